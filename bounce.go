@@ -0,0 +1,72 @@
+package dmail
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+)
+
+const (
+	bounceSender  = "MAILER-DAEMON"
+	bounceSubject = "Undelivered Mail Returned to Sender"
+)
+
+// bounce queues a delivery status notification (RFC 3464) of the failed recipients
+// to the sender of the message. Bounces themselves have the null sender and are never bounced.
+func (this *Queue) bounce(env *envelope, failed []*queueRecipient, raw []byte) error {
+	if env.From == "" {
+		return nil
+	}
+	host := this.conf.Hostname
+	now := this.now()
+	boundary := fmt.Sprintf("%s/%s", env.Id, host)
+
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "From: Mail Delivery System <%s@%s>\r\n", bounceSender, host)
+	fmt.Fprintf(buf, "To: <%s>\r\n", env.From)
+	fmt.Fprintf(buf, "Subject: %s\r\n", bounceSubject)
+	fmt.Fprintf(buf, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Message-ID: <%s.bounce@%s>\r\n", env.Id, host)
+	buf.WriteString("Auto-Submitted: auto-replied\r\n")
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(buf, "Content-Type: multipart/report; report-type=delivery-status;\r\n\tboundary=\"%s\"\r\n\r\n", boundary)
+
+	fmt.Fprintf(buf, "--%s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n", boundary)
+	fmt.Fprintf(buf, "This is the mail system at host %s.\r\n\r\n", host)
+	buf.WriteString("Your message could not be delivered to the following recipients:\r\n\r\n")
+	for _, rcpt := range failed {
+		fmt.Fprintf(buf, "<%s>: %s\r\n", rcpt.Address, rcpt.Detail)
+	}
+
+	fmt.Fprintf(buf, "\r\n--%s\r\nContent-Type: message/delivery-status\r\n\r\n", boundary)
+	fmt.Fprintf(buf, "Reporting-MTA: dns; %s\r\n", host)
+	fmt.Fprintf(buf, "Arrival-Date: %s\r\n", env.Created.Format(time.RFC1123Z))
+	for _, rcpt := range failed {
+		status := rcpt.Status
+		if status == "" {
+			status = "5.0.0"
+		}
+		fmt.Fprintf(buf, "\r\nFinal-Recipient: rfc822; %s\r\n", rcpt.Address)
+		buf.WriteString("Action: failed\r\n")
+		fmt.Fprintf(buf, "Status: %s\r\n", status)
+		if rcpt.Code != 0 {
+			fmt.Fprintf(buf, "Diagnostic-Code: smtp; %s\r\n", rcpt.Detail)
+		}
+		fmt.Fprintf(buf, "Last-Attempt-Date: %s\r\n", rcpt.Updated.Format(time.RFC1123Z))
+	}
+
+	fmt.Fprintf(buf, "\r\n--%s\r\nContent-Type: text/rfc822-headers\r\n\r\n", boundary)
+	headers := raw
+	if i := bytes.Index(raw, []byte("\r\n\r\n")); i != -1 {
+		headers = raw[:i+2]
+	}
+	buf.Write(headers)
+	fmt.Fprintf(buf, "\r\n--%s--\r\n", boundary)
+
+	b, err := this.sender.signRaw(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = this.Enqueue("", []string{env.From}, b)
+	return err
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dtynn/dmail/dkim"
+)
+
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	keyType := fs.String("type", string(dkim.KeyTypeRsa), "key type, rsa (2048 bits) or ed25519")
+	domain := fs.String("domain", "", "signing domain")
+	selector := fs.String("selector", "dkim", "selector")
+	out := fs.String("out", "", "private key file, default <selector>.<domain>.pem")
+	fs.Parse(args)
+
+	if *domain == "" {
+		fs.Usage()
+		return fmt.Errorf("domain required")
+	}
+	if *out == "" {
+		*out = *selector + "." + *domain + ".pem"
+	}
+
+	pemBytes, record, err := dkim.GenerateKey(dkim.KeyType(*keyType))
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(pemBytes); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "private key written to %s\n", *out)
+	fmt.Println(dkim.ZoneRecord(*domain, *selector, record))
+	return nil
+}
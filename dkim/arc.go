@@ -0,0 +1,365 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dtynn/dmail/message"
+)
+
+// ARC (Authenticated Received Chain) of RFC 8617
+
+type ChainStatus string
+
+const (
+	ChainNone ChainStatus = "none"
+	ChainPass ChainStatus = "pass"
+	ChainFail ChainStatus = "fail"
+)
+
+var (
+	ArcSealHeaderName        = "ARC-Seal"
+	ArcSignatureHeaderName   = "ARC-Message-Signature"
+	ArcAuthResultsHeaderName = "ARC-Authentication-Results"
+)
+
+const maxArcInstance = 50
+
+var (
+	errArcChainFailed = fmt.Errorf("arc chain already failed")
+	errArcAlgorithm   = fmt.Errorf("arc requires a rsa key")
+)
+
+type arcSet struct {
+	aar, ams, as *rawHeader
+}
+
+// ArcResult is the validation result of the ARC chain of a message.
+type ArcResult struct {
+	Status   ChainStatus
+	Reason   string
+	Instance int
+	Domain   string
+	Selector string
+}
+
+func arcFail(instance int, format string, v ...interface{}) *ArcResult {
+	return &ArcResult{Status: ChainFail, Instance: instance, Reason: fmt.Sprintf(format, v...)}
+}
+
+// arcInstance returns the i= tag of an ARC header.
+func arcInstance(h *rawHeader) (int, error) {
+	value := h.value()
+	if strings.EqualFold(h.field, ArcAuthResultsHeaderName) {
+		if i := strings.Index(value, ";"); i != -1 {
+			value = value[:i]
+		}
+	}
+	tags, err := parseTagList(value)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(tags["i"])
+	if err != nil || n < 1 || n > maxArcInstance {
+		return 0, fmt.Errorf("invalid instance %q", tags["i"])
+	}
+	return n, nil
+}
+
+// collectArcSets groups the ARC headers by instance.
+func collectArcSets(headers []*rawHeader) (map[int]*arcSet, int, error) {
+	sets := map[int]*arcSet{}
+	max := 0
+	for _, h := range headers {
+		isSeal := strings.EqualFold(h.field, ArcSealHeaderName)
+		isSignature := strings.EqualFold(h.field, ArcSignatureHeaderName)
+		isAuthResults := strings.EqualFold(h.field, ArcAuthResultsHeaderName)
+		if !isSeal && !isSignature && !isAuthResults {
+			continue
+		}
+
+		n, err := arcInstance(h)
+		if err != nil {
+			return nil, 0, err
+		}
+		set, ok := sets[n]
+		if !ok {
+			set = &arcSet{}
+			sets[n] = set
+		}
+
+		slot := &set.aar
+		if isSeal {
+			slot = &set.as
+		} else if isSignature {
+			slot = &set.ams
+		}
+		if *slot != nil {
+			return nil, 0, fmt.Errorf("duplicate %s for instance %d", h.field, n)
+		}
+		*slot = h
+		if n > max {
+			max = n
+		}
+	}
+	return sets, max, nil
+}
+
+// latestChainStatus returns the cv= of the most recent seal, if any.
+func latestChainStatus(headers []*rawHeader) ChainStatus {
+	sets, max, err := collectArcSets(headers)
+	if err != nil || max == 0 || sets[max].as == nil {
+		return ChainNone
+	}
+	tags, err := parseTagList(sets[max].as.value())
+	if err != nil {
+		return ChainNone
+	}
+	return ChainStatus(tags["cv"])
+}
+
+// VerifyArc validates the ARC chain of a raw message using the default resolver.
+func VerifyArc(raw []byte) (*ArcResult, error) {
+	return defaultVerifier.VerifyArc(raw)
+}
+
+// VerifyArc validates the ARC chain of a raw message as described in RFC 8617 section 5.2.
+func (this *Verifier) VerifyArc(raw []byte) (*ArcResult, error) {
+	headers, body, err := splitMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	return this.verifyArc(headers, body), nil
+}
+
+func (this *Verifier) verifyArc(headers []*rawHeader, body []byte) *ArcResult {
+	sets, max, err := collectArcSets(headers)
+	if err != nil {
+		return arcFail(0, "%s", err)
+	}
+	if max == 0 {
+		return &ArcResult{Status: ChainNone}
+	}
+
+	for i := 1; i <= max; i++ {
+		set, ok := sets[i]
+		if !ok || set.aar == nil || set.ams == nil || set.as == nil {
+			return arcFail(max, "incomplete arc set %d", i)
+		}
+	}
+
+	seals := make([]map[string]string, max+1)
+	for i := 1; i <= max; i++ {
+		tags, err := parseTagList(sets[i].as.value())
+		if err != nil {
+			return arcFail(max, "malformed seal %d: %s", i, err)
+		}
+		seals[i] = tags
+	}
+	if ChainStatus(seals[max]["cv"]) == ChainFail {
+		return arcFail(max, "chain failed at instance %d", max)
+	}
+	for i := 1; i <= max; i++ {
+		expect := ChainPass
+		if i == 1 {
+			expect = ChainNone
+		}
+		if ChainStatus(seals[i]["cv"]) != expect {
+			return arcFail(max, "unexpected cv for instance %d", i)
+		}
+	}
+
+	latest := sets[max].ams
+	for index, h := range headers {
+		if h != latest {
+			continue
+		}
+		sig, verr := parseSignature(h.value(), true)
+		if verr == nil {
+			verr = this.check(sig, headers, index, body)
+		}
+		if verr != nil {
+			return arcFail(max, "message signature %d: %s", max, verr.reason)
+		}
+	}
+
+	for i := max; i >= 1; i-- {
+		if verr := this.checkSeal(sets, i, seals[i]); verr != nil {
+			return arcFail(max, "seal %d: %s", i, verr.reason)
+		}
+	}
+
+	return &ArcResult{
+		Status:   ChainPass,
+		Instance: max,
+		Domain:   strings.ToLower(seals[max]["d"]),
+		Selector: seals[max]["s"],
+	}
+}
+
+// sealHash hashes the given arc sets in order, the last seal without its signature.
+func sealHash(sets []*arcSet) []byte {
+	hasher := sha256.New()
+	last := len(sets) - 1
+	for i, set := range sets {
+		hasher.Write([]byte(canonRawHeader("relaxed", set.aar)))
+		hasher.Write([]byte(canonRawHeader("relaxed", set.ams)))
+		if i < last {
+			hasher.Write([]byte(canonRawHeader("relaxed", set.as)))
+		}
+	}
+	self := &rawHeader{sets[last].as.field, cutBTag(sets[last].as.raw)}
+	hasher.Write([]byte(strings.TrimSuffix(canonRawHeader("relaxed", self), "\r\n")))
+	return hasher.Sum(nil)
+}
+
+// chainSets returns the arc sets 1 to n in order.
+func chainSets(sets map[int]*arcSet, n int) []*arcSet {
+	chain := make([]*arcSet, 0, n)
+	for i := 1; i <= n; i++ {
+		chain = append(chain, sets[i])
+	}
+	return chain
+}
+
+func (this *Verifier) checkSeal(sets map[int]*arcSet, n int, tags map[string]string) *verifyError {
+	for _, name := range []string{"a", "b", "cv", "d", "s"} {
+		if _, has := tags[name]; !has {
+			return permError("missing tag %s", name)
+		}
+	}
+	if _, has := tags["h"]; has {
+		return permError("h tag not allowed in seal")
+	}
+	if strings.ToLower(tags["a"]) != algorithmRsaSha256 {
+		return permError("unsupported algorithm %q", tags["a"])
+	}
+
+	b, err := base64.StdEncoding.DecodeString(stripWhitespace(tags["b"]))
+	if err != nil {
+		return permError("malformed b tag")
+	}
+
+	sig := &signature{domain: strings.ToLower(tags["d"]), selector: tags["s"]}
+	key, verr := this.lookupKey(sig)
+	if verr != nil {
+		return verr
+	}
+	if key.keyType != "rsa" {
+		return permError("key type does not match algorithm")
+	}
+	if !verifyDigest(key.key, crypto.SHA256, sealHash(chainSets(sets, n)), b) {
+		return failure("seal did not verify")
+	}
+	return nil
+}
+
+// ArcSealer adds ARC sets to forwarded messages.
+type ArcSealer struct {
+	conf     *DkimConf
+	verifier *Verifier
+	now      func() time.Time
+}
+
+func NewArcSealer(conf *DkimConf, v *Verifier) *ArcSealer {
+	if v == nil {
+		v = defaultVerifier
+	}
+	return &ArcSealer{conf, v, time.Now}
+}
+
+// Seal validates the existing chain of a raw message and returns the new ARC set
+// in the order it should be prepended to the message:
+// ARC-Seal, ARC-Message-Signature, ARC-Authentication-Results.
+// authResults is the content of the local Authentication-Results header without the authserv-id.
+func (this *ArcSealer) Seal(raw []byte, authservId, authResults string) ([]message.Header, *ArcResult, error) {
+	headers, body, err := splitMessage(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if latestChainStatus(headers) == ChainFail {
+		return nil, nil, errArcChainFailed
+	}
+	chain := this.verifier.verifyArc(headers, body)
+	if chain.Status == ChainFail && chain.Instance == 0 {
+		return nil, chain, fmt.Errorf("malformed arc headers: %s", chain.Reason)
+	}
+	n := chain.Instance + 1
+	if n > maxArcInstance {
+		return nil, chain, fmt.Errorf("too many arc sets")
+	}
+
+	signer, err := this.conf.getSigner()
+	if err != nil {
+		return nil, chain, err
+	}
+	if signer.Algorithm() != algorithmRsaSha256 {
+		return nil, chain, errArcAlgorithm
+	}
+	t := this.now().Unix()
+
+	if authResults == "" {
+		authResults = "none"
+	}
+	aarValue := fmt.Sprintf("i=%d; %s; %s", n, authservId, authResults)
+	aar := &rawHeader{ArcAuthResultsHeaderName, ArcAuthResultsHeaderName + ": " + aarValue}
+
+	// message signature over the same headers as the dkim signer
+	fields := []string{}
+	for _, h := range headers {
+		field := strings.ToLower(h.field)
+		if stringIn(field, headersMust) || stringIn(field, headersShould) {
+			fields = append(fields, h.field)
+		}
+	}
+	bodyHasher := sha256.New()
+	w := NewBodyCanonicalizer(bodyHasher, "relaxed", -1)
+	w.Write(body)
+	w.Close()
+	bh := base64.StdEncoding.EncodeToString(bodyHasher.Sum(nil))
+	amsValue := fmt.Sprintf("i=%d; a=rsa-sha256; c=relaxed/relaxed; d=%s; s=%s; t=%d; h=%s; bh=%s; b=",
+		n, this.conf.domain, this.conf.selector, t, strings.Join(fields, " : "), bh)
+
+	hasher := sha256.New()
+	for _, h := range selectHeaders(headers, nil, fields) {
+		hasher.Write([]byte(canonRawHeader("relaxed", h)))
+	}
+	amsHeader := &rawHeader{ArcSignatureHeaderName, ArcSignatureHeaderName + ": " + amsValue}
+	hasher.Write([]byte(strings.TrimSuffix(canonRawHeader("relaxed", amsHeader), "\r\n")))
+	b, err := signer.SignHash(hasher)
+	if err != nil {
+		return nil, chain, err
+	}
+	// the folded value is what the seal covers
+	amsValue = foldHeader(amsValue + b)
+	ams := &rawHeader{ArcSignatureHeaderName, ArcSignatureHeaderName + ": " + amsValue}
+
+	// seal over all sets including the new one
+	cv := chain.Status
+	asValue := fmt.Sprintf("i=%d; a=rsa-sha256; t=%d; cv=%s; d=%s; s=%s; b=",
+		n, t, cv, this.conf.domain, this.conf.selector)
+	set := &arcSet{aar, ams, &rawHeader{ArcSealHeaderName, ArcSealHeaderName + ": " + asValue}}
+	sealed := []*arcSet{set}
+	if cv == ChainPass {
+		// with a failed chain the seal only covers its own set
+		sets, _, _ := collectArcSets(headers)
+		sealed = append(chainSets(sets, chain.Instance), set)
+	}
+	seal, err := signer.signDigest(sealHash(sealed))
+	if err != nil {
+		return nil, chain, err
+	}
+	asValue = foldHeader(asValue + seal)
+
+	return []message.Header{
+		message.NewNormalHeader(ArcSealHeaderName, asValue),
+		message.NewNormalHeader(ArcSignatureHeaderName, amsValue),
+		message.NewNormalHeader(ArcAuthResultsHeaderName, aarValue),
+	}, chain, nil
+}
@@ -0,0 +1,82 @@
+package dkim
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dtynn/dmail/message"
+)
+
+func prependHeaders(raw []byte, headers []message.Header) []byte {
+	buf := new(bytes.Buffer)
+	for _, h := range headers {
+		buf.WriteString(h.String() + "\r\n")
+	}
+	buf.Write(raw)
+	return buf.Bytes()
+}
+
+func TestArc(t *testing.T) {
+	v := NewVerifier(fakeResolver{
+		"abc._domainkey.dtynn.me":  {testKeyRecord(t)},
+		"list._domainkey.dtynn.me": {testKeyRecord(t)},
+	})
+
+	raw := signedTestMessage(t, "abc", false)
+	result, err := v.VerifyArc(raw)
+	if err != nil {
+		t.Fatal("verify arc: ", err)
+	}
+	if result.Status != ChainNone {
+		t.Fatalf("expect none, get %s", result.Status)
+	}
+
+	sealer := NewArcSealer(NewDkimConf("dtynn.me", "", "list", false, testPrivateKey), v)
+	headers, chain, err := sealer.Seal(raw, "mx.dtynn.me", "dkim=pass header.d=dtynn.me")
+	if err != nil {
+		t.Fatal("seal: ", err)
+	}
+	if chain.Status != ChainNone || len(headers) != 3 {
+		t.Fatalf("unexpected first seal %v %d", chain, len(headers))
+	}
+	raw = prependHeaders(raw, headers)
+
+	// a mailing list modifies the subject and seals again
+	raw = bytes.Replace(raw, []byte("Subject: verify   me"), []byte("Subject: [list] verify me"), 1)
+	headers, chain, err = sealer.Seal(raw, "list.dtynn.me", "arc=pass")
+	if err != nil {
+		t.Fatal("seal: ", err)
+	}
+	if chain.Status != ChainFail {
+		t.Fatalf("expect the modified message to fail the first signature, get %s", chain.Status)
+	}
+	if _, _, err := sealer.Seal(prependHeaders(raw, headers), "mx.example.com", "arc=fail"); err != errArcChainFailed {
+		t.Errorf("expect sealing a failed chain to be refused, get %v", err)
+	}
+
+	// the list seals before modifying
+	raw = bytes.Replace(raw, []byte("Subject: [list] verify me"), []byte("Subject: verify   me"), 1)
+	headers, chain, err = sealer.Seal(raw, "list.dtynn.me", "arc=pass")
+	if err != nil || chain.Status != ChainPass {
+		t.Fatalf("second seal: %v %v", chain, err)
+	}
+	raw = prependHeaders(raw, headers)
+
+	result, err = v.VerifyArc(raw)
+	if err != nil {
+		t.Fatal("verify arc: ", err)
+	}
+	if result.Status != ChainPass || result.Instance != 2 || result.Selector != "list" {
+		t.Errorf("expect pass at instance 2, get %+v", result)
+	}
+
+	tampered := append(raw[:len(raw)-2], []byte("tampered\r\n")...)
+	if result, _ = v.VerifyArc(tampered); result.Status != ChainFail {
+		t.Errorf("expect fail for tampered body, get %+v", result)
+	}
+
+	broken := bytes.Replace(raw, []byte("ARC-Seal: i=1;"), []byte("X-Old-Seal: i=1;"), 1)
+	if result, _ = v.VerifyArc(broken); result.Status != ChainFail {
+		t.Errorf("expect fail for missing seal, get %+v", result)
+	}
+}
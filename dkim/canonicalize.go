@@ -1,6 +1,9 @@
 package dkim
 
 import (
+	"bytes"
+	"io"
+
 	"github.com/dtynn/dmail/utils"
 )
 
@@ -12,7 +15,7 @@ func simpleHeader(h string) string {
 }
 
 func simpleBody(body string) string {
-	return stripTrailingLine(body)
+	return canonicalizeBody("simple", body)
 }
 
 func relaxedHeader(h string) string {
@@ -20,7 +23,15 @@ func relaxedHeader(h string) string {
 }
 
 func relaxedBody(body string) string {
-	return stripTrailingLine(compressWhitespace(stripTrailingWhitespace(body)))
+	return canonicalizeBody("relaxed", body)
+}
+
+func canonicalizeBody(c, body string) string {
+	buf := new(bytes.Buffer)
+	w := NewBodyCanonicalizer(buf, c, -1)
+	w.Write([]byte(body))
+	w.Close()
+	return buf.String()
 }
 
 type canon struct {
@@ -30,3 +41,123 @@ type canon struct {
 func (this *canon) String() string {
 	return this.header + "/" + this.body
 }
+
+// BodyCanonicalizer canonicalizes a body written in any chunks as described in RFC 6376 section 3.4
+// and passes at most limit bytes of the result on, e.g. to the hash of the bh= tag.
+// Lone LF ends a line like CRLF, lone CR is ordinary content.
+type BodyCanonicalizer struct {
+	w       io.Writer
+	relaxed bool
+	limit   int64
+	n       int64
+	out     []byte
+	err     error
+
+	cr         bool // CR seen, waiting for LF
+	wsp        bool // white space seen in the line (relaxed)
+	content    bool // the line has content
+	emptyLines int  // empty lines not written yet
+}
+
+// NewBodyCanonicalizer returns a "simple" or "relaxed" canonicalizer writing to w.
+// A negative limit writes the whole body.
+func NewBodyCanonicalizer(w io.Writer, c string, limit int64) *BodyCanonicalizer {
+	return &BodyCanonicalizer{w: w, relaxed: c == "relaxed", limit: limit}
+}
+
+func (this *BodyCanonicalizer) Write(p []byte) (int, error) {
+	if this.err != nil {
+		return 0, this.err
+	}
+	for _, c := range p {
+		if this.cr {
+			this.cr = false
+			if c == '\n' {
+				this.endLine()
+				continue
+			}
+			this.emit('\r')
+		}
+
+		switch {
+		case c == '\r':
+			this.cr = true
+		case c == '\n':
+			this.endLine()
+		case this.relaxed && (c == ' ' || c == '\t'):
+			this.wsp = true
+		default:
+			this.emit(c)
+		}
+	}
+	this.flush()
+	return len(p), this.err
+}
+
+func (this *BodyCanonicalizer) emit(c byte) {
+	if !this.content {
+		for ; this.emptyLines > 0; this.emptyLines-- {
+			this.out = append(this.out, bytesLineSep...)
+		}
+		this.content = true
+	}
+	if this.wsp {
+		this.out = append(this.out, ' ')
+		this.wsp = false
+	}
+	this.out = append(this.out, c)
+}
+
+func (this *BodyCanonicalizer) endLine() {
+	// relaxed drops white space at the end of lines
+	this.wsp = false
+	if !this.content {
+		this.emptyLines += 1
+		return
+	}
+	this.out = append(this.out, bytesLineSep...)
+	this.content = false
+}
+
+func (this *BodyCanonicalizer) flush() {
+	out := this.out
+	this.n += int64(len(out))
+	if this.limit >= 0 {
+		written := this.n - int64(len(out))
+		if written >= this.limit {
+			out = nil
+		} else if written+int64(len(out)) > this.limit {
+			out = out[:this.limit-written]
+		}
+	}
+	if len(out) != 0 {
+		_, this.err = this.w.Write(out)
+	}
+	this.out = this.out[:0]
+}
+
+// Close completes the last line. Trailing empty lines are dropped,
+// an empty body is CRLF with simple and empty with relaxed.
+func (this *BodyCanonicalizer) Close() error {
+	if this.err != nil {
+		return this.err
+	}
+	if this.cr {
+		this.cr = false
+		this.emit('\r')
+	}
+	this.wsp = false
+	if this.content {
+		this.endLine()
+	} else if !this.relaxed && this.n == 0 {
+		this.out = append(this.out, bytesLineSep...)
+	}
+	this.emptyLines = 0
+	this.flush()
+	return this.err
+}
+
+// Len returns the length of the whole canonicalized body, regardless of the limit.
+func (this *BodyCanonicalizer) Len() int64 {
+	return this.n
+}
@@ -0,0 +1,56 @@
+package dkim
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBodyCanonicalizer(t *testing.T) {
+	cases := []struct {
+		body, simple, relaxed string
+	}{
+		{"", "\r\n", ""},
+		{"\r\n\r\n", "\r\n", ""},
+		{"abc", "abc\r\n", "abc\r\n"},
+		// RFC 6376 section 3.4.5
+		{" C \r\nD \t E\r\n\r\n\r\n", " C \r\nD \t E\r\n", " C\r\nD E\r\n"},
+		{"a\nb\n", "a\r\nb\r\n", "a\r\nb\r\n"},
+		{"a\rb\r\n", "a\rb\r\n", "a\rb\r\n"},
+		{"a\r", "a\r\r\n", "a\r\r\n"},
+		{"a\r\n \t\r\n\r\n", "a\r\n \t\r\n", "a\r\n"},
+		{"a\r\n  \r\nb  ", "a\r\n  \r\nb  \r\n", "a\r\n\r\nb\r\n"},
+	}
+
+	for _, c := range cases {
+		for name, expect := range map[string]string{"simple": c.simple, "relaxed": c.relaxed} {
+			if got := canonicalizeBody(name, c.body); got != expect {
+				t.Errorf("%s %q: expect %q, get %q", name, c.body, expect, got)
+			}
+
+			// byte by byte
+			buf := new(bytes.Buffer)
+			w := NewBodyCanonicalizer(buf, name, -1)
+			for i := 0; i < len(c.body); i++ {
+				w.Write([]byte{c.body[i]})
+			}
+			w.Close()
+			if buf.String() != expect || w.Len() != int64(len(expect)) {
+				t.Errorf("%s %q in chunks: expect %q, get %q", name, c.body, expect, buf.String())
+			}
+		}
+	}
+}
+
+func TestBodyCanonicalizerLimit(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := NewBodyCanonicalizer(buf, "relaxed", 7)
+	w.Write([]byte("hello  "))
+	w.Write([]byte("world \r\n\r\n"))
+	w.Close()
+	if buf.String() != "hello w" {
+		t.Errorf("expect %q, get %q", "hello w", buf.String())
+	}
+	if w.Len() != 13 {
+		t.Errorf("expect length 13, get %d", w.Len())
+	}
+}
@@ -1,11 +1,46 @@
 package dkim
 
+import (
+	"crypto"
+	"sync"
+)
+
 type DkimConf struct {
 	domain, identity, selector string
 	setLength                  bool
 	pemBytes                   []byte
+
+	once   sync.Once
+	signer signer
+	err    error
 }
 
+// NewDkimConf returns a conf signing with a PEM encoded key, see ParsePrivateKey.
+// The key is parsed on first use and reused afterwards.
 func NewDkimConf(domain, identity, selector string, setLength bool, pemBytes []byte) *DkimConf {
-	return &DkimConf{domain, identity, selector, setLength, pemBytes}
+	return &DkimConf{domain: domain, identity: identity, selector: selector, setLength: setLength, pemBytes: pemBytes}
+}
+
+// NewDkimConfWithKey returns a conf signing with any rsa or ed25519 crypto.Signer,
+// e.g. a key held by a PKCS#11 module or a remote signing service.
+func NewDkimConfWithKey(domain, identity, selector string, setLength bool, key crypto.Signer) (*DkimConf, error) {
+	s, err := newKeySigner(key)
+	if err != nil {
+		return nil, err
+	}
+	return &DkimConf{domain: domain, identity: identity, selector: selector, setLength: setLength, signer: s}, nil
+}
+
+// Domain returns the signing domain, d=.
+func (this *DkimConf) Domain() string {
+	return this.domain
+}
+
+func (this *DkimConf) getSigner() (signer, error) {
+	this.once.Do(func() {
+		if this.signer == nil {
+			this.signer, this.err = newSigner(this.pemBytes)
+		}
+	})
+	return this.signer, this.err
 }
@@ -2,8 +2,8 @@ package dkim
 
 import (
 	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
-	"hash"
 	"strconv"
 	"strings"
 	"time"
@@ -13,19 +13,49 @@ import (
 
 var bBlank = ""
 
-var bytesColon = []byte(":")
-var bytesLineSep = []byte("\r\n")
 var DkimHeaderName = "DKIM-Signature"
-var bytesLowerDkimHeaderName = []byte(strings.ToLower(DkimHeaderName))
+
+var errMissingMustHeaders = fmt.Errorf("not all MUST headers included")
+
+// Options control how a message is signed.
+type Options struct {
+	// "simple" or "relaxed"
+	HeaderCanonicalization string
+	BodyCanonicalization   string
+
+	// Headers lists the fields to sign, every instance of a listed field is signed.
+	// nil signs the recommended fields of RFC 6376 section 5.4.1 present in the message.
+	Headers []string
+
+	// OverSign lists fields signed once more than they appear, so adding an instance,
+	// even of an absent field, breaks the signature (RFC 6376 section 8.15).
+	OverSign []string
+
+	// Expiration sets x= relative to the signing time, 0 omits it.
+	Expiration time.Duration
+
+	// CopyHeaders adds the signed header fields as z= for diagnostics.
+	CopyHeaders bool
+}
+
+func DefaultOptions() *Options {
+	return &Options{
+		HeaderCanonicalization: "relaxed",
+		BodyCanonicalization:   "simple",
+		OverSign:               headersOverSign,
+	}
+}
 
 type dkim struct {
 	v, // version
-	a, // algorithm "rsa-sha256"
+	a, // algorithm "rsa-sha256" or "ed25519-sha256"
 	bh, // body hash
 	d, // domain "example.com"
+	h, // signed header fields
 	i, // identity "@<domain>"
 	q, // query methods "dns/txt"
-	s string // selector
+	s, // selector
+	z string // copied header fields
 
 	setLength bool
 	c         *canon // canonicalization "relaxed/simple"
@@ -34,74 +64,83 @@ type dkim struct {
 	t, // unix timestamp
 	x int64 // expiration
 
-	included *dkimHeaders
-	musts    map[string]bool
-	message  *message.Message
-	pemBytes []byte
+	opts    *Options
+	message *message.Message
+	conf    *DkimConf
 }
 
 func NewDefaultDkim(message *message.Message, conf *DkimConf) *dkim {
-	c := canon{"relaxed", "simple"}
-	musts := map[string]bool{}
-	for _, must := range headersMust {
-		musts[must] = false
+	return NewDkim(message, conf, nil)
+}
+
+// NewDkim returns a signer of the message, nil options are DefaultOptions.
+func NewDkim(message *message.Message, conf *DkimConf, opts *Options) *dkim {
+	if opts == nil {
+		opts = DefaultOptions()
 	}
 	return &dkim{
 		v:         "1",
-		a:         "rsa-sha256",
+		a:         algorithmRsaSha256,
 		d:         conf.domain,
 		i:         conf.identity,
 		q:         "dns/txt",
 		s:         conf.selector,
 		setLength: conf.setLength,
-		c:         &c,
+		c:         &canon{opts.HeaderCanonicalization, opts.BodyCanonicalization},
 		t:         time.Now().Unix(),
 
-		included: newDkimHeader(),
-		musts:    musts,
-		message:  message,
-		pemBytes: conf.pemBytes,
+		opts:    opts,
+		message: message,
+		conf:    conf,
 	}
 }
 
-func (this *dkim) includeHeaders() {
-	for _, mh := range this.message.Headers() {
-		field := strings.ToLower(mh.Field())
-		if isMust := stringIn(field, headersMust); isMust || stringIn(field, headersShould) {
-			// should sign
-			if isMust {
-				this.musts[field] = true
+// signedFields returns the h= list and the header instances it covers.
+func (this *dkim) signedFields(headers []*rawHeader) ([]string, []*rawHeader) {
+	fields := []string{}
+	if this.opts.Headers == nil {
+		for _, h := range headers {
+			field := strings.ToLower(h.field)
+			if stringIn(field, headersMust) || stringIn(field, headersShould) {
+				fields = append(fields, h.field)
+			}
+		}
+	} else {
+		for _, name := range this.opts.Headers {
+			for _, h := range headers {
+				if strings.EqualFold(h.field, name) {
+					fields = append(fields, name)
+				}
 			}
-			canonicalizer, _ := canonHeaders[this.c.header]
-			this.included.append(message.NewNormalHeader(mh.Field(), canonicalizer(mh.Value())))
 		}
 	}
-	return
-}
-
-func (this *dkim) hashHeaders() hash.Hash {
-	toHash := this.included.toHash()
-	hasher := sha256.New()
-	for _, h := range toHash {
-		hasher.Write([]byte(h.Field()))
-		hasher.Write(bytesColon)
-		hasher.Write([]byte(h.Value()))
-		hasher.Write(bytesLineSep)
+	// the present instances of over-signed fields are signed too, whatever Headers lists
+	for _, name := range this.opts.OverSign {
+		if fieldIn(name, fields) {
+			continue
+		}
+		for _, h := range headers {
+			if strings.EqualFold(h.field, name) {
+				fields = append(fields, name)
+			}
+		}
 	}
-
-	hasher.Write(bytesLowerDkimHeaderName)
-	hasher.Write(bytesColon)
-	hasher.Write([]byte(this.signature(bBlank)))
-	return hasher
+	selected := selectHeaders(headers, nil, fields)
+	for _, name := range this.opts.OverSign {
+		fields = append(fields, name)
+	}
+	return fields, selected
 }
 
-func (this *dkim) hashBody() {
-	canonicalizer, _ := canonBody[this.c.body]
-	canonedBody := canonicalizer(string(this.message.EncodeBody()))
+func (this *dkim) hashBody(body []byte) {
+	hasher := sha256.New()
+	w := NewBodyCanonicalizer(hasher, this.c.body, -1)
+	w.Write(body)
+	w.Close()
 	if this.setLength {
-		this.l = int64(len(canonedBody))
+		this.l = w.Len()
 	}
-	this.bh = generateSha256Hash(canonedBody)
+	this.bh = base64.StdEncoding.EncodeToString(hasher.Sum(nil))
 }
 
 func (this *dkim) tags(bv string) []string {
@@ -115,11 +154,17 @@ func (this *dkim) tags(bv string) []string {
 		makeDkimTag("s", this.s),
 		makeDkimTag("t", strconv.Itoa(int(this.t))),
 	}
+	if this.x > 0 {
+		tags = append(tags, makeDkimTag("x", strconv.Itoa(int(this.x))))
+	}
 	if this.setLength {
 		tags = append(tags, makeDkimTag("l", strconv.Itoa(int(this.l))))
 	}
+	tags = append(tags, makeDkimTag("h", this.h))
+	if this.z != "" {
+		tags = append(tags, makeDkimTag("z", this.z))
+	}
 	tags = append(tags,
-		makeDkimTag("h", this.included.h()),
 		makeDkimTag("bh", this.bh),
 		makeDkimTag("b", bv))
 	return tags
@@ -129,34 +174,59 @@ func (this *dkim) signature(bv string) string {
 	return strings.Join(this.tags(bv), "; ")
 }
 
-func (this *dkim) checkMusts() bool {
-	for _, ok := range this.musts {
-		if !ok {
-			return false
-		}
-	}
-	return true
+func (this *dkim) Sign() (string, error) {
+	return this.signRaw(this.message.Bytes())
 }
 
-func (this *dkim) Sign() (string, error) {
+func (this *dkim) signRaw(raw []byte) (string, error) {
+	if _, ok := canonHeaders[this.c.header]; !ok {
+		return "", fmt.Errorf("unsupported canonicalization %q", this.c)
+	}
+	if _, ok := canonBody[this.c.body]; !ok {
+		return "", fmt.Errorf("unsupported canonicalization %q", this.c)
+	}
+
+	headers, body, err := splitMessage(raw)
+	if err != nil {
+		return "", err
+	}
 	// get body and hash
-	this.hashBody()
+	this.hashBody(body)
 	// get headers
-	this.includeHeaders()
-	// hash headers
-	if checked := this.checkMusts(); !checked {
-		return "", fmt.Errorf("not all MUST headers included")
+	fields, selected := this.signedFields(headers)
+	for _, must := range headersMust {
+		if !stringIn(must, lowerFields(selected)) {
+			return "", errMissingMustHeaders
+		}
+	}
+	this.h = strings.Join(fields, " : ")
+	if this.opts.CopyHeaders {
+		this.z = copyHeaders(selected)
+	}
+	if this.opts.Expiration > 0 {
+		this.x = this.t + int64(this.opts.Expiration/time.Second)
 	}
 
-	signer, err := newSigner(this.pemBytes)
+	signer, err := this.conf.getSigner()
 	if err != nil {
 		return "", err
 	}
-	bv, err := signer.SignHash(this.hashHeaders())
+	this.a = signer.Algorithm()
+
+	// hash headers the way a verifier sees them, the signature is only appended to the folded value
+	unsigned := foldHeader(this.signature(bBlank))
+	hasher := sha256.New()
+	for _, h := range selected {
+		hasher.Write([]byte(canonRawHeader(this.c.header, h)))
+	}
+	self := &rawHeader{DkimHeaderName, DkimHeaderName + ": " + unsigned}
+	hasher.Write([]byte(strings.TrimSuffix(canonRawHeader(this.c.header, self), "\r\n")))
+
+	bv, err := signer.SignHash(hasher)
 	if err != nil {
 		return "", err
 	}
-	return foldHeader(this.signature(bv)), nil
+	return foldAppend(unsigned, bv), nil
 }
 
 func (this *dkim) SignatureHeader() (message.Header, error) {
@@ -167,3 +237,57 @@ func (this *dkim) SignatureHeader() (message.Header, error) {
 
 	return message.NewNormalHeader(DkimHeaderName, sig), nil
 }
+
+// SignRaw signs a serialized message, nil options are DefaultOptions.
+func SignRaw(raw []byte, conf *DkimConf, opts *Options) (message.Header, error) {
+	sig, err := NewDkim(nil, conf, opts).signRaw(raw)
+	if err != nil {
+		return nil, err
+	}
+	return message.NewNormalHeader(DkimHeaderName, sig), nil
+}
+
+// SignatureHeaders signs the message once per conf, e.g. with both a rsa and an ed25519 key.
+// None of the signatures covers the others.
+func SignatureHeaders(msg *message.Message, confs ...*DkimConf) ([]message.Header, error) {
+	headers := make([]message.Header, 0, len(confs))
+	for _, conf := range confs {
+		header, err := NewDefaultDkim(msg, conf).SignatureHeader()
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, header)
+	}
+	return headers, nil
+}
+
+func lowerFields(headers []*rawHeader) []string {
+	fields := make([]string, len(headers))
+	for i, h := range headers {
+		fields[i] = strings.ToLower(h.field)
+	}
+	return fields
+}
+
+// copyHeaders builds the z= value of RFC 6376 section 3.5.
+func copyHeaders(headers []*rawHeader) string {
+	copied := make([]string, len(headers))
+	for i, h := range headers {
+		copied[i] = h.field + ":" + quotePrintable(strings.TrimLeft(unfoldHeader(h.value()), " \t"))
+	}
+	return strings.Join(copied, "|")
+}
+
+// quotePrintable encodes a value as dkim-quoted-printable, including "|" for z=.
+func quotePrintable(s string) string {
+	buf := new(strings.Builder)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c <= ' ' || c >= 0x7f || c == ';' || c == '=' || c == '|' {
+			fmt.Fprintf(buf, "=%02X", c)
+		} else {
+			buf.WriteByte(c)
+		}
+	}
+	return buf.String()
+}
@@ -1,7 +1,9 @@
 package dkim
 
 import (
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dtynn/dmail/message"
 )
@@ -24,7 +26,7 @@ aGuSbLZpX/EcVR3d3yd+uSF52fuamuZK7nQo5Y1AEqo=
 -----END RSA PRIVATE KEY-----`)
 
 func TestSign(t *testing.T) {
-	res := "v=1; a=rsa-sha256; c=relaxed/simple; d=dtynn.me; i=@dtynn.me; \r\n q=dns/txt; s=abc; t=1416912369; h=From : To : Subject : to : To : \r\n subject : Subject : to : From : Subject : subject : Subject; \r\n bh=P/65m6skPz/Wri2VBU/j1ViQK3o7hPVzpfeEh4cYpKw=; \r\n b=ESVTjf/jN4czA3Vx3B1T6rwuDl9H3M7mfKA9WsfXUNSSC6XV2auGIYXXDzdo1qYmsU8Uj/\r\n HbcMALpMFtHphgaPSTwp9sK9ieptXrs5XamnomZTGXG75JmWoidyaL0UiQpkmFG6BFEfS3BW\r\n TYbfr26LT3ATKGc1M76rx6HQ3N56M="
+	res := "v=1; a=rsa-sha256; c=relaxed/simple; d=dtynn.me; i=@dtynn.me; \r\n q=dns/txt; s=abc; t=1416912369; h=From : To : Subject : to : To : \r\n subject : Subject : to : from : subject : date; \r\n bh=P/65m6skPz/Wri2VBU/j1ViQK3o7hPVzpfeEh4cYpKw=; b=csubAJ9GFj4orZab1+gN\r\n 8xorFlrhPyJGBaEAMsDoeFwRnPNmjNlEj+iV4DTXiAkwaVknpLsJr17KUeT5FgeAvXVnp0U\r\n 1QHNk+QTNsTu40jyILlPfDQQC+5gzos4l9hP92rizlEYOSOUQeZxt0WXIF3wwXIpV5PJByu\r\n /J25AOKr4="
 
 	msg := message.NewMessage(message.Unencoded, message.CharsetUTF8, "")
 	msg.AddNormalHeader("From", "a")
@@ -54,3 +56,127 @@ func TestSign(t *testing.T) {
 		t.Error("sign failed")
 	}
 }
+
+func TestSignVector(t *testing.T) {
+	// ed25519 is deterministic, signing the message of RFC 8463 appendix A
+	// with the same tags must give the published signature
+	raw := testEd25519Signed[strings.Index(testEd25519Signed, "From:"):]
+	conf := NewDkimConf("football.example.com", "", "brisbane", false, testEd25519Key(t))
+	d := NewDkim(nil, conf, &Options{
+		HeaderCanonicalization: "relaxed",
+		BodyCanonicalization:   "relaxed",
+		Headers:                []string{"from", "to", "subject", "date", "message-id"},
+		OverSign:               []string{"from", "subject", "date"},
+	})
+	d.t = int64(1528637909)
+
+	sig, err := d.signRaw([]byte(raw))
+	if err != nil {
+		t.Fatal("sign err: ", err)
+	}
+	tags, _ := parseTagList(sig)
+	expect, _ := parseTagList(testEd25519Signed[len(DkimHeaderName)+1 : strings.Index(testEd25519Signed, "From:")])
+	for _, name := range []string{"a", "c", "h", "bh", "b"} {
+		if stripWhitespace(tags[name]) != stripWhitespace(expect[name]) {
+			t.Errorf("expect %s=%s, get %s", name, expect[name], tags[name])
+		}
+	}
+}
+
+func TestSignOptions(t *testing.T) {
+	v := NewVerifier(fakeResolver{"abc._domainkey.dtynn.me": {testKeyRecord(t)}})
+	v.now = func() time.Time { return time.Unix(1416912369, 0) }
+	conf := NewDkimConf("dtynn.me", "", "abc", false, testPrivateKey)
+	raw := "From: a@dtynn.me\r\n" +
+		"To:  b@example.com\r\n" +
+		"Subject: folded\r\n  subject\t here\r\n" +
+		"\r\n" +
+		"body  with \t spaces  \r\n\r\n\r\n"
+
+	for _, c := range []string{"simple/simple", "simple/relaxed", "relaxed/simple", "relaxed/relaxed"} {
+		pieces := strings.Split(c, "/")
+		d := NewDkim(nil, conf, &Options{
+			HeaderCanonicalization: pieces[0],
+			BodyCanonicalization:   pieces[1],
+			OverSign:               []string{"subject", "reply-to"},
+			Expiration:             time.Hour,
+			CopyHeaders:            true,
+		})
+		d.t = int64(1416912369)
+		sig, err := d.signRaw([]byte(raw))
+		if err != nil {
+			t.Fatalf("%s: sign err: %s", c, err)
+		}
+		signed := DkimHeaderName + ": " + sig + "\r\n" + raw
+
+		results, _ := v.Verify([]byte(signed))
+		if len(results) != 1 || results[0].Status != StatusPass {
+			t.Errorf("%s: expect pass, get %v", c, results)
+		}
+
+		tags, _ := parseTagList(sig)
+		if tags["c"] != c || tags["x"] != "1416915969" {
+			t.Errorf("%s: unexpected tags c=%s x=%s", c, tags["c"], tags["x"])
+		}
+		if h := compressWhitespace(unfoldHeader(tags["h"])); h != "From : To : Subject : subject : reply-to" {
+			t.Errorf("%s: unexpected h=%s", c, h)
+		}
+		if z := stripWhitespace(tags["z"]); z != "From:a@dtynn.me|To:b@example.com|Subject:folded=20=20subject=09=20here" {
+			t.Errorf("%s: unexpected z=%s", c, z)
+		}
+
+		// over-signed fields may not be added, even when absent before
+		for _, added := range []string{"Subject: another\r\n", "Reply-To: x@example.com\r\n"} {
+			results, _ = v.Verify([]byte(strings.Replace(signed, "\r\n\r\n", "\r\n"+added+"\r\n", 1)))
+			if len(results) != 1 || results[0].Status != StatusFail {
+				t.Errorf("%s: expect fail with added %q, get %v", c, added, results)
+			}
+		}
+
+		// relaxed ignores changed header whitespace
+		relaxed := strings.Replace(signed, "To:  b@example.com", "To: b@example.com", 1)
+		results, _ = v.Verify([]byte(relaxed))
+		if expect := pieces[0] == "relaxed"; (results[0].Status == StatusPass) != expect {
+			t.Errorf("%s: unexpected result with changed header whitespace %s", c, results[0])
+		}
+	}
+
+	d := NewDkim(nil, conf, &Options{HeaderCanonicalization: "relaxed", BodyCanonicalization: "strict"})
+	if _, err := d.signRaw([]byte(raw)); err == nil {
+		t.Error("expect error for unsupported canonicalization")
+	}
+	d = NewDkim(nil, conf, &Options{HeaderCanonicalization: "relaxed", BodyCanonicalization: "relaxed", Headers: []string{"to"}})
+	if _, err := d.signRaw([]byte(raw)); err != errMissingMustHeaders {
+		t.Errorf("expect %q, get %v", errMissingMustHeaders, err)
+	}
+}
+
+func TestSignOverSignHeaders(t *testing.T) {
+	v := NewVerifier(fakeResolver{"abc._domainkey.dtynn.me": {testKeyRecord(t)}})
+	v.now = func() time.Time { return time.Unix(1416912369, 0) }
+	conf := NewDkimConf("dtynn.me", "", "abc", false, testPrivateKey)
+	raw := "From: a@dtynn.me\r\n" +
+		"To: b@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"Date: Tue, 25 Nov 2014 10:46:09 +0000\r\n" +
+		"\r\n" +
+		"body\r\n"
+
+	opts := DefaultOptions()
+	opts.Headers = []string{"from", "to"}
+	d := NewDkim(nil, conf, opts)
+	d.t = int64(1416912369)
+	sig, err := d.signRaw([]byte(raw))
+	if err != nil {
+		t.Fatal("sign err: ", err)
+	}
+	tags, _ := parseTagList(sig)
+	if h := compressWhitespace(unfoldHeader(tags["h"])); h != "from : to : subject : date : from : subject : date" {
+		t.Errorf("unexpected h=%s", h)
+	}
+
+	results, _ := v.Verify([]byte(DkimHeaderName + ": " + sig + "\r\n" + raw))
+	if len(results) != 1 || results[0].Status != StatusPass {
+		t.Errorf("expect pass, get %v", results)
+	}
+}
@@ -0,0 +1,221 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"hash"
+	"io/ioutil"
+)
+
+var (
+	errNoKey          = fmt.Errorf("no key found")
+	errKeyEncrypted   = fmt.Errorf("key is encrypted")
+	errWrongPassword  = fmt.Errorf("decryption failed, wrong password?")
+	errUnsupportedKdf = fmt.Errorf("unsupported key derivation")
+)
+
+// ParsePrivateKey parses a PEM encoded PKCS#1 rsa key or PKCS#8 rsa or ed25519 key.
+func ParsePrivateKey(pemBytes []byte) (crypto.Signer, error) {
+	return ParseEncryptedPrivateKey(pemBytes, nil)
+}
+
+// ParseEncryptedPrivateKey is ParsePrivateKey for keys protected by a password,
+// either PKCS#8 "ENCRYPTED PRIVATE KEY" (PBES2) or legacy encrypted PEM blocks.
+// Unencrypted keys are accepted as well.
+func ParseEncryptedPrivateKey(pemBytes, password []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errNoKey
+	}
+
+	der := block.Bytes
+	if block.Type == "ENCRYPTED PRIVATE KEY" || x509.IsEncryptedPEMBlock(block) {
+		if password == nil {
+			return nil, errKeyEncrypted
+		}
+		var err error
+		if block.Type == "ENCRYPTED PRIVATE KEY" {
+			der, err = decryptPkcs8(der, password)
+		} else {
+			der, err = x509.DecryptPEMBlock(block, password)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(der)
+	case "PRIVATE KEY", "ENCRYPTED PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(der)
+		if err != nil {
+			if block.Type == "ENCRYPTED PRIVATE KEY" {
+				return nil, errWrongPassword
+			}
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("unsupported private key %T", key)
+	}
+	return nil, fmt.Errorf("unsupported key type %q", block.Type)
+}
+
+// LoadPrivateKey reads a key file, password may be nil for unencrypted keys.
+func LoadPrivateKey(path string, password []byte) (crypto.Signer, error) {
+	pemBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseEncryptedPrivateKey(pemBytes, password)
+}
+
+// PKCS#8 encryption of RFC 5208 with the PBES2 scheme of RFC 8018
+
+var (
+	oidPbes2          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPbkdf2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHmacWithSha1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHmacWithSha256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidDesEde3Cbc     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAes128Cbc      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAes192Cbc      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAes256Cbc      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	Prf            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+func decryptPkcs8(der, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPbes2) {
+		return nil, fmt.Errorf("unsupported encryption %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPbkdf2) {
+		return nil, errUnsupportedKdf
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+
+	prf := sha1.New
+	switch {
+	case kdf.Prf.Algorithm == nil, kdf.Prf.Algorithm.Equal(oidHmacWithSha1):
+	case kdf.Prf.Algorithm.Equal(oidHmacWithSha256):
+		prf = sha256.New
+	default:
+		return nil, errUnsupportedKdf
+	}
+
+	var keyLen int
+	var newCipher func(key []byte) (cipher.Block, error)
+	scheme := params.EncryptionScheme.Algorithm
+	switch {
+	case scheme.Equal(oidAes128Cbc):
+		keyLen, newCipher = 16, aes.NewCipher
+	case scheme.Equal(oidAes192Cbc):
+		keyLen, newCipher = 24, aes.NewCipher
+	case scheme.Equal(oidAes256Cbc):
+		keyLen, newCipher = 32, aes.NewCipher
+	case scheme.Equal(oidDesEde3Cbc):
+		keyLen, newCipher = 24, des.NewTripleDESCipher
+	default:
+		return nil, fmt.Errorf("unsupported cipher %s", scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	block, err := newCipher(pbkdf2(password, kdf.Salt, kdf.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errWrongPassword
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// pkcs#7 padding
+	pad := int(plain[len(plain)-1])
+	if pad == 0 || pad > block.BlockSize() {
+		return nil, errWrongPassword
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errWrongPassword
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// pbkdf2 derives a key as described in RFC 8018 section 5.2.
+func pbkdf2(password, salt []byte, iterations, keyLen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	size := prf.Size()
+	blocks := (keyLen + size - 1) / size
+
+	key := make([]byte, 0, blocks*size)
+	buf := make([]byte, 4)
+	for i := 1; i <= blocks; i++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(buf, uint32(i))
+		prf.Write(buf)
+		u := prf.Sum(nil)
+		t := append([]byte{}, u...)
+		for n := 1; n < iterations; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,102 @@
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"strings"
+)
+
+type KeyType string
+
+const (
+	KeyTypeRsa     KeyType = "rsa"
+	KeyTypeEd25519 KeyType = "ed25519"
+)
+
+const (
+	generatedRsaBits = 2048
+	// a TXT character-string holds at most 255 bytes
+	txtStringLength = 255
+)
+
+// GenerateKey returns a new private key in PEM, usable with NewDkimConf,
+// and the TXT record to publish at <selector>._domainkey.<domain>.
+// rsa keys are PKCS#1, ed25519 keys PKCS#8.
+func GenerateKey(t KeyType) ([]byte, string, error) {
+	var block *pem.Block
+	var pub crypto.PublicKey
+	switch t {
+	case KeyTypeRsa:
+		key, err := rsa.GenerateKey(rand.Reader, generatedRsaBits)
+		if err != nil {
+			return nil, "", err
+		}
+		block = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}
+		pub = key.Public()
+	case KeyTypeEd25519:
+		pk, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, "", err
+		}
+		block = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+		pub = pk
+	default:
+		return nil, "", fmt.Errorf("unsupported key type %q", t)
+	}
+
+	record, err := KeyRecord(pub)
+	if err != nil {
+		return nil, "", err
+	}
+	return pem.EncodeToMemory(block), record, nil
+}
+
+// KeyRecord returns the "v=DKIM1; k=...; p=..." record of a public key.
+func KeyRecord(pub crypto.PublicKey) (string, error) {
+	var t KeyType
+	var der []byte
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		var err error
+		if der, err = x509.MarshalPKIXPublicKey(k); err != nil {
+			return "", err
+		}
+		t = KeyTypeRsa
+	case ed25519.PublicKey:
+		// RFC 8463 publishes the raw key
+		der, t = k, KeyTypeEd25519
+	default:
+		return "", fmt.Errorf("unsupported public key %T", pub)
+	}
+	return fmt.Sprintf("v=DKIM1; k=%s; p=%s", t, base64.StdEncoding.EncodeToString(der)), nil
+}
+
+// SplitTXT splits a record into the character-strings of one TXT record.
+func SplitTXT(record string) []string {
+	strs := []string{}
+	for len(record) > txtStringLength {
+		strs = append(strs, record[:txtStringLength])
+		record = record[txtStringLength:]
+	}
+	return append(strs, record)
+}
+
+// ZoneRecord formats the record as a zone file line for <selector>._domainkey.<domain>.
+func ZoneRecord(domain, selector, record string) string {
+	quoted := []string{}
+	for _, s := range SplitTXT(record) {
+		quoted = append(quoted, `"`+s+`"`)
+	}
+	return fmt.Sprintf("%s%s%s. IN TXT ( %s )", selector, domainKeySuffix, strings.TrimSuffix(domain, "."),
+		strings.Join(quoted, " "))
+}
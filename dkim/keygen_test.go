@@ -0,0 +1,51 @@
+package dkim
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/dtynn/dmail/message"
+)
+
+func TestGenerateKey(t *testing.T) {
+	for _, kt := range []KeyType{KeyTypeRsa, KeyTypeEd25519} {
+		pemBytes, record, err := GenerateKey(kt)
+		if err != nil {
+			t.Fatalf("%s: %s", kt, err)
+		}
+		if !strings.HasPrefix(record, "v=DKIM1; k="+string(kt)+"; p=") {
+			t.Errorf("%s: unexpected record %s", kt, record)
+		}
+
+		strs := SplitTXT(record)
+		for _, s := range strs {
+			if len(s) > txtStringLength {
+				t.Errorf("%s: string longer than %d", kt, txtStringLength)
+			}
+		}
+		if strings.Join(strs, "") != record {
+			t.Errorf("%s: split record differs", kt)
+		}
+
+		msg := message.NewMessage(message.Unencoded, message.CharsetUTF8, "text/plain")
+		msg.AddAddressHeader("From", "a@dtynn.me", "")
+		msg.SetBody("generated\r\n")
+		header, err := NewDefaultDkim(msg, NewDkimConf("dtynn.me", "", "gen", false, pemBytes)).SignatureHeader()
+		if err != nil {
+			t.Fatalf("%s: sign: %s", kt, err)
+		}
+		msg.AddHeader(header)
+
+		// the resolver returns the strings of a record joined
+		v := NewVerifier(fakeResolver{"gen._domainkey.dtynn.me": {strings.Join(strs, "")}})
+		results, _ := v.Verify(msg.Bytes())
+		if len(results) != 1 || results[0].Status != StatusPass {
+			t.Errorf("%s: expect pass, get %v", kt, results)
+		}
+	}
+
+	if zone := ZoneRecord("dtynn.me", "s1", strings.Repeat("a", 300)); zone !=
+		`s1._domainkey.dtynn.me. IN TXT ( "`+strings.Repeat("a", 255)+`" "`+strings.Repeat("a", 45)+`" )` {
+		t.Errorf("unexpected zone record %s", zone)
+	}
+}
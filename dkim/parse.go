@@ -0,0 +1,118 @@
+package dkim
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+var (
+	errDuplicateTag = fmt.Errorf("duplicate tag")
+	errInvalidTag   = fmt.Errorf("invalid tag")
+)
+
+var (
+	bytesLineSep   = []byte("\r\n")
+	bytesHeaderSep = []byte("\r\n\r\n")
+)
+
+// rawHeader is a header field exactly as it appears in the message,
+// without the trailing CRLF.
+type rawHeader struct {
+	field string
+	raw   string
+}
+
+func (this *rawHeader) value() string {
+	i := strings.Index(this.raw, ":")
+	return this.raw[i+1:]
+}
+
+// fixLineEndings converts lone LF to CRLF.
+func fixLineEndings(raw []byte) []byte {
+	if !bytes.Contains(raw, []byte("\n")) {
+		return raw
+	}
+	buf := make([]byte, 0, len(raw)+len(raw)/40)
+	for i, b := range raw {
+		if b == '\n' && (i == 0 || raw[i-1] != '\r') {
+			buf = append(buf, '\r')
+		}
+		buf = append(buf, b)
+	}
+	return buf
+}
+
+// splitMessage splits a raw message into its header fields and its body.
+func splitMessage(raw []byte) ([]*rawHeader, []byte, error) {
+	raw = fixLineEndings(raw)
+
+	var head, body []byte
+	if bytes.HasPrefix(raw, bytesLineSep) {
+		body = raw[len(bytesLineSep):]
+	} else if i := bytes.Index(raw, bytesHeaderSep); i != -1 {
+		head = raw[:i+len(bytesLineSep)]
+		body = raw[i+len(bytesHeaderSep):]
+	} else {
+		head = raw
+	}
+
+	headers := []*rawHeader{}
+	for _, line := range strings.SplitAfter(string(head), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(headers) == 0 {
+				return nil, nil, fmt.Errorf("malformed header %q", line)
+			}
+			last := headers[len(headers)-1]
+			last.raw += line
+			continue
+		}
+		i := strings.Index(line, ":")
+		if i <= 0 {
+			return nil, nil, fmt.Errorf("malformed header %q", line)
+		}
+		headers = append(headers, &rawHeader{strings.TrimRight(line[:i], " \t"), line})
+	}
+
+	for _, h := range headers {
+		h.raw = strings.TrimSuffix(h.raw, "\r\n")
+	}
+	return headers, body, nil
+}
+
+// canonRawHeader canonicalizes a raw header field including the trailing CRLF.
+func canonRawHeader(c string, h *rawHeader) string {
+	if c == "relaxed" {
+		return strings.ToLower(h.field) + ":" + relaxedHeader(h.value()) + "\r\n"
+	}
+	return h.raw + "\r\n"
+}
+
+// parseTagList parses a tag=value list as used by signatures and key records.
+func parseTagList(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(unfoldHeader(spec))
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, errInvalidTag
+		}
+		name := strings.TrimSpace(spec[:i])
+		if _, has := tags[name]; has {
+			return nil, errDuplicateTag
+		}
+		tags[name] = strings.TrimSpace(spec[i+1:])
+	}
+	return tags, nil
+}
+
+// stripWhitespace removes all folding white space, as needed for base64 values.
+func stripWhitespace(s string) string {
+	return reBlank.ReplaceAllString(s, "")
+}
@@ -2,55 +2,74 @@ package dkim
 
 import (
 	"crypto"
+	"crypto/ed25519"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha256"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"fmt"
 	"hash"
 )
 
-type rsaSha256Signer struct {
-	key *rsa.PrivateKey
+const (
+	algorithmRsaSha256     = "rsa-sha256"
+	algorithmEd25519Sha256 = "ed25519-sha256"
+)
+
+type signer interface {
+	// Algorithm returns the a= tag value of the signatures.
+	Algorithm() string
+	Sign(data []byte) (string, error)
+	SignHash(h hash.Hash) (string, error)
+	signDigest(d []byte) (string, error)
+}
+
+// keySigner signs with any crypto.Signer holding a rsa or ed25519 key,
+// so the key itself may live in a HSM or a remote service.
+type keySigner struct {
+	key       crypto.Signer
+	algorithm string
+	opts      crypto.SignerOpts
+}
+
+func newKeySigner(key crypto.Signer) (*keySigner, error) {
+	switch pub := key.Public().(type) {
+	case *rsa.PublicKey:
+		return &keySigner{key, algorithmRsaSha256, crypto.SHA256}, nil
+	case ed25519.PublicKey:
+		// ed25519 signs the sha256 digest itself as described in RFC 8463
+		return &keySigner{key, algorithmEd25519Sha256, crypto.Hash(0)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key %T", pub)
+	}
+}
+
+func (this *keySigner) Algorithm() string {
+	return this.algorithm
 }
 
-func (this *rsaSha256Signer) Sign(data []byte) (string, error) {
+func (this *keySigner) Sign(data []byte) (string, error) {
 	h := sha256.New()
 	h.Write(data)
 	return this.SignHash(h)
 }
 
-func (this *rsaSha256Signer) SignHash(h hash.Hash) (string, error) {
-	d := h.Sum(nil)
-	result, err := rsa.SignPKCS1v15(rand.Reader, this.key, crypto.SHA256, d)
-	if err != nil {
-		return "", err
-	}
-	return base64.StdEncoding.EncodeToString(result), nil
+func (this *keySigner) SignHash(h hash.Hash) (string, error) {
+	return this.signDigest(h.Sum(nil))
 }
 
-func (this *rsaSha256Signer) signDigest(d []byte) (string, error) {
-	result, err := rsa.SignPKCS1v15(rand.Reader, this.key, crypto.SHA256, d)
+func (this *keySigner) signDigest(d []byte) (string, error) {
+	result, err := this.key.Sign(rand.Reader, d, this.opts)
 	if err != nil {
 		return "", err
 	}
 	return base64.StdEncoding.EncodeToString(result), nil
 }
 
-func newSigner(pemBytes []byte) (*rsaSha256Signer, error) {
-	block, _ := pem.Decode(pemBytes)
-	if block == nil {
-		return nil, fmt.Errorf("no key found")
-	}
-
-	if block.Type != "RSA PRIVATE KEY" {
-		return nil, fmt.Errorf("unsupported key type %q", block.Type)
-	}
-	rsa, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+func newSigner(pemBytes []byte) (signer, error) {
+	key, err := ParsePrivateKey(pemBytes)
 	if err != nil {
 		return nil, err
 	}
-	return &rsaSha256Signer{rsa}, nil
+	return newKeySigner(key)
 }
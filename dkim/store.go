@@ -0,0 +1,164 @@
+package dkim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyEntry is one selector of a domain, active from NotBefore until NotAfter.
+// Zero times are unbounded.
+type KeyEntry struct {
+	Conf      *DkimConf
+	NotBefore time.Time
+	NotAfter  time.Time
+}
+
+func (this *KeyEntry) active(now time.Time) bool {
+	if !this.NotBefore.IsZero() && now.Before(this.NotBefore) {
+		return false
+	}
+	if !this.NotAfter.IsZero() && !now.Before(this.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// KeyStore picks the signing keys by the From domain.
+// Several selectors of a domain may be active at once, e.g. a rsa and an ed25519 key,
+// or the old and the new key while rotating.
+type KeyStore struct {
+	mutex   sync.RWMutex
+	entries map[string][]*KeyEntry
+	now     func() time.Time
+}
+
+func NewKeyStore() *KeyStore {
+	return &KeyStore{entries: map[string][]*KeyEntry{}, now: time.Now}
+}
+
+func (this *KeyStore) Add(entry *KeyEntry) {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+	domain := strings.ToLower(entry.Conf.domain)
+	this.entries[domain] = append(this.entries[domain], entry)
+}
+
+// Replace swaps all entries at once.
+func (this *KeyStore) Replace(entries []*KeyEntry) {
+	m := map[string][]*KeyEntry{}
+	for _, entry := range entries {
+		domain := strings.ToLower(entry.Conf.domain)
+		m[domain] = append(m[domain], entry)
+	}
+	this.mutex.Lock()
+	this.entries = m
+	this.mutex.Unlock()
+}
+
+// Lookup returns the confs active now for the domain,
+// falling back to the parent domains so a subdomain is signed aligned with its brand.
+func (this *KeyStore) Lookup(domain string) []*DkimConf {
+	now := this.now()
+	this.mutex.RLock()
+	defer this.mutex.RUnlock()
+
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	for domain != "" {
+		confs := []*DkimConf{}
+		for _, entry := range this.entries[domain] {
+			if entry.active(now) {
+				confs = append(confs, entry.Conf)
+			}
+		}
+		if len(confs) != 0 {
+			return confs
+		}
+		i := strings.Index(domain, ".")
+		if i == -1 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return nil
+}
+
+// keyFileEntry is an entry of the key store file, a json array of:
+//
+//	{"domain": "example.com", "selector": "2015a", "key": "example.com.2015a.pem",
+//	 "not_before": "2015-01-01T00:00:00Z", "not_after": "2015-07-01T00:00:00Z"}
+//
+// Relative key paths are relative to the store file, times are RFC 3339.
+type keyFileEntry struct {
+	Domain    string `json:"domain"`
+	Identity  string `json:"identity"`
+	Selector  string `json:"selector"`
+	Key       string `json:"key"`
+	Password  string `json:"password"`
+	SetLength bool   `json:"set_length"`
+	NotBefore string `json:"not_before"`
+	NotAfter  string `json:"not_after"`
+}
+
+// LoadKeyFile reads the entries of a key store file and parses their keys.
+func LoadKeyFile(path string) ([]*KeyEntry, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fileEntries := []*keyFileEntry{}
+	if err := json.Unmarshal(data, &fileEntries); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*KeyEntry, 0, len(fileEntries))
+	for _, fe := range fileEntries {
+		if fe.Domain == "" || fe.Selector == "" || fe.Key == "" {
+			return nil, fmt.Errorf("key entry %s/%s: domain, selector and key required", fe.Domain, fe.Selector)
+		}
+		keyPath := fe.Key
+		if !filepath.IsAbs(keyPath) {
+			keyPath = filepath.Join(filepath.Dir(path), keyPath)
+		}
+		var password []byte
+		if fe.Password != "" {
+			password = []byte(fe.Password)
+		}
+		key, err := LoadPrivateKey(keyPath, password)
+		if err != nil {
+			return nil, fmt.Errorf("key entry %s/%s: %s", fe.Domain, fe.Selector, err)
+		}
+		conf, err := NewDkimConfWithKey(fe.Domain, fe.Identity, fe.Selector, fe.SetLength, key)
+		if err != nil {
+			return nil, fmt.Errorf("key entry %s/%s: %s", fe.Domain, fe.Selector, err)
+		}
+
+		entry := &KeyEntry{Conf: conf}
+		values := []string{fe.NotBefore, fe.NotAfter}
+		for i, p := range []*time.Time{&entry.NotBefore, &entry.NotAfter} {
+			if values[i] == "" {
+				continue
+			}
+			if *p, err = time.Parse(time.RFC3339, values[i]); err != nil {
+				return nil, fmt.Errorf("key entry %s/%s: %s", fe.Domain, fe.Selector, err)
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Reload replaces the entries with those of a key store file.
+// The current entries are kept if the file can not be loaded.
+func (this *KeyStore) Reload(path string) error {
+	entries, err := LoadKeyFile(path)
+	if err != nil {
+		return err
+	}
+	this.Replace(entries)
+	return nil
+}
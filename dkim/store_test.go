@@ -0,0 +1,77 @@
+package dkim
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func selectors(confs []*DkimConf) []string {
+	s := []string{}
+	for _, c := range confs {
+		s = append(s, c.domain+"/"+c.selector)
+	}
+	return s
+}
+
+func TestKeyStore(t *testing.T) {
+	rotation := time.Date(2015, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewKeyStore()
+	store.Add(&KeyEntry{Conf: NewDkimConf("brand.com", "", "old", false, testPrivateKey), NotAfter: rotation.Add(24 * time.Hour)})
+	store.Add(&KeyEntry{Conf: NewDkimConf("brand.com", "", "new", false, testPrivateKey), NotBefore: rotation})
+	store.Add(&KeyEntry{Conf: NewDkimConf("other.org", "", "s1", false, testPrivateKey)})
+
+	cases := []struct {
+		now    time.Time
+		domain string
+		expect string
+	}{
+		{rotation.Add(-time.Hour), "brand.com", "[brand.com/old]"},
+		{rotation.Add(time.Hour), "BRAND.com", "[brand.com/old brand.com/new]"},
+		{rotation.Add(48 * time.Hour), "news.brand.com", "[brand.com/new]"},
+		{rotation, "other.org", "[other.org/s1]"},
+		{rotation, "unknown.net", "[]"},
+	}
+	for _, c := range cases {
+		store.now = func() time.Time { return c.now }
+		if got := fmt.Sprint(selectors(store.Lookup(c.domain))); got != c.expect {
+			t.Errorf("%s at %s: expect %s, get %s", c.domain, c.now, c.expect, got)
+		}
+	}
+}
+
+func TestKeyStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(filepath.Join(dir, "rsa.pem"), testPrivateKey, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "ed25519.pem"), testEd25519Key(t), 0600)
+	path := filepath.Join(dir, "keys.json")
+	ioutil.WriteFile(path, []byte(`[
+		{"domain": "brand.com", "selector": "rsa", "key": "rsa.pem"},
+		{"domain": "brand.com", "selector": "ed", "key": "ed25519.pem", "not_before": "2015-01-01T00:00:00Z"}
+	]`), 0600)
+
+	store := NewKeyStore()
+	store.now = func() time.Time { return time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC) }
+	if err := store.Reload(path); err != nil {
+		t.Fatal("reload: ", err)
+	}
+	if got := fmt.Sprint(selectors(store.Lookup("brand.com"))); got != "[brand.com/rsa brand.com/ed]" {
+		t.Errorf("unexpected selectors %s", got)
+	}
+
+	ioutil.WriteFile(path, []byte(`[{"domain": "brand.com", "selector": "rsa", "key": "missing.pem"}]`), 0600)
+	if err := store.Reload(path); err == nil {
+		t.Error("expect error for missing key")
+	}
+	if len(store.Lookup("brand.com")) != 2 {
+		t.Error("expect failed reload to keep the keys")
+	}
+}
@@ -14,14 +14,12 @@ import (
 
 var Hasher = map[string]func(string) string{"sha1": generateSha1Hash, "sha256": generateSha256Hash}
 
-var reCRLF, reMultiWS, reTrailingLines, reTrailingWS, reBlank, reBTag *regexp.Regexp
+var reCRLF, reMultiWS, reBlank, reBTag *regexp.Regexp
 var FWS = "(?:(?:\\s*\r?\n)?\\s*)"
 
 func init() {
 	reCRLF, _ = regexp.Compile("\r\n")
 	reMultiWS, _ = regexp.Compile("[\t ]+")
-	reTrailingLines, _ = regexp.Compile("(\r\n)*$")
-	reTrailingWS, _ = regexp.Compile("[\t ]+\r\n")
 	reBlank, _ = regexp.Compile("[\\s]+")
 	reBTag, _ = regexp.Compile("([;\\s]b" + FWS + "?=)(?:" + FWS + "[a-zA-Z0-9+/=])*(?:\r?\n$)?")
 }
@@ -46,22 +44,37 @@ func foldHeader(s string) string {
 	return pre + s
 }
 
-func unfoldHeader(src string) string {
-	return reCRLF.ReplaceAllString(src, "")
+// foldAppend appends a base64 value to a folded header without refolding what is already there.
+func foldAppend(s, v string) string {
+	line := len(s)
+	if i := strings.LastIndex(s, "\r\n"); i != -1 {
+		line = len(s) - i - 2
+	}
+	for len(v) > 0 {
+		n := 72 - line
+		if n <= 0 {
+			s += "\r\n "
+			line = 1
+			continue
+		}
+		if n > len(v) {
+			n = len(v)
+		}
+		s += v[:n]
+		v = v[n:]
+		line += n
+	}
+	return s
 }
 
-func stripTrailingLine(src string) string {
-	return reTrailingLines.ReplaceAllString(src, "\r\n")
+func unfoldHeader(src string) string {
+	return reCRLF.ReplaceAllString(src, "")
 }
 
 func compressWhitespace(src string) string {
 	return reMultiWS.ReplaceAllString(src, " ")
 }
 
-func stripTrailingWhitespace(src string) string {
-	return reTrailingWS.ReplaceAllString(src, "\r\n")
-}
-
 func generateSha1Hash(s string) string {
 	return generateHash(s, sha1.New())
 }
@@ -87,6 +100,16 @@ func stringIn(val string, slice []string) bool {
 	return false
 }
 
+// fieldIn is stringIn ignoring the case of header field names.
+func fieldIn(field string, fields []string) bool {
+	for _, one := range fields {
+		if strings.EqualFold(field, one) {
+			return true
+		}
+	}
+	return false
+}
+
 func makeDkimTag(name string, value string) string {
 	return fmt.Sprintf("%s=%s", name, value)
 }
@@ -0,0 +1,452 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dtynn/dmail/dns"
+)
+
+type Status string
+
+const (
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+const (
+	domainKeySuffix = "._domainkey."
+	minRsaKeyBits   = 1024
+	// accepted clock skew for t=
+	maxClockSkew = 5 * time.Minute
+)
+
+// rsa-sha1 is not verified any more, RFC 8301
+var hashAlgorithms = map[string]crypto.Hash{"sha256": crypto.SHA256}
+
+// Resolver fetches the key records.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// Result is the verification result of one DKIM-Signature header.
+type Result struct {
+	Status    Status
+	Reason    string
+	Domain    string
+	Selector  string
+	Identity  string
+	Algorithm string
+}
+
+func (this *Result) String() string {
+	if this.Reason == "" {
+		return fmt.Sprintf("%s (d=%s s=%s)", this.Status, this.Domain, this.Selector)
+	}
+	return fmt.Sprintf("%s (d=%s s=%s): %s", this.Status, this.Domain, this.Selector, this.Reason)
+}
+
+type verifyError struct {
+	status Status
+	reason string
+}
+
+func (this *verifyError) Error() string {
+	return this.reason
+}
+
+func permError(format string, v ...interface{}) *verifyError {
+	return &verifyError{StatusPermError, fmt.Sprintf(format, v...)}
+}
+
+func tempError(format string, v ...interface{}) *verifyError {
+	return &verifyError{StatusTempError, fmt.Sprintf(format, v...)}
+}
+
+func failure(format string, v ...interface{}) *verifyError {
+	return &verifyError{StatusFail, fmt.Sprintf(format, v...)}
+}
+
+type Verifier struct {
+	resolver Resolver
+	now      func() time.Time
+}
+
+func NewVerifier(r Resolver) *Verifier {
+	if r == nil {
+		r = dns.DefaultResolver
+	}
+	return &Verifier{r, time.Now}
+}
+
+var defaultVerifier = NewVerifier(nil)
+
+// Verify verifies every DKIM-Signature header of a raw message using the default resolver.
+func Verify(raw []byte) ([]*Result, error) {
+	return defaultVerifier.Verify(raw)
+}
+
+// Verify verifies every DKIM-Signature header of a raw message.
+// The results are in the order the headers appear in the message.
+func (this *Verifier) Verify(raw []byte) ([]*Result, error) {
+	headers, body, err := splitMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []*Result{}
+	for i, h := range headers {
+		if !strings.EqualFold(h.field, DkimHeaderName) {
+			continue
+		}
+		results = append(results, this.verifySignature(headers, i, body))
+	}
+	return results, nil
+}
+
+type signature struct {
+	tags      map[string]string
+	algorithm string
+	keyType   string
+	hash      crypto.Hash
+	header    string
+	body      string
+	domain    string
+	selector  string
+	identity  string
+	fields    []string
+	bh        []byte
+	b         []byte
+	length    int64
+	timestamp int64
+	expire    int64
+}
+
+var (
+	dkimRequiredTags = []string{"v", "a", "b", "bh", "d", "h", "s"}
+	arcRequiredTags  = []string{"i", "a", "b", "bh", "d", "h", "s"}
+)
+
+// parseSignature parses a DKIM-Signature or, if arc is set, an ARC-Message-Signature value.
+// ARC signatures use i= as the instance and have no v= tag.
+func parseSignature(value string, arc bool) (*signature, *verifyError) {
+	tags, err := parseTagList(value)
+	if err != nil {
+		return nil, permError("malformed signature: %s", err)
+	}
+
+	required := dkimRequiredTags
+	if arc {
+		required = arcRequiredTags
+	}
+	for _, name := range required {
+		if _, has := tags[name]; !has {
+			return nil, permError("missing tag %s", name)
+		}
+	}
+
+	sig := &signature{
+		tags:      tags,
+		algorithm: strings.ToLower(tags["a"]),
+		domain:    strings.ToLower(tags["d"]),
+		selector:  tags["s"],
+		length:    -1,
+		timestamp: -1,
+		expire:    -1,
+	}
+
+	if !arc && tags["v"] != "1" {
+		return sig, permError("unsupported version %q", tags["v"])
+	}
+
+	pieces := strings.SplitN(sig.algorithm, "-", 2)
+	if len(pieces) != 2 || (pieces[0] != "rsa" && pieces[0] != "ed25519") {
+		return sig, permError("unsupported algorithm %q", tags["a"])
+	}
+	hash, ok := hashAlgorithms[pieces[1]]
+	if !ok || (pieces[0] == "ed25519" && hash != crypto.SHA256) {
+		return sig, permError("unsupported algorithm %q", tags["a"])
+	}
+	sig.keyType, sig.hash = pieces[0], hash
+
+	sig.header, sig.body = "simple", "simple"
+	if c, has := tags["c"]; has {
+		pieces := strings.SplitN(strings.ToLower(c), "/", 2)
+		sig.header = pieces[0]
+		if len(pieces) == 2 {
+			sig.body = pieces[1]
+		}
+	}
+	if _, ok := canonHeaders[sig.header]; !ok {
+		return sig, permError("unsupported canonicalization %q", tags["c"])
+	}
+	if _, ok := canonBody[sig.body]; !ok {
+		return sig, permError("unsupported canonicalization %q", tags["c"])
+	}
+
+	if sig.bh, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["bh"])); err != nil {
+		return sig, permError("malformed bh tag")
+	}
+	if sig.b, err = base64.StdEncoding.DecodeString(stripWhitespace(tags["b"])); err != nil {
+		return sig, permError("malformed b tag")
+	}
+
+	hasFrom := false
+	for _, f := range strings.Split(tags["h"], ":") {
+		f = strings.TrimSpace(unfoldHeader(f))
+		if strings.EqualFold(f, "from") {
+			hasFrom = true
+		}
+		sig.fields = append(sig.fields, f)
+	}
+	if !hasFrom {
+		return sig, permError("from header not signed")
+	}
+
+	sig.identity = "@" + sig.domain
+	if i, has := tags["i"]; has && !arc {
+		sig.identity = i
+		at := strings.LastIndex(i, "@")
+		if at == -1 {
+			return sig, permError("malformed i tag")
+		}
+		idDomain := strings.ToLower(i[at+1:])
+		if idDomain != sig.domain && !strings.HasSuffix(idDomain, "."+sig.domain) {
+			return sig, permError("identity %q not in domain %q", i, sig.domain)
+		}
+	}
+
+	if q, has := tags["q"]; has && !stringIn("dns/txt", strings.Split(strings.ToLower(stripWhitespace(q)), ":")) {
+		return sig, permError("unsupported query method %q", q)
+	}
+
+	intTags := map[string]*int64{"l": &sig.length, "t": &sig.timestamp, "x": &sig.expire}
+	for name, p := range intTags {
+		if v, has := tags[name]; has {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || n < 0 {
+				return sig, permError("malformed %s tag", name)
+			}
+			*p = n
+		}
+	}
+	if sig.expire != -1 && sig.timestamp != -1 && sig.expire < sig.timestamp {
+		return sig, permError("x tag before t tag")
+	}
+	return sig, nil
+}
+
+type publicKey struct {
+	key     crypto.PublicKey
+	keyType string
+	hashes  []string
+	strict  bool
+}
+
+func (this *Verifier) lookupKey(sig *signature) (*publicKey, *verifyError) {
+	name := sig.selector + domainKeySuffix + sig.domain
+	txts, err := this.resolver.LookupTXT(name)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, permError("no key for signature")
+		}
+		return nil, tempError("key lookup: %s", err)
+	}
+	if len(txts) == 0 {
+		return nil, permError("no key for signature")
+	}
+	// every string is a record, whose own strings are joined by the resolver
+	var first *verifyError
+	for _, txt := range txts {
+		key, err := parsePublicKey(txt)
+		if err == nil {
+			return key, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return nil, first
+}
+
+func parsePublicKey(txt string) (*publicKey, *verifyError) {
+	tags, err := parseTagList(txt)
+	if err != nil {
+		return nil, permError("malformed key record: %s", err)
+	}
+
+	if v, has := tags["v"]; has && v != "DKIM1" {
+		return nil, permError("unsupported key version %q", v)
+	}
+	keyType := "rsa"
+	if k, has := tags["k"]; has {
+		keyType = strings.ToLower(k)
+	}
+	if keyType != "rsa" && keyType != "ed25519" {
+		return nil, permError("unsupported key type %q", keyType)
+	}
+	if s, has := tags["s"]; has {
+		services := strings.Split(stripWhitespace(s), ":")
+		if !stringIn("*", services) && !stringIn("email", services) {
+			return nil, permError("key not for email")
+		}
+	}
+
+	p, has := tags["p"]
+	if !has {
+		return nil, permError("key record without p tag")
+	}
+	p = stripWhitespace(p)
+	if p == "" {
+		return nil, permError("key revoked")
+	}
+	der, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, permError("malformed key")
+	}
+
+	pk := &publicKey{keyType: keyType}
+	if keyType == "ed25519" {
+		// RFC 8463 publishes the raw 32 bytes key
+		if len(der) != ed25519.PublicKeySize {
+			return nil, permError("malformed key")
+		}
+		pk.key = ed25519.PublicKey(der)
+	} else {
+		var key *rsa.PublicKey
+		if pub, err := x509.ParsePKIXPublicKey(der); err == nil {
+			rsaKey, ok := pub.(*rsa.PublicKey)
+			if !ok {
+				return nil, permError("key is not a rsa key")
+			}
+			key = rsaKey
+		} else if key, err = x509.ParsePKCS1PublicKey(der); err != nil {
+			return nil, permError("malformed key")
+		}
+		if key.N.BitLen() < minRsaKeyBits {
+			return nil, permError("key too short")
+		}
+		pk.key = key
+	}
+
+	if h, has := tags["h"]; has {
+		pk.hashes = strings.Split(stripWhitespace(h), ":")
+	}
+	if t, has := tags["t"]; has {
+		pk.strict = stringIn("s", strings.Split(stripWhitespace(t), ":"))
+	}
+	return pk, nil
+}
+
+func (this *Verifier) verifySignature(headers []*rawHeader, index int, body []byte) *Result {
+	sig, err := parseSignature(headers[index].value(), false)
+	result := &Result{}
+	if sig != nil {
+		result.Domain = sig.domain
+		result.Selector = sig.selector
+		result.Identity = sig.identity
+		result.Algorithm = sig.algorithm
+	}
+	if err == nil {
+		err = this.check(sig, headers, index, body)
+	}
+
+	if err != nil {
+		result.Status = err.status
+		result.Reason = err.reason
+		return result
+	}
+	result.Status = StatusPass
+	return result
+}
+
+func (this *Verifier) check(sig *signature, headers []*rawHeader, index int, body []byte) *verifyError {
+	now := this.now().Unix()
+	if sig.expire != -1 && sig.expire < now {
+		return permError("signature expired")
+	}
+	if sig.timestamp != -1 && sig.timestamp > now+int64(maxClockSkew/time.Second) {
+		return permError("signature timestamp in the future")
+	}
+
+	key, err := this.lookupKey(sig)
+	if err != nil {
+		return err
+	}
+	if key.keyType != sig.keyType {
+		return permError("key type does not match algorithm")
+	}
+	hashName := strings.SplitN(sig.algorithm, "-", 2)[1]
+	if key.hashes != nil && !stringIn(hashName, key.hashes) {
+		return permError("hash algorithm not allowed by key")
+	}
+	if key.strict && !strings.HasSuffix(strings.ToLower(sig.identity), "@"+sig.domain) {
+		return permError("identity must match domain for this key")
+	}
+
+	bodyHasher := sig.hash.New()
+	w := NewBodyCanonicalizer(bodyHasher, sig.body, sig.length)
+	w.Write(body)
+	w.Close()
+	if sig.length != -1 && sig.length > w.Len() {
+		return permError("body shorter than l tag")
+	}
+	if !bytes.Equal(bodyHasher.Sum(nil), sig.bh) {
+		return failure("body hash did not verify")
+	}
+
+	hasher := sig.hash.New()
+	for _, h := range selectHeaders(headers[:index], headers[index+1:], sig.fields) {
+		hasher.Write([]byte(canonRawHeader(sig.header, h)))
+	}
+	self := &rawHeader{headers[index].field, cutBTag(headers[index].raw)}
+	hasher.Write([]byte(strings.TrimSuffix(canonRawHeader(sig.header, self), "\r\n")))
+
+	if !verifyDigest(key.key, sig.hash, hasher.Sum(nil), sig.b) {
+		return failure("signature did not verify")
+	}
+	return nil
+}
+
+// verifyDigest checks a signature over digest, ed25519 signs the digest itself (RFC 8463).
+func verifyDigest(key crypto.PublicKey, hash crypto.Hash, digest, sig []byte) bool {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig) == nil
+	case ed25519.PublicKey:
+		return ed25519.Verify(k, digest, sig)
+	}
+	return false
+}
+
+// selectHeaders picks the header instances listed in fields from the bottom up.
+// Names without a remaining instance are skipped.
+func selectHeaders(before, after []*rawHeader, fields []string) []*rawHeader {
+	all := make([]*rawHeader, 0, len(before)+len(after))
+	all = append(all, before...)
+	all = append(all, after...)
+
+	used := map[int]bool{}
+	selected := []*rawHeader{}
+	for _, f := range fields {
+		for i := len(all) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(all[i].field, f) {
+				continue
+			}
+			used[i] = true
+			selected = append(selected, all[i])
+			break
+		}
+	}
+	return selected
+}
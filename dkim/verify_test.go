@@ -0,0 +1,249 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/message"
+)
+
+type fakeResolver map[string][]string
+
+func (this fakeResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := this[name]; ok {
+		return txts, nil
+	}
+	if name == "temp._domainkey.dtynn.me" {
+		return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func testKeyRecord(t *testing.T) string {
+	signer, err := newSigner(testPrivateKey)
+	if err != nil {
+		t.Fatal("newSigner: ", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(signer.(*keySigner).key.Public())
+	if err != nil {
+		t.Fatal("marshal public key: ", err)
+	}
+	return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+}
+
+func signedTestMessage(t *testing.T, selector string, setLength bool) []byte {
+	msg := message.NewMessage(message.Unencoded, message.CharsetUTF8, "text/plain")
+	msg.AddAddressHeader("From", "a@dtynn.me", "")
+	msg.AddAddressHeader("To", "b@example.com", "")
+	msg.AddNormalHeader("Subject", "verify   me")
+	msg.AddContentType()
+	msg.SetBody("line  one \r\nline two\r\n\r\n")
+
+	conf := NewDkimConf("dtynn.me", "", selector, setLength, testPrivateKey)
+	header, err := NewDefaultDkim(msg, conf).SignatureHeader()
+	if err != nil {
+		t.Fatal("sign: ", err)
+	}
+	msg.AddHeader(header)
+	return msg.Bytes()
+}
+
+func TestVerify(t *testing.T) {
+	record := testKeyRecord(t)
+	v := NewVerifier(fakeResolver{
+		"abc._domainkey.dtynn.me":     {record},
+		"revoked._domainkey.dtynn.me": {"v=DKIM1; p="},
+		"sha1._domainkey.dtynn.me":    {record + "; h=sha1"},
+		"multi._domainkey.dtynn.me":   {"v=spf1 -all", record},
+		"split._domainkey.dtynn.me":   {record[:20], record[20:]},
+	})
+
+	cases := []struct {
+		name     string
+		selector string
+		modify   func([]byte) []byte
+		status   Status
+	}{
+		{"valid", "abc", nil, StatusPass},
+		{"lf line endings", "abc", func(b []byte) []byte {
+			return []byte(string(b[:len(b)-2]) + "\n")
+		}, StatusPass},
+		{"tampered body", "abc", func(b []byte) []byte {
+			return append(b[:len(b)-2], []byte("more\r\n")...)
+		}, StatusFail},
+		{"tampered header", "abc", func(b []byte) []byte {
+			return []byte("Subject: other\r\n" + string(b))
+		}, StatusFail},
+		{"unrelated header", "abc", func(b []byte) []byte {
+			return []byte("Received: by mx.example.com\r\n" + string(b))
+		}, StatusPass},
+		{"no key", "missing", nil, StatusPermError},
+		{"revoked key", "revoked", nil, StatusPermError},
+		{"key lookup timeout", "temp", nil, StatusTempError},
+		{"hash not allowed", "sha1", nil, StatusPermError},
+		{"rsa-sha1 signature", "abc", func(b []byte) []byte {
+			return bytes.Replace(b, []byte("a=rsa-sha256"), []byte("a=rsa-sha1"), 1)
+		}, StatusPermError},
+		{"first valid record", "multi", nil, StatusPass},
+		{"records not joined", "split", nil, StatusPermError},
+	}
+
+	for _, c := range cases {
+		raw := signedTestMessage(t, c.selector, false)
+		if c.modify != nil {
+			raw = c.modify(raw)
+		}
+		results, err := v.Verify(raw)
+		if err != nil {
+			t.Errorf("%s: verify err: %s", c.name, err)
+			continue
+		}
+		if len(results) != 1 {
+			t.Errorf("%s: expect 1 result, get %d", c.name, len(results))
+			continue
+		}
+		if results[0].Status != c.status {
+			t.Errorf("%s: expect %s, get %s", c.name, c.status, results[0])
+		}
+	}
+}
+
+func TestVerifyLength(t *testing.T) {
+	v := NewVerifier(fakeResolver{"abc._domainkey.dtynn.me": {testKeyRecord(t)}})
+	raw := signedTestMessage(t, "abc", true)
+	raw = append(raw, []byte("appended after signing\r\n")...)
+
+	results, err := v.Verify(raw)
+	if err != nil {
+		t.Fatal("verify err: ", err)
+	}
+	if len(results) != 1 || results[0].Status != StatusPass {
+		t.Errorf("expect pass with l tag, get %v", results)
+	}
+}
+
+func TestVerifyTimestamp(t *testing.T) {
+	v := NewVerifier(fakeResolver{"abc._domainkey.dtynn.me": {testKeyRecord(t)}})
+	v.now = func() time.Time {
+		return time.Now().Add(-time.Hour)
+	}
+
+	results, err := v.Verify(signedTestMessage(t, "abc", false))
+	if err != nil {
+		t.Fatal("verify err: ", err)
+	}
+	if len(results) != 1 || results[0].Status != StatusPermError {
+		t.Errorf("expect permerror for future signature, get %v", results)
+	}
+}
+
+func TestVerifyMultiple(t *testing.T) {
+	v := NewVerifier(fakeResolver{"abc._domainkey.dtynn.me": {testKeyRecord(t)}})
+	raw := signedTestMessage(t, "abc", false)
+	raw = append([]byte("DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=x; h=subject; bh=; b=\r\n"), raw...)
+
+	results, err := v.Verify(raw)
+	if err != nil {
+		t.Fatal("verify err: ", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expect 2 results, get %d", len(results))
+	}
+	if results[0].Status != StatusPermError || results[0].Domain != "example.com" {
+		t.Errorf("expect permerror for unsigned from, get %s", results[0])
+	}
+	if results[1].Status != StatusPass {
+		t.Errorf("expect pass, get %s", results[1])
+	}
+}
+
+// key and message of RFC 8463 appendix A
+var (
+	testEd25519Seed   = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	testEd25519Record = "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	testEd25519Signed = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+		" d=football.example.com; i=@football.example.com;\r\n" +
+		" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+		" subject : date : message-id : from : subject : date;\r\n" +
+		" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+		" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+		" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+		"From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+		"\r\n" +
+		"Hi.\r\n" +
+		"\r\n" +
+		"We lost the game.  Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+)
+
+func testEd25519Key(t *testing.T) []byte {
+	seed, _ := base64.StdEncoding.DecodeString(testEd25519Seed)
+	der, err := x509.MarshalPKCS8PrivateKey(ed25519.NewKeyFromSeed(seed))
+	if err != nil {
+		t.Fatal("marshal private key: ", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestVerifyEd25519(t *testing.T) {
+	v := NewVerifier(fakeResolver{"brisbane._domainkey.football.example.com": {testEd25519Record}})
+	results, err := v.Verify([]byte(testEd25519Signed))
+	if err != nil {
+		t.Fatal("verify err: ", err)
+	}
+	if len(results) != 1 || results[0].Status != StatusPass || results[0].Algorithm != "ed25519-sha256" {
+		t.Fatalf("expect ed25519 pass, get %v", results)
+	}
+
+	// a rsa key must not verify an ed25519 signature
+	v = NewVerifier(fakeResolver{"brisbane._domainkey.football.example.com": {testKeyRecord(t)}})
+	if results, _ = v.Verify([]byte(testEd25519Signed)); results[0].Status != StatusPermError {
+		t.Errorf("expect permerror for key type mismatch, get %s", results[0])
+	}
+}
+
+func TestDualSign(t *testing.T) {
+	msg := message.NewMessage(message.Unencoded, message.CharsetUTF8, "text/plain")
+	msg.AddAddressHeader("From", "a@football.example.com", "")
+	msg.AddNormalHeader("Subject", "dual")
+	msg.SetBody("both keys\r\n")
+
+	headers, err := SignatureHeaders(msg,
+		NewDkimConf("football.example.com", "", "rsa", false, testPrivateKey),
+		NewDkimConf("football.example.com", "", "brisbane", false, testEd25519Key(t)))
+	if err != nil {
+		t.Fatal("sign: ", err)
+	}
+	for _, h := range headers {
+		msg.AddHeader(h)
+	}
+
+	v := NewVerifier(fakeResolver{
+		"rsa._domainkey.football.example.com":      {testKeyRecord(t)},
+		"brisbane._domainkey.football.example.com": {testEd25519Record},
+	})
+	results, err := v.Verify(msg.Bytes())
+	if err != nil {
+		t.Fatal("verify err: ", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expect 2 results, get %d", len(results))
+	}
+	algorithms := []string{"rsa-sha256", "ed25519-sha256"}
+	for i, r := range results {
+		if r.Status != StatusPass || r.Algorithm != algorithms[i] {
+			t.Errorf("expect %s pass, get %s %s", algorithms[i], r.Algorithm, r)
+		}
+	}
+}
@@ -0,0 +1,330 @@
+package dmarc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"mime/multipart"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dtynn/dmail/dkim"
+	"github.com/dtynn/dmail/dns"
+	"github.com/dtynn/dmail/message"
+	"github.com/dtynn/dmail/utils"
+)
+
+const (
+	reportInterval   = 24 * time.Hour
+	reportLineLength = 76
+	reportIdLength   = 12
+)
+
+// MessageSender delivers the generated reports, see dmail.Sender.
+type MessageSender interface {
+	SendMessage(from string, to []string, msg *message.Message) error
+}
+
+type aggregate struct {
+	domain  string
+	begin   time.Time
+	record  *Record
+	records map[string]*ReportRecord
+	keys    []string
+}
+
+// Aggregator collects DMARC results of inbound messages
+// into daily aggregate reports per policy domain.
+type Aggregator struct {
+	receiver string
+	email    string
+	resolver Resolver
+
+	mutex      sync.Mutex
+	aggregates map[string]*aggregate
+}
+
+func NewAggregator(receiver, email string, r Resolver) *Aggregator {
+	if r == nil {
+		r = dns.DefaultResolver
+	}
+	return &Aggregator{
+		receiver:   receiver,
+		email:      email,
+		resolver:   r,
+		aggregates: map[string]*aggregate{},
+	}
+}
+
+// Add records the outcome of one message received at t.
+// Results without a published rua are ignored.
+func (this *Aggregator) Add(t time.Time, result *Result, ip net.IP, envelopeFrom string, spf *dns.SpfCheck, dkims []*dkim.Result) {
+	if result == nil || result.Record == nil || len(result.Record.Rua) == 0 {
+		return
+	}
+
+	record := newReportRecord(result, ip, envelopeFrom, spf, dkims)
+	keyData, _ := xml.Marshal(record)
+	key := string(keyData)
+
+	begin := t.UTC().Truncate(reportInterval)
+	name := fmt.Sprintf("%s/%d", result.PolicyDomain, begin.Unix())
+
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	agg, ok := this.aggregates[name]
+	if !ok {
+		agg = &aggregate{
+			domain:  result.PolicyDomain,
+			begin:   begin,
+			records: map[string]*ReportRecord{},
+			keys:    []string{},
+		}
+		this.aggregates[name] = agg
+	}
+	agg.record = result.Record
+
+	if existing, ok := agg.records[key]; ok {
+		existing.Row.Count += 1
+		return
+	}
+	record.Row.Count = 1
+	agg.records[key] = record
+	agg.keys = append(agg.keys, key)
+}
+
+func newReportRecord(result *Result, ip net.IP, envelopeFrom string, spf *dns.SpfCheck, dkims []*dkim.Result) *ReportRecord {
+	record := &ReportRecord{}
+	if ip != nil {
+		record.Row.SourceIP = ip.String()
+	}
+
+	evaluated := &record.Row.PolicyEvaluated
+	evaluated.Disposition = result.Disposition
+	evaluated.Dkim, evaluated.Spf = StatusFail, StatusFail
+	if result.DkimAligned {
+		evaluated.Dkim = StatusPass
+	}
+	if result.SpfAligned {
+		evaluated.Spf = StatusPass
+	}
+	if result.Status == StatusFail && result.Disposition != result.Policy {
+		evaluated.Reasons = []*PolicyOverrideReason{{Type: "sampled_out"}}
+	}
+
+	if i := strings.LastIndex(envelopeFrom, "@"); i != -1 {
+		envelopeFrom = envelopeFrom[i+1:]
+	}
+	record.Identifiers.HeaderFrom = result.Domain
+	record.Identifiers.EnvelopeFrom = envelopeFrom
+
+	for _, d := range dkims {
+		record.AuthResults.Dkim = append(record.AuthResults.Dkim, &DkimAuthResult{
+			Domain:   d.Domain,
+			Selector: d.Selector,
+			Result:   string(d.Status),
+		})
+	}
+
+	spfResult := &SpfAuthResult{Domain: envelopeFrom, Scope: "mfrom", Result: string(dns.SpfNone)}
+	if spf != nil {
+		spfResult.Domain = spf.Domain
+		spfResult.Result = string(spf.Result)
+		if spf.Identity == dns.SpfIdentityHelo {
+			spfResult.Scope = "helo"
+		}
+	}
+	record.AuthResults.Spf = []*SpfAuthResult{spfResult}
+	return record
+}
+
+// Report is the aggregate report of one policy domain for one day.
+type Report struct {
+	Domain   string
+	Rua      []string
+	Feedback *Feedback
+}
+
+// Flush removes and returns the reports of the days ended before now.
+func (this *Aggregator) Flush(now time.Time) []*Report {
+	this.mutex.Lock()
+	defer this.mutex.Unlock()
+
+	names := []string{}
+	for name, agg := range this.aggregates {
+		if !agg.begin.Add(reportInterval).After(now) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	reports := []*Report{}
+	for _, name := range names {
+		reports = append(reports, this.report(this.aggregates[name]))
+		delete(this.aggregates, name)
+	}
+	return reports
+}
+
+func (this *Aggregator) report(agg *aggregate) *Report {
+	feedback := &Feedback{
+		Version: "1.0",
+		ReportMetadata: ReportMetadata{
+			OrgName:  this.receiver,
+			Email:    this.email,
+			ReportId: fmt.Sprintf("%s.%d.%s", agg.domain, agg.begin.Unix(), utils.RandString(reportIdLength)),
+			DateRange: DateRange{
+				Begin: agg.begin.Unix(),
+				End:   agg.begin.Add(reportInterval).Unix() - 1,
+			},
+		},
+		PolicyPublished: PolicyPublished{
+			Domain: agg.domain,
+			Adkim:  agg.record.Adkim,
+			Aspf:   agg.record.Aspf,
+			P:      agg.record.Policy,
+			Sp:     agg.record.SubdomainPolicy,
+			Pct:    agg.record.Pct,
+			Fo:     agg.record.Fo,
+		},
+		Records: make([]*ReportRecord, 0, len(agg.keys)),
+	}
+	for _, key := range agg.keys {
+		feedback.Records = append(feedback.Records, agg.records[key])
+	}
+	return &Report{agg.domain, agg.record.Rua, feedback}
+}
+
+// Filename returns the attachment name of RFC 7489 section 7.2.1.1.
+func (this *Report) Filename() string {
+	dr := this.Feedback.ReportMetadata.DateRange
+	return fmt.Sprintf("%s!%s!%d!%d.xml.gz", this.Feedback.ReportMetadata.OrgName, this.Domain, dr.Begin, dr.End)
+}
+
+func (this *Report) Gzip() ([]byte, error) {
+	data, err := this.Feedback.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Message builds the report mail with the gzipped report attached.
+func (this *Report) Message(to []string) (*message.Message, error) {
+	gz, err := this.Gzip()
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := this.Feedback.ReportMetadata
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	text := textproto.MIMEHeader{}
+	text.Set("Content-Type", "text/plain; charset=UTF-8")
+	w, err := mw.CreatePart(text)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(w, "This is an aggregate report from %s for %s.\r\n", metadata.OrgName, this.Domain)
+
+	filename := this.Filename()
+	attachment := textproto.MIMEHeader{}
+	attachment.Set("Content-Type", fmt.Sprintf("application/gzip; name=%q", filename))
+	attachment.Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	attachment.Set("Content-Transfer-Encoding", "base64")
+	if w, err = mw.CreatePart(attachment); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(gz)
+	for len(encoded) > reportLineLength {
+		w.Write([]byte(encoded[:reportLineLength] + "\r\n"))
+		encoded = encoded[reportLineLength:]
+	}
+	w.Write([]byte(encoded + "\r\n"))
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	msg := message.NewMessage(message.Unencoded, message.CharsetUTF8, "")
+	msg.AddAddressHeader("From", metadata.Email, "")
+	for _, t := range to {
+		msg.AddAddressHeader("To", t, "")
+	}
+	msg.AddNormalHeader("Subject", fmt.Sprintf("Report Domain: %s Submitter: %s Report-ID: <%s>",
+		this.Domain, metadata.OrgName, metadata.ReportId))
+	msg.AddDate()
+	msg.AddNormalHeader("MIME-Version", "1.0")
+	msg.AddNormalHeader("Content-Type", fmt.Sprintf("multipart/mixed; boundary=%q", mw.Boundary()))
+	msg.SetBody(body.String())
+	return msg, nil
+}
+
+// Destinations returns the mailto addresses of rua allowed to receive the report.
+// Addresses outside the policy domain must authorize it as described in RFC 7489 section 7.1.
+func (this *Aggregator) Destinations(report *Report) []string {
+	allowed := []string{}
+	for _, addr := range MailtoAddresses(report.Rua) {
+		i := strings.LastIndex(addr, "@")
+		if i == -1 {
+			continue
+		}
+		domain := strings.ToLower(addr[i+1:])
+		if OrganizationalDomain(domain) == OrganizationalDomain(report.Domain) ||
+			this.authorized(report.Domain, domain) {
+			allowed = append(allowed, addr)
+		}
+	}
+	return allowed
+}
+
+func (this *Aggregator) authorized(policyDomain, destination string) bool {
+	txts, err := this.resolver.LookupTXT(policyDomain + "._report." + recordPrefix + destination)
+	if err != nil {
+		return false
+	}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v="+recordVersion) {
+			return true
+		}
+	}
+	return false
+}
+
+// SendReports flushes the finished reports and mails them to their rua addresses.
+func (this *Aggregator) SendReports(s MessageSender, now time.Time) error {
+	errs := []string{}
+	for _, report := range this.Flush(now) {
+		to := this.Destinations(report)
+		if len(to) == 0 {
+			continue
+		}
+		msg, err := report.Message(to)
+		if err == nil {
+			err = s.SendMessage(this.email, to, msg)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", report.Domain, err))
+		}
+	}
+	if len(errs) != 0 {
+		return fmt.Errorf("send reports: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package dmarc
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dtynn/dmail/dkim"
+	"github.com/dtynn/dmail/dns"
+	"github.com/dtynn/dmail/message"
+)
+
+const AuthResultsHeaderName = "Authentication-Results"
+
+// AuthResults writes an Authentication-Results header of RFC 8601.
+type AuthResults struct {
+	authservId string
+	results    []string
+}
+
+func NewAuthResults(authservId string) *AuthResults {
+	return &AuthResults{authservId, []string{}}
+}
+
+func (this *AuthResults) add(format string, v ...interface{}) {
+	this.results = append(this.results, fmt.Sprintf(format, v...))
+}
+
+func (this *AuthResults) AddSpf(spf *dns.SpfCheck) {
+	if spf == nil {
+		this.add("spf=none")
+		return
+	}
+	if spf.Identity == dns.SpfIdentityHelo {
+		this.add("spf=%s smtp.helo=%s", spf.Result, spf.Helo)
+		return
+	}
+	this.add("spf=%s smtp.mailfrom=%s", spf.Result, spf.Sender)
+}
+
+func (this *AuthResults) AddDkim(results []*dkim.Result) {
+	if len(results) == 0 {
+		this.add("dkim=none")
+		return
+	}
+	for _, r := range results {
+		reason := ""
+		if r.Reason != "" {
+			reason = fmt.Sprintf(" (%s)", r.Reason)
+		}
+		this.add("dkim=%s%s header.d=%s header.s=%s header.i=%s", r.Status, reason, r.Domain, r.Selector, r.Identity)
+	}
+}
+
+func (this *AuthResults) AddDmarc(result *Result) {
+	if result == nil {
+		this.add("dmarc=none")
+		return
+	}
+	comment := ""
+	if result.Record != nil {
+		comment = fmt.Sprintf(" (p=%s dis=%s)", result.Policy, result.Disposition)
+	}
+	this.add("dmarc=%s%s header.from=%s", result.Status, comment, result.Domain)
+}
+
+func (this *AuthResults) Value() string {
+	if len(this.results) == 0 {
+		return this.authservId + "; none"
+	}
+	return this.authservId + ";\r\n\t" + strings.Join(this.results, ";\r\n\t")
+}
+
+func (this *AuthResults) Header() message.Header {
+	return message.NewNormalHeader(AuthResultsHeaderName, this.Value())
+}
+
+// AuthResultsHeader returns the Authentication-Results header for a complete evaluation.
+func AuthResultsHeader(authservId string, spf *dns.SpfCheck, dkims []*dkim.Result, result *Result) message.Header {
+	ar := NewAuthResults(authservId)
+	ar.AddSpf(spf)
+	ar.AddDkim(dkims)
+	ar.AddDmarc(result)
+	return ar.Header()
+}
@@ -0,0 +1,225 @@
+package dmarc
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/dtynn/dmail/dkim"
+	"github.com/dtynn/dmail/dns"
+)
+
+type Status string
+
+const (
+	StatusPass      Status = "pass"
+	StatusFail      Status = "fail"
+	StatusNone      Status = "none"
+	StatusTempError Status = "temperror"
+	StatusPermError Status = "permerror"
+)
+
+var errFromHeader = fmt.Errorf("message must have exactly one from address")
+
+// Resolver fetches the dmarc records.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+}
+
+// Result is the DMARC evaluation of one message.
+type Result struct {
+	Status       Status
+	Reason       string
+	Domain       string
+	PolicyDomain string
+	Record       *Record
+
+	SpfAligned  bool
+	DkimAligned bool
+
+	// Policy is the policy requested by the domain owner,
+	// Disposition the one to apply after pct sampling.
+	Policy      Policy
+	Disposition Policy
+}
+
+// Reject reports whether the message should be rejected.
+func (this *Result) Reject() bool {
+	return this.Disposition == PolicyReject
+}
+
+// Quarantine reports whether the message should be quarantined.
+func (this *Result) Quarantine() bool {
+	return this.Disposition == PolicyQuarantine
+}
+
+type Evaluator struct {
+	resolver Resolver
+	verifier *dkim.Verifier
+	random   func(n int) int
+}
+
+func NewEvaluator(r Resolver) *Evaluator {
+	if r == nil {
+		r = dns.DefaultResolver
+	}
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano()))
+	return &Evaluator{
+		resolver: r,
+		verifier: dkim.NewVerifier(r),
+		random:   rnd.Intn,
+	}
+}
+
+// LookupRecord fetches the record for domain,
+// falling back to the record of its organizational domain.
+func (this *Evaluator) LookupRecord(domain string) (*Record, string, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	record, err := this.lookupRecord(domain)
+	if err != errNoRecord {
+		return record, domain, err
+	}
+
+	org := OrganizationalDomain(domain)
+	if org == domain {
+		return nil, domain, err
+	}
+	record, err = this.lookupRecord(org)
+	return record, org, err
+}
+
+func (this *Evaluator) lookupRecord(domain string) (*Record, error) {
+	txts, err := this.resolver.LookupTXT(recordPrefix + domain)
+	if err != nil {
+		if dns.IsNotFound(err) {
+			return nil, errNoRecord
+		}
+		return nil, err
+	}
+
+	records := []string{}
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.TrimSpace(txt), "v="+recordVersion) {
+			records = append(records, txt)
+		}
+	}
+	switch len(records) {
+	case 0:
+		return nil, errNoRecord
+	case 1:
+		record, err := ParseRecord(records[0])
+		if err != nil {
+			return nil, errNoRecord
+		}
+		return record, nil
+	}
+	return nil, errMultipleRecords
+}
+
+// Evaluate applies the DMARC policy of fromDomain to the SPF and DKIM results.
+func (this *Evaluator) Evaluate(fromDomain string, spf *dns.SpfCheck, dkims []*dkim.Result) *Result {
+	result := &Result{
+		Status:      StatusNone,
+		Domain:      strings.ToLower(strings.TrimSuffix(fromDomain, ".")),
+		Disposition: PolicyNone,
+	}
+
+	record, policyDomain, err := this.LookupRecord(result.Domain)
+	result.PolicyDomain = policyDomain
+	switch err {
+	case nil:
+	case errNoRecord, errMultipleRecords:
+		result.Reason = err.Error()
+		return result
+	default:
+		result.Status = StatusTempError
+		result.Reason = err.Error()
+		return result
+	}
+	result.Record = record
+
+	if spf != nil && spf.Result == dns.SpfPass {
+		result.SpfAligned = aligned(spf.Domain, result.Domain, record.Aspf)
+	}
+	for _, d := range dkims {
+		if d.Status == dkim.StatusPass && aligned(d.Domain, result.Domain, record.Adkim) {
+			result.DkimAligned = true
+			break
+		}
+	}
+
+	result.Policy = record.Policy
+	if policyDomain != result.Domain {
+		result.Policy = record.SubdomainPolicy
+	}
+
+	if result.SpfAligned || result.DkimAligned {
+		result.Status = StatusPass
+		return result
+	}
+
+	result.Status = StatusFail
+	result.Disposition = result.Policy
+	if record.Pct < 100 && this.random(100) >= record.Pct {
+		// messages not sampled get the next less severe policy
+		switch result.Policy {
+		case PolicyReject:
+			result.Disposition = PolicyQuarantine
+		case PolicyQuarantine:
+			result.Disposition = PolicyNone
+		}
+	}
+	return result
+}
+
+// EvaluateMessage verifies the DKIM signatures of a raw message
+// and evaluates the policy of its From domain.
+func (this *Evaluator) EvaluateMessage(raw []byte, spf *dns.SpfCheck) (*Result, []*dkim.Result, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, nil, err
+	}
+	domain, err := fromDomain(msg.Header)
+	if err != nil {
+		return &Result{Status: StatusPermError, Reason: err.Error(), Disposition: PolicyNone}, nil, nil
+	}
+
+	dkims, err := this.verifier.Verify(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	return this.Evaluate(domain, spf, dkims), dkims, nil
+}
+
+func fromDomain(h mail.Header) (string, error) {
+	froms := h["From"]
+	if len(froms) != 1 {
+		return "", errFromHeader
+	}
+	addrs, err := mail.ParseAddressList(froms[0])
+	if err != nil {
+		return "", err
+	}
+	if len(addrs) != 1 {
+		return "", errFromHeader
+	}
+	i := strings.LastIndex(addrs[0].Address, "@")
+	if i == -1 {
+		return "", errFromHeader
+	}
+	return addrs[0].Address[i+1:], nil
+}
+
+func aligned(domain, fromDomain string, mode Alignment) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if domain == fromDomain {
+		return true
+	}
+	if mode == AlignmentStrict {
+		return false
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(fromDomain)
+}
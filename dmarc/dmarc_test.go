@@ -0,0 +1,147 @@
+package dmarc
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/dtynn/dmail/dkim"
+	"github.com/dtynn/dmail/dns"
+)
+
+type fakeResolver map[string][]string
+
+func (this fakeResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := this[name]; ok {
+		return txts, nil
+	}
+	if strings.HasPrefix(name, "_dmarc.temp.") {
+		return nil, &net.DNSError{Err: "timeout", Name: name, IsTimeout: true}
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	cases := map[string]string{
+		"example.com":             "example.com",
+		"mail.example.com":        "example.com",
+		"a.b.example.co.uk":       "example.co.uk",
+		"co.uk":                   "co.uk",
+		"com":                     "com",
+		"a.b.c.kobe.jp":           "b.c.kobe.jp",
+		"a.city.kobe.jp":          "city.kobe.jp",
+		"Mail.Example.COM.":       "example.com",
+		"foo.unknowntld":          "foo.unknowntld",
+		"a.foo.unknowntld":        "foo.unknowntld",
+		"user.github.io":          "user.github.io",
+		"deep.sub.user.github.io": "user.github.io",
+	}
+	for in, expect := range cases {
+		if out := OrganizationalDomain(in); out != expect {
+			t.Errorf("%s: expect %s, get %s", in, expect, out)
+		}
+	}
+}
+
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=DMARC1; p=reject; sp=quarantine; pct=50; adkim=s; rua=mailto:a@example.com!10m, mailto:b@example.com; ri=3600")
+	if err != nil {
+		t.Fatal("parse: ", err)
+	}
+	if r.Policy != PolicyReject || r.SubdomainPolicy != PolicyQuarantine || r.Pct != 50 ||
+		r.Adkim != AlignmentStrict || r.Aspf != AlignmentRelaxed || r.Ri != 3600 {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if addrs := MailtoAddresses(r.Rua); len(addrs) != 2 || addrs[0] != "a@example.com" {
+		t.Errorf("unexpected rua %v", r.Rua)
+	}
+
+	r, err = ParseRecord("v=DMARC1; p=bogus; rua=mailto:a@example.com")
+	if err != nil || r.Policy != PolicyNone || r.SubdomainPolicy != PolicyNone {
+		t.Errorf("expect p=none for invalid policy with rua, get %+v %v", r, err)
+	}
+
+	for _, bad := range []string{"p=reject; v=DMARC1", "v=DMARC2; p=none", "v=DMARC1; p=bogus", ""} {
+		if _, err := ParseRecord(bad); err == nil {
+			t.Errorf("%q: expect error", bad)
+		}
+	}
+}
+
+func newTestEvaluator() *Evaluator {
+	e := NewEvaluator(fakeResolver{
+		"_dmarc.example.com": {"v=DMARC1; p=reject; sp=quarantine"},
+		"_dmarc.strict.com":  {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+		"_dmarc.half.com":    {"v=DMARC1; p=reject; pct=50"},
+		"_dmarc.multi.com":   {"v=DMARC1; p=reject", "v=DMARC1; p=none"},
+	})
+	return e
+}
+
+func TestEvaluate(t *testing.T) {
+	e := newTestEvaluator()
+	e.random = func(n int) int { return 0 }
+
+	spfPass := func(domain string) *dns.SpfCheck {
+		return &dns.SpfCheck{Result: dns.SpfPass, Domain: domain, Identity: dns.SpfIdentityMailFrom}
+	}
+	dkimPass := func(domain string) []*dkim.Result {
+		return []*dkim.Result{{Status: dkim.StatusPass, Domain: domain}}
+	}
+
+	cases := []struct {
+		name        string
+		from        string
+		spf         *dns.SpfCheck
+		dkims       []*dkim.Result
+		status      Status
+		disposition Policy
+	}{
+		{"spf aligned", "example.com", spfPass("example.com"), nil, StatusPass, PolicyNone},
+		{"spf relaxed", "example.com", spfPass("bounce.example.com"), nil, StatusPass, PolicyNone},
+		{"dkim relaxed", "news.example.com", nil, dkimPass("example.com"), StatusPass, PolicyNone},
+		{"unaligned", "example.com", spfPass("other.com"), dkimPass("other.com"), StatusFail, PolicyReject},
+		{"dkim failed", "example.com", nil, []*dkim.Result{{Status: dkim.StatusFail, Domain: "example.com"}}, StatusFail, PolicyReject},
+		{"subdomain policy", "news.example.com", nil, nil, StatusFail, PolicyQuarantine},
+		{"strict spf", "strict.com", spfPass("mail.strict.com"), nil, StatusFail, PolicyReject},
+		{"strict dkim", "strict.com", nil, dkimPass("strict.com"), StatusPass, PolicyNone},
+		{"no record", "none.com", nil, nil, StatusNone, PolicyNone},
+		{"multiple records", "multi.com", nil, nil, StatusNone, PolicyNone},
+		{"temp error", "temp.com", nil, nil, StatusTempError, PolicyNone},
+	}
+
+	for _, c := range cases {
+		r := e.Evaluate(c.from, c.spf, c.dkims)
+		if r.Status != c.status || r.Disposition != c.disposition {
+			t.Errorf("%s: expect %s/%s, get %s/%s (%s)", c.name, c.status, c.disposition, r.Status, r.Disposition, r.Reason)
+		}
+	}
+}
+
+func TestEvaluatePct(t *testing.T) {
+	e := newTestEvaluator()
+
+	e.random = func(n int) int { return 10 }
+	if r := e.Evaluate("half.com", nil, nil); r.Disposition != PolicyReject {
+		t.Errorf("sampled message: expect reject, get %s", r.Disposition)
+	}
+
+	e.random = func(n int) int { return 60 }
+	if r := e.Evaluate("half.com", nil, nil); r.Disposition != PolicyQuarantine || r.Policy != PolicyReject {
+		t.Errorf("unsampled message: expect quarantine, get %s", r.Disposition)
+	}
+}
+
+func TestAuthResultsHeader(t *testing.T) {
+	spf := &dns.SpfCheck{Result: dns.SpfPass, Sender: "a@example.com", Identity: dns.SpfIdentityMailFrom}
+	dkims := []*dkim.Result{{Status: dkim.StatusPass, Domain: "example.com", Selector: "s1", Identity: "@example.com"}}
+	result := &Result{Status: StatusPass, Domain: "example.com", Record: &Record{}, Policy: PolicyReject, Disposition: PolicyNone}
+
+	h := AuthResultsHeader("mx.dtynn.me", spf, dkims, result)
+	expect := "Authentication-Results: mx.dtynn.me;\r\n\tspf=pass smtp.mailfrom=a@example.com;\r\n\t" +
+		"dkim=pass header.d=example.com header.s=s1 header.i=@example.com;\r\n\t" +
+		"dmarc=pass (p=reject dis=none) header.from=example.com"
+	if h.String() != expect {
+		t.Errorf("unexpected header:\n%s", h.String())
+	}
+}
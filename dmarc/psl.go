@@ -0,0 +1,87 @@
+package dmarc
+
+import (
+	_ "embed"
+	"strings"
+	"sync"
+)
+
+// public_suffix_list.dat is a copy of https://publicsuffix.org/list/public_suffix_list.dat
+
+//go:embed public_suffix_list.dat
+var pslData string
+
+type suffixList struct {
+	rules      map[string]bool
+	wildcards  map[string]bool
+	exceptions map[string]bool
+}
+
+var (
+	psl     *suffixList
+	pslOnce sync.Once
+)
+
+func loadSuffixList() {
+	psl = &suffixList{
+		rules:      map[string]bool{},
+		wildcards:  map[string]bool{},
+		exceptions: map[string]bool{},
+	}
+	for _, line := range strings.Split(pslData, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if i := strings.IndexAny(line, " \t"); i != -1 {
+			line = line[:i]
+		}
+		line = strings.ToLower(line)
+
+		switch {
+		case strings.HasPrefix(line, "!"):
+			psl.exceptions[line[1:]] = true
+		case strings.HasPrefix(line, "*."):
+			psl.wildcards[line[2:]] = true
+		default:
+			psl.rules[line] = true
+		}
+	}
+}
+
+// PublicSuffix returns the public suffix of domain.
+// Unlisted top level domains are public suffixes.
+func PublicSuffix(domain string) string {
+	pslOnce.Do(loadSuffixList)
+
+	labels := strings.Split(strings.ToLower(strings.TrimSuffix(domain, ".")), ".")
+	for i := range labels {
+		name := strings.Join(labels[i:], ".")
+		if psl.exceptions[name] {
+			return strings.Join(labels[i+1:], ".")
+		}
+		if psl.rules[name] {
+			return name
+		}
+		if i+1 < len(labels) && psl.wildcards[strings.Join(labels[i+1:], ".")] {
+			return name
+		}
+	}
+	return labels[len(labels)-1]
+}
+
+// OrganizationalDomain returns the organizational domain of RFC 7489 section 3.2,
+// i.e. the public suffix plus one label.
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	suffix := PublicSuffix(domain)
+	if domain == suffix {
+		return domain
+	}
+
+	rest := strings.TrimSuffix(domain, "."+suffix)
+	if i := strings.LastIndex(rest, "."); i != -1 {
+		rest = rest[i+1:]
+	}
+	return rest + "." + suffix
+}
@@ -0,0 +1,168 @@
+package dmarc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+type Alignment string
+
+const (
+	AlignmentRelaxed Alignment = "r"
+	AlignmentStrict  Alignment = "s"
+)
+
+const (
+	recordPrefix    = "_dmarc."
+	recordVersion   = "DMARC1"
+	defaultInterval = 86400
+)
+
+var (
+	errNoRecord        = fmt.Errorf("no dmarc record")
+	errMultipleRecords = fmt.Errorf("multiple dmarc records")
+	errInvalidVersion  = fmt.Errorf("invalid dmarc version")
+	errInvalidPolicy   = fmt.Errorf("invalid dmarc policy")
+)
+
+// Record is a parsed DMARC record of RFC 7489 section 6.3.
+type Record struct {
+	Policy          Policy
+	SubdomainPolicy Policy
+	Pct             int
+	Adkim           Alignment
+	Aspf            Alignment
+	Rua             []string
+	Ruf             []string
+	Fo              string
+	Rf              string
+	Ri              int
+}
+
+func ParseRecord(txt string) (*Record, error) {
+	r := &Record{
+		Pct:   100,
+		Adkim: AlignmentRelaxed,
+		Aspf:  AlignmentRelaxed,
+		Fo:    "0",
+		Rf:    "afrf",
+		Ri:    defaultInterval,
+	}
+
+	specs := strings.Split(txt, ";")
+	first := true
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		i := strings.Index(spec, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid tag %q", spec)
+		}
+		name := strings.ToLower(strings.TrimSpace(spec[:i]))
+		value := strings.TrimSpace(spec[i+1:])
+
+		if first {
+			if name != "v" || value != recordVersion {
+				return nil, errInvalidVersion
+			}
+			first = false
+			continue
+		}
+
+		switch name {
+		case "p":
+			r.Policy = parsePolicy(value)
+		case "sp":
+			r.SubdomainPolicy = parsePolicy(value)
+		case "pct":
+			pct, err := strconv.Atoi(value)
+			if err == nil && pct >= 0 && pct <= 100 {
+				r.Pct = pct
+			}
+		case "adkim":
+			r.Adkim = parseAlignment(value)
+		case "aspf":
+			r.Aspf = parseAlignment(value)
+		case "rua":
+			r.Rua = parseUris(value)
+		case "ruf":
+			r.Ruf = parseUris(value)
+		case "fo":
+			r.Fo = value
+		case "rf":
+			r.Rf = value
+		case "ri":
+			if ri, err := strconv.Atoi(value); err == nil && ri > 0 {
+				r.Ri = ri
+			}
+		}
+	}
+
+	if first {
+		return nil, errInvalidVersion
+	}
+
+	// a record with a valid rua but an invalid or missing policy is treated as p=none
+	if r.Policy == "" {
+		if len(r.Rua) == 0 {
+			return nil, errInvalidPolicy
+		}
+		r.Policy = PolicyNone
+	}
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+	return r, nil
+}
+
+func parsePolicy(s string) Policy {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p
+	}
+	return ""
+}
+
+func parseAlignment(s string) Alignment {
+	if strings.ToLower(s) == "s" {
+		return AlignmentStrict
+	}
+	return AlignmentRelaxed
+}
+
+// parseUris parses a comma separated list of dmarc-uri, dropping the size limits.
+func parseUris(s string) []string {
+	uris := []string{}
+	for _, uri := range strings.Split(s, ",") {
+		uri = strings.TrimSpace(uri)
+		if i := strings.LastIndex(uri, "!"); i != -1 {
+			uri = uri[:i]
+		}
+		if uri != "" {
+			uris = append(uris, uri)
+		}
+	}
+	return uris
+}
+
+// MailtoAddresses returns the addresses of the mailto uris in uris.
+func MailtoAddresses(uris []string) []string {
+	addrs := []string{}
+	for _, uri := range uris {
+		if len(uri) > 7 && strings.EqualFold(uri[:7], "mailto:") {
+			addrs = append(addrs, uri[7:])
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,223 @@
+package dmarc
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"strings"
+)
+
+// Aggregate report format of RFC 7489 appendix C
+
+type Feedback struct {
+	XMLName         xml.Name        `xml:"feedback"`
+	Version         string          `xml:"version,omitempty"`
+	ReportMetadata  ReportMetadata  `xml:"report_metadata"`
+	PolicyPublished PolicyPublished `xml:"policy_published"`
+	Records         []*ReportRecord `xml:"record"`
+}
+
+type ReportMetadata struct {
+	OrgName          string    `xml:"org_name"`
+	Email            string    `xml:"email"`
+	ExtraContactInfo string    `xml:"extra_contact_info,omitempty"`
+	ReportId         string    `xml:"report_id"`
+	DateRange        DateRange `xml:"date_range"`
+	Errors           []string  `xml:"error,omitempty"`
+}
+
+type DateRange struct {
+	Begin int64 `xml:"begin"`
+	End   int64 `xml:"end"`
+}
+
+type PolicyPublished struct {
+	Domain string    `xml:"domain"`
+	Adkim  Alignment `xml:"adkim,omitempty"`
+	Aspf   Alignment `xml:"aspf,omitempty"`
+	P      Policy    `xml:"p"`
+	Sp     Policy    `xml:"sp,omitempty"`
+	Pct    int       `xml:"pct"`
+	Fo     string    `xml:"fo,omitempty"`
+}
+
+type ReportRecord struct {
+	Row         Row               `xml:"row"`
+	Identifiers Identifiers       `xml:"identifiers"`
+	AuthResults ReportAuthResults `xml:"auth_results"`
+}
+
+type Row struct {
+	SourceIP        string          `xml:"source_ip"`
+	Count           int             `xml:"count"`
+	PolicyEvaluated PolicyEvaluated `xml:"policy_evaluated"`
+}
+
+type PolicyEvaluated struct {
+	Disposition Policy                  `xml:"disposition"`
+	Dkim        Status                  `xml:"dkim"`
+	Spf         Status                  `xml:"spf"`
+	Reasons     []*PolicyOverrideReason `xml:"reason,omitempty"`
+}
+
+type PolicyOverrideReason struct {
+	Type    string `xml:"type"`
+	Comment string `xml:"comment,omitempty"`
+}
+
+type Identifiers struct {
+	EnvelopeTo   string `xml:"envelope_to,omitempty"`
+	EnvelopeFrom string `xml:"envelope_from,omitempty"`
+	HeaderFrom   string `xml:"header_from"`
+}
+
+type ReportAuthResults struct {
+	Dkim []*DkimAuthResult `xml:"dkim,omitempty"`
+	Spf  []*SpfAuthResult  `xml:"spf"`
+}
+
+type DkimAuthResult struct {
+	Domain      string `xml:"domain"`
+	Selector    string `xml:"selector,omitempty"`
+	Result      string `xml:"result"`
+	HumanResult string `xml:"human_result,omitempty"`
+}
+
+type SpfAuthResult struct {
+	Domain string `xml:"domain"`
+	Scope  string `xml:"scope,omitempty"`
+	Result string `xml:"result"`
+}
+
+// Failures returns the records which passed neither aligned DKIM nor aligned SPF.
+func (this *Feedback) Failures() []*ReportRecord {
+	failures := []*ReportRecord{}
+	for _, r := range this.Records {
+		evaluated := r.Row.PolicyEvaluated
+		if evaluated.Dkim != StatusPass && evaluated.Spf != StatusPass {
+			failures = append(failures, r)
+		}
+	}
+	return failures
+}
+
+// Marshal returns the xml document of the report.
+func (this *Feedback) Marshal() ([]byte, error) {
+	data, err := xml.MarshalIndent(this, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zipMagic  = []byte("PK\x03\x04")
+
+	errNoReport = fmt.Errorf("no aggregate report found")
+)
+
+// ParseReport parses an aggregate report, either plain, gzipped or zipped.
+func ParseReport(r io.Reader) (*Feedback, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, gzipMagic):
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		if data, err = ioutil.ReadAll(gr); err != nil {
+			return nil, err
+		}
+	case bytes.HasPrefix(data, zipMagic):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		if len(zr.File) == 0 {
+			return nil, errNoReport
+		}
+		f, err := zr.File[0].Open()
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if data, err = ioutil.ReadAll(f); err != nil {
+			return nil, err
+		}
+	}
+
+	feedback := &Feedback{}
+	if err := xml.Unmarshal(data, feedback); err != nil {
+		return nil, err
+	}
+	return feedback, nil
+}
+
+// ParseReportMessage finds and parses the aggregate report attached to a raw message.
+func ParseReportMessage(raw []byte) (*Feedback, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	return parseReportPart(msg.Header, msg.Body)
+}
+
+type partHeader interface {
+	Get(key string) string
+}
+
+func parseReportPart(h partHeader, body io.Reader) (*Feedback, error) {
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil, errNoReport
+			}
+			if err != nil {
+				return nil, err
+			}
+			if feedback, err := parseReportPart(part.Header, part); err == nil {
+				return feedback, nil
+			}
+		}
+	}
+
+	if !isReportPart(mediaType, h) {
+		return nil, errNoReport
+	}
+	if strings.EqualFold(h.Get("Content-Transfer-Encoding"), "base64") {
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	return ParseReport(body)
+}
+
+func isReportPart(mediaType string, h partHeader) bool {
+	switch mediaType {
+	case "application/gzip", "application/x-gzip", "application/zip", "application/x-zip-compressed",
+		"text/xml", "application/xml":
+		return true
+	}
+	_, params, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	name := params["filename"]
+	return strings.HasSuffix(name, ".xml.gz") || strings.HasSuffix(name, ".zip") || strings.HasSuffix(name, ".xml")
+}
@@ -0,0 +1,81 @@
+package dmarc
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/dkim"
+	"github.com/dtynn/dmail/dns"
+	"github.com/dtynn/dmail/message"
+)
+
+type fakeMessageSender struct {
+	from string
+	to   []string
+	msg  *message.Message
+}
+
+func (this *fakeMessageSender) SendMessage(from string, to []string, msg *message.Message) error {
+	this.from, this.to, this.msg = from, to, msg
+	return nil
+}
+
+func TestAggregateReport(t *testing.T) {
+	record, _ := ParseRecord("v=DMARC1; p=reject; rua=mailto:dmarc@example.com,mailto:reports@thirdparty.net,mailto:x@unauthorized.org")
+	pass := &Result{Status: StatusPass, Domain: "example.com", PolicyDomain: "example.com", Record: record,
+		DkimAligned: true, Policy: PolicyReject, Disposition: PolicyNone}
+	fail := &Result{Status: StatusFail, Domain: "example.com", PolicyDomain: "example.com", Record: record,
+		Policy: PolicyReject, Disposition: PolicyReject}
+	spf := &dns.SpfCheck{Result: dns.SpfPass, Domain: "example.com", Identity: dns.SpfIdentityMailFrom}
+	dkims := []*dkim.Result{{Status: dkim.StatusPass, Domain: "example.com", Selector: "s1"}}
+
+	agg := NewAggregator("dtynn.me", "dmarc-noreply@dtynn.me", fakeResolver{
+		"example.com._report._dmarc.thirdparty.net": {"v=DMARC1"},
+	})
+	day := time.Date(2014, 11, 25, 10, 0, 0, 0, time.UTC)
+	ip := net.ParseIP("192.0.2.1")
+	agg.Add(day, pass, ip, "a@example.com", spf, dkims)
+	agg.Add(day.Add(time.Hour), pass, ip, "b@example.com", spf, dkims)
+	agg.Add(day, fail, net.ParseIP("198.51.100.1"), "a@other.com", nil, nil)
+	agg.Add(day, &Result{Status: StatusNone, Domain: "none.com"}, ip, "a@none.com", nil, nil)
+
+	if reports := agg.Flush(day.Add(time.Hour)); len(reports) != 0 {
+		t.Fatalf("expect no finished report, get %d", len(reports))
+	}
+
+	s := &fakeMessageSender{}
+	if err := agg.SendReports(s, day.Add(24*time.Hour)); err != nil {
+		t.Fatal("send reports: ", err)
+	}
+	if s.msg == nil {
+		t.Fatal("no report sent")
+	}
+	if strings.Join(s.to, ",") != "dmarc@example.com,reports@thirdparty.net" {
+		t.Errorf("unexpected destinations %v", s.to)
+	}
+
+	feedback, err := ParseReportMessage(s.msg.Bytes())
+	if err != nil {
+		t.Fatal("parse report message: ", err)
+	}
+	if feedback.PolicyPublished.Domain != "example.com" || feedback.PolicyPublished.P != PolicyReject {
+		t.Errorf("unexpected policy %+v", feedback.PolicyPublished)
+	}
+	if dr := feedback.ReportMetadata.DateRange; dr.Begin != 1416873600 || dr.End != 1416959999 {
+		t.Errorf("unexpected date range %+v", dr)
+	}
+	if len(feedback.Records) != 2 || feedback.Records[0].Row.Count != 2 {
+		t.Fatalf("unexpected records %+v", feedback.Records)
+	}
+	failures := feedback.Failures()
+	if len(failures) != 1 || failures[0].Row.SourceIP != "198.51.100.1" ||
+		failures[0].Row.PolicyEvaluated.Disposition != PolicyReject {
+		t.Errorf("unexpected failures %+v", failures)
+	}
+
+	if reports := agg.Flush(day.Add(48 * time.Hour)); len(reports) != 0 {
+		t.Errorf("expect reports to be flushed once, get %d", len(reports))
+	}
+}
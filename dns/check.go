@@ -3,9 +3,13 @@ package dns
 import (
 	"fmt"
 	"net"
+	"strings"
 )
 
-var domainKeyPrefix = "dkim._domainkey."
+var (
+	defaultDkimSelector = "dkim"
+	domainKeySuffix     = "._domainkey."
+)
 
 type checkResult struct {
 	Checked bool
@@ -23,11 +27,18 @@ func newChecks() *checks {
 
 type Checker struct {
 	name, key, spf, dkim, mxHost string
+	dkimSelector                 string
 	checks                       *checks
 }
 
 func NewChecker(name, key, spf, dkim, mxHost string) *Checker {
-	return &Checker{name, key, spf, dkim, mxHost, newChecks()}
+	return &Checker{name, key, spf, dkim, mxHost, defaultDkimSelector, newChecks()}
+}
+
+// SetDkimSelector sets the selector of the dkim record, "dkim" by default.
+// The expected record is the one printed by dkim.GenerateKey.
+func (this *Checker) SetDkimSelector(selector string) {
+	this.dkimSelector = selector
 }
 
 func (this *Checker) CheckAll() *checks {
@@ -62,14 +73,15 @@ func (this *Checker) checkTxt() {
 }
 
 func (this *Checker) checkDkim() {
-	name := domainKeyPrefix + this.name
+	name := this.dkimSelector + domainKeySuffix + this.name
 	txts, err := net.LookupTXT(name)
 	if err != nil {
 		this.checks.DkimChecked.Detail = err.Error()
 		return
 	}
 	for _, txt := range txts {
-		if txt == this.dkim {
+		// the strings of a record are joined by the resolver
+		if strings.Join(strings.Fields(txt), " ") == strings.Join(strings.Fields(this.dkim), " ") {
 			this.checks.DkimChecked.Checked = true
 			break
 		}
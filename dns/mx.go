@@ -2,44 +2,76 @@ package dns
 
 import (
 	"fmt"
+	"math/rand"
 	"net"
+	"sort"
+	"strings"
 )
 
-var errMxNotFound = fmt.Errorf("mx records not found")
+var (
+	errMxNotFound = fmt.Errorf("mx records not found")
+	// ErrNullMx is returned for domains declaring that they accept no mail, RFC 7505.
+	ErrNullMx = fmt.Errorf("domain does not accept mail (null mx)")
+)
 
+// ChoseMx returns the first candidate of MxHosts.
 func ChoseMx(name string) (*net.MX, error) {
-	mxs, err := net.LookupMX(name)
+	mxs, err := lookupMx(DefaultResolver, name)
 	if err != nil {
 		return nil, err
 	}
+	return mxs[0], nil
+}
 
-	size := len(mxs)
-	if size == 0 {
-		return nil, errMxNotFound
-	}
-
-	first := mxs[0]
+// MxHosts returns the hosts to deliver the mail of a domain to, see LookupMxHosts.
+func MxHosts(name string) ([]string, error) {
+	return LookupMxHosts(DefaultResolver, name)
+}
 
-	if size == 1 {
-		return first, nil
+// LookupMxHosts returns the hosts to try in order as described in RFC 5321 section 5.1:
+// the MX hosts by preference, shuffled within a preference, or the domain itself
+// if it has no MX but an address record. A null MX returns ErrNullMx.
+func LookupMxHosts(r Resolver, name string) ([]string, error) {
+	mxs, err := lookupMx(r, name)
+	if err != nil {
+		return nil, err
+	}
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
 	}
+	return hosts, nil
+}
 
-	mxsMap := map[uint16][]*net.MX{}
-	minimum := first.Pref
-	mxsMap[minimum] = []*net.MX{first}
+func lookupMx(r Resolver, name string) ([]*net.MX, error) {
+	mxs, err := r.LookupMX(name)
+	if err != nil && !IsNotFound(err) {
+		return nil, err
+	}
 
-	for _, mx := range mxs[1:] {
-		if mx.Pref < minimum {
-			minimum = mx.Pref
+	if len(mxs) == 0 {
+		// implicit mx
+		if ips, ipErr := r.LookupIP(name); ipErr == nil && len(ips) != 0 {
+			return []*net.MX{{Host: name, Pref: 0}}, nil
+		}
+		if err == nil {
+			err = errMxNotFound
 		}
+		return nil, err
+	}
 
-		if slice, has := mxsMap[mx.Pref]; has {
-			mxsMap[mx.Pref] = append(slice, mx)
-		} else {
-			mxsMap[mx.Pref] = []*net.MX{mx}
+	for _, mx := range mxs {
+		if mx.Host == "." || mx.Host == "" {
+			return nil, ErrNullMx
 		}
 	}
 
-	// todo: random choise or ping test
-	return mxsMap[minimum][0], nil
+	shuffled := make([]*net.MX, len(mxs))
+	for i, j := range rand.Perm(len(mxs)) {
+		shuffled[i] = mxs[j]
+	}
+	sort.SliceStable(shuffled, func(i, j int) bool {
+		return shuffled[i].Pref < shuffled[j].Pref
+	})
+	return shuffled, nil
 }
@@ -0,0 +1,48 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestLookupMxHosts(t *testing.T) {
+	r := &fakeResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "backup.example.com.", Pref: 20},
+				{Host: "mx1.example.com.", Pref: 10},
+				{Host: "mx2.example.com.", Pref: 10},
+			},
+			"null.example.com": {{Host: ".", Pref: 0}},
+		},
+		ip: map[string][]net.IP{
+			"implicit.example.com": {net.ParseIP("192.0.2.1")},
+		},
+	}
+
+	seen := map[string]bool{}
+	for i := 0; i < 50; i++ {
+		hosts, err := LookupMxHosts(r, "example.com")
+		if err != nil {
+			t.Fatal("lookup: ", err)
+		}
+		if len(hosts) != 3 || hosts[2] != "backup.example.com" {
+			t.Fatalf("unexpected order %v", hosts)
+		}
+		seen[strings.Join(hosts[:2], ",")] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("expect the preference 10 hosts shuffled, get %v", seen)
+	}
+
+	if hosts, err := LookupMxHosts(r, "implicit.example.com"); err != nil || len(hosts) != 1 || hosts[0] != "implicit.example.com" {
+		t.Errorf("expect implicit mx, get %v %v", hosts, err)
+	}
+	if _, err := LookupMxHosts(r, "null.example.com"); err != ErrNullMx {
+		t.Errorf("expect null mx, get %v", err)
+	}
+	if _, err := LookupMxHosts(r, "missing.example.com"); !IsNotFound(err) {
+		t.Errorf("expect not found, get %v", err)
+	}
+}
@@ -0,0 +1,51 @@
+package dns
+
+import (
+	"net"
+)
+
+// Resolver is the set of lookups used by the dns checks.
+// It can be replaced in order to use a custom dns server or a fake in tests.
+type Resolver interface {
+	LookupTXT(name string) ([]string, error)
+	LookupMX(name string) ([]*net.MX, error)
+	LookupIP(host string) ([]net.IP, error)
+	LookupAddr(addr string) ([]string, error)
+}
+
+type netResolver struct{}
+
+func (this netResolver) LookupTXT(name string) ([]string, error) {
+	return net.LookupTXT(name)
+}
+
+func (this netResolver) LookupMX(name string) ([]*net.MX, error) {
+	return net.LookupMX(name)
+}
+
+func (this netResolver) LookupIP(host string) ([]net.IP, error) {
+	return net.LookupIP(host)
+}
+
+func (this netResolver) LookupAddr(addr string) ([]string, error) {
+	return net.LookupAddr(addr)
+}
+
+var DefaultResolver Resolver = netResolver{}
+
+// IsNotFound reports whether err means the name does not exist
+// or has no records of the requested type.
+func IsNotFound(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.IsNotFound
+	}
+	return false
+}
+
+// IsTemporary reports whether err is a transient lookup failure.
+func IsTemporary(err error) bool {
+	if dnsErr, ok := err.(*net.DNSError); ok {
+		return dnsErr.Temporary() || dnsErr.IsTimeout
+	}
+	return false
+}
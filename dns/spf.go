@@ -0,0 +1,710 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SPF evaluation as described in RFC 7208
+
+type SpfResult string
+
+const (
+	SpfNone      SpfResult = "none"
+	SpfNeutral   SpfResult = "neutral"
+	SpfPass      SpfResult = "pass"
+	SpfFail      SpfResult = "fail"
+	SpfSoftFail  SpfResult = "softfail"
+	SpfTempError SpfResult = "temperror"
+	SpfPermError SpfResult = "permerror"
+)
+
+const (
+	SpfIdentityMailFrom = "mailfrom"
+	SpfIdentityHelo     = "helo"
+)
+
+const (
+	spfVersion         = "v=spf1"
+	spfLookupLimit     = 10
+	spfVoidLookupLimit = 2
+	spfMxLimit         = 10
+	spfPtrLimit        = 10
+	maxDomainLength    = 253
+	maxLabelLength     = 63
+)
+
+var (
+	errSpfMultipleRecords = fmt.Errorf("multiple spf records found")
+	errSpfLookupLimit     = fmt.Errorf("dns lookup limit exceeded")
+	errSpfVoidLimit       = fmt.Errorf("void lookup limit exceeded")
+	errSpfMxLimit         = fmt.Errorf("too many mx records")
+	errSpfRedirectNone    = fmt.Errorf("redirect domain has no spf record")
+	errSpfIncludeNone     = fmt.Errorf("included domain has no spf record")
+)
+
+type spfError struct {
+	result SpfResult
+	err    error
+}
+
+func (this *spfError) Error() string {
+	return this.err.Error()
+}
+
+func spfTempError(err error) *spfError {
+	return &spfError{SpfTempError, err}
+}
+
+func spfPermError(err error) *spfError {
+	return &spfError{SpfPermError, err}
+}
+
+// SpfCheck is the outcome of one check_host() evaluation.
+type SpfCheck struct {
+	Result      SpfResult
+	Identity    string
+	IP          net.IP
+	Domain      string
+	Sender      string
+	Helo        string
+	Mechanism   string
+	Explanation string
+	Reason      string
+}
+
+func (this *SpfCheck) comment() string {
+	subject := "domain of " + this.Sender
+	switch this.Result {
+	case SpfPass:
+		return fmt.Sprintf("%s designates %s as permitted sender", subject, this.IP)
+	case SpfFail:
+		return fmt.Sprintf("%s does not designate %s as permitted sender", subject, this.IP)
+	case SpfSoftFail:
+		return fmt.Sprintf("transitioning %s does not designate %s as permitted sender", subject, this.IP)
+	case SpfNeutral:
+		return fmt.Sprintf("%s is neither permitted nor denied by %s", this.IP, subject)
+	case SpfNone:
+		return fmt.Sprintf("%s does not designate permitted sender hosts", subject)
+	}
+	return fmt.Sprintf("error in processing during lookup of %s: %s", this.Sender, this.Reason)
+}
+
+// ReceivedSpf returns the value of a Received-SPF header for this check.
+func (this *SpfCheck) ReceivedSpf(receiver string) string {
+	return fmt.Sprintf("%s (%s: %s) receiver=%s; client-ip=%s; envelope-from=\"%s\"; helo=%s; identity=%s;",
+		this.Result, receiver, this.comment(), receiver, this.IP, this.Sender, this.Helo, this.Identity)
+}
+
+type SpfChecker struct {
+	resolver Resolver
+	hostname string
+}
+
+func NewSpfChecker(r Resolver, hostname string) *SpfChecker {
+	if r == nil {
+		r = DefaultResolver
+	}
+	return &SpfChecker{r, hostname}
+}
+
+// CheckMailFrom checks the MAIL FROM identity.
+// The HELO identity is checked instead for the null reverse-path.
+func (this *SpfChecker) CheckMailFrom(ip net.IP, from, helo string) *SpfCheck {
+	if from == "" {
+		return this.CheckHelo(ip, helo)
+	}
+	domain := from
+	if i := strings.LastIndex(from, "@"); i != -1 {
+		domain = from[i+1:]
+	}
+	check := this.CheckHost(ip, domain, from, helo)
+	check.Identity = SpfIdentityMailFrom
+	return check
+}
+
+// CheckHelo checks the HELO identity.
+func (this *SpfChecker) CheckHelo(ip net.IP, helo string) *SpfCheck {
+	check := this.CheckHost(ip, helo, "postmaster@"+helo, helo)
+	check.Identity = SpfIdentityHelo
+	return check
+}
+
+// CheckHost is the check_host() function of RFC 7208.
+func (this *SpfChecker) CheckHost(ip net.IP, domain, sender, helo string) *SpfCheck {
+	if i := strings.LastIndex(sender, "@"); i == -1 {
+		sender = "postmaster@" + sender
+	} else if i == 0 {
+		sender = "postmaster" + sender
+	}
+
+	check := &SpfCheck{
+		IP:     ip,
+		Domain: domain,
+		Sender: sender,
+		Helo:   helo,
+	}
+
+	e := &spfEval{
+		checker: this,
+		ip:      ip,
+		sender:  sender,
+		helo:    helo,
+	}
+
+	result, mechanism, err := e.checkHost(domain)
+	check.Result = result
+	check.Mechanism = mechanism
+	check.Explanation = e.explanation
+	if err != nil {
+		check.Reason = err.Error()
+	}
+	return check
+}
+
+type spfTerm struct {
+	qualifier byte
+	name      string
+	domain    string
+	network   *net.IPNet
+	cidr4     int
+	cidr6     int
+}
+
+func (this *spfTerm) String() string {
+	return string(this.qualifier) + this.name
+}
+
+type spfRecord struct {
+	terms    []*spfTerm
+	redirect string
+	exp      string
+}
+
+type spfEval struct {
+	checker     *SpfChecker
+	ip          net.IP
+	sender      string
+	helo        string
+	lookups     int
+	voids       int
+	explanation string
+}
+
+func (this *spfEval) checkHost(domain string) (SpfResult, string, *spfError) {
+	domain = strings.TrimSuffix(domain, ".")
+	if !isValidDomain(domain) {
+		return SpfNone, "", nil
+	}
+
+	txt, err := this.fetchRecord(domain)
+	if err != nil {
+		return err.result, "", err
+	}
+	if txt == "" {
+		return SpfNone, "", nil
+	}
+
+	record, err := parseSpfRecord(txt)
+	if err != nil {
+		return err.result, "", err
+	}
+
+	for _, term := range record.terms {
+		match, err := this.match(term, domain)
+		if err != nil {
+			return err.result, term.String(), err
+		}
+		if match {
+			result := qualifierResult(term.qualifier)
+			if result == SpfFail && record.exp != "" {
+				this.explain(record.exp, domain)
+			}
+			return result, term.String(), nil
+		}
+	}
+
+	if record.redirect != "" {
+		if err := this.countLookup(); err != nil {
+			return err.result, "redirect", err
+		}
+		target, err := this.expandDomain(record.redirect, domain)
+		if err != nil {
+			return err.result, "redirect", err
+		}
+		result, mechanism, rerr := this.checkHost(target)
+		if result == SpfNone {
+			return SpfPermError, "redirect", spfPermError(errSpfRedirectNone)
+		}
+		return result, mechanism, rerr
+	}
+
+	return SpfNeutral, "", nil
+}
+
+func (this *spfEval) fetchRecord(domain string) (string, *spfError) {
+	txts, err := this.checker.resolver.LookupTXT(domain)
+	if err != nil {
+		if IsNotFound(err) {
+			return "", nil
+		}
+		return "", spfTempError(err)
+	}
+
+	records := []string{}
+	for _, txt := range txts {
+		lower := strings.ToLower(txt)
+		if lower == spfVersion || strings.HasPrefix(lower, spfVersion+" ") {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return "", nil
+	case 1:
+		return records[0], nil
+	}
+	return "", spfPermError(errSpfMultipleRecords)
+}
+
+func parseSpfRecord(txt string) (*spfRecord, *spfError) {
+	record := &spfRecord{terms: []*spfTerm{}}
+	seen := map[string]bool{}
+
+	for _, field := range strings.Fields(txt[len(spfVersion):]) {
+		if name, value, ok := splitModifier(field); ok {
+			name = strings.ToLower(name)
+			if name == "redirect" || name == "exp" {
+				if seen[name] {
+					return nil, spfPermError(fmt.Errorf("duplicate modifier %q", name))
+				}
+				seen[name] = true
+			}
+			if err := validateMacro(value); err != nil {
+				return nil, spfPermError(err)
+			}
+			switch name {
+			case "redirect":
+				record.redirect = value
+			case "exp":
+				record.exp = value
+			}
+			continue
+		}
+
+		term, err := parseSpfTerm(field)
+		if err != nil {
+			return nil, spfPermError(err)
+		}
+		record.terms = append(record.terms, term)
+	}
+
+	// redirect is ignored when the record contains an "all" mechanism
+	for _, term := range record.terms {
+		if term.name == "all" {
+			record.redirect = ""
+			break
+		}
+	}
+	return record, nil
+}
+
+func splitModifier(field string) (string, string, bool) {
+	i := strings.Index(field, "=")
+	if i <= 0 {
+		return "", "", false
+	}
+	name := field[:i]
+	for j, r := range name {
+		isAlpha := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z')
+		if j == 0 && !isAlpha {
+			return "", "", false
+		}
+		if !isAlpha && !(r >= '0' && r <= '9') && r != '-' && r != '_' && r != '.' {
+			return "", "", false
+		}
+	}
+	return name, field[i+1:], true
+}
+
+func parseSpfTerm(field string) (*spfTerm, error) {
+	term := &spfTerm{qualifier: '+', cidr4: -1, cidr6: -1}
+	switch field[0] {
+	case '+', '-', '~', '?':
+		term.qualifier = field[0]
+		field = field[1:]
+	}
+
+	name, arg := field, ""
+	if i := strings.IndexAny(field, ":/"); i != -1 {
+		name, arg = field[:i], field[i:]
+	}
+	term.name = strings.ToLower(name)
+
+	var err error
+	switch term.name {
+	case "all":
+		if arg != "" {
+			return nil, fmt.Errorf("invalid term %q", field)
+		}
+	case "include", "exists":
+		if !strings.HasPrefix(arg, ":") || len(arg) == 1 {
+			return nil, fmt.Errorf("%s requires a domain", term.name)
+		}
+		term.domain = arg[1:]
+		err = validateMacro(term.domain)
+	case "a", "mx":
+		arg, err = term.parseDualCidr(arg)
+		if err != nil {
+			break
+		}
+		if arg != "" {
+			if !strings.HasPrefix(arg, ":") || len(arg) == 1 {
+				return nil, fmt.Errorf("invalid term %q", field)
+			}
+			term.domain = arg[1:]
+			err = validateMacro(term.domain)
+		}
+	case "ptr":
+		if arg != "" {
+			if !strings.HasPrefix(arg, ":") || len(arg) == 1 {
+				return nil, fmt.Errorf("invalid term %q", field)
+			}
+			term.domain = arg[1:]
+			err = validateMacro(term.domain)
+		}
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return nil, fmt.Errorf("%s requires a network", term.name)
+		}
+		term.network, err = parseSpfNetwork(term.name, arg[1:])
+	default:
+		return nil, fmt.Errorf("unknown mechanism %q", name)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return term, nil
+}
+
+func (this *spfTerm) parseDualCidr(arg string) (string, error) {
+	if i := strings.LastIndex(arg, "//"); i != -1 {
+		bits, err := parseCidr(arg[i+2:], 128)
+		if err != nil {
+			return "", err
+		}
+		this.cidr6 = bits
+		arg = arg[:i]
+	}
+	if i := strings.LastIndex(arg, "/"); i != -1 {
+		bits, err := parseCidr(arg[i+1:], 32)
+		if err != nil {
+			return "", err
+		}
+		this.cidr4 = bits
+		arg = arg[:i]
+	}
+	return arg, nil
+}
+
+func parseCidr(s string, max int) (int, error) {
+	if s == "" || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid cidr length %q", s)
+	}
+	bits, err := strconv.Atoi(s)
+	if err != nil || bits < 0 || bits > max {
+		return 0, fmt.Errorf("invalid cidr length %q", s)
+	}
+	return bits, nil
+}
+
+func parseSpfNetwork(name, s string) (*net.IPNet, error) {
+	max := 32
+	if name == "ip6" {
+		max = 128
+	}
+	bits := max
+	if i := strings.Index(s, "/"); i != -1 {
+		var err error
+		if bits, err = parseCidr(s[i+1:], max); err != nil {
+			return nil, err
+		}
+		s = s[:i]
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid %s address %q", name, s)
+	}
+	isV4 := ip.To4() != nil && !strings.Contains(s, ":")
+	if (name == "ip4") != isV4 {
+		return nil, fmt.Errorf("invalid %s address %q", name, s)
+	}
+	if isV4 {
+		ip = ip.To4()
+	}
+	mask := net.CIDRMask(bits, max)
+	return &net.IPNet{IP: ip.Mask(mask), Mask: mask}, nil
+}
+
+func qualifierResult(q byte) SpfResult {
+	switch q {
+	case '-':
+		return SpfFail
+	case '~':
+		return SpfSoftFail
+	case '?':
+		return SpfNeutral
+	}
+	return SpfPass
+}
+
+func (this *spfEval) countLookup() *spfError {
+	this.lookups += 1
+	if this.lookups > spfLookupLimit {
+		return spfPermError(errSpfLookupLimit)
+	}
+	return nil
+}
+
+func (this *spfEval) countVoid() *spfError {
+	this.voids += 1
+	if this.voids > spfVoidLookupLimit {
+		return spfPermError(errSpfVoidLimit)
+	}
+	return nil
+}
+
+func (this *spfEval) targetDomain(term *spfTerm, domain string) (string, *spfError) {
+	if term.domain == "" {
+		return domain, nil
+	}
+	return this.expandDomain(term.domain, domain)
+}
+
+func (this *spfEval) match(term *spfTerm, domain string) (bool, *spfError) {
+	switch term.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return term.network.Contains(this.ip), nil
+	}
+
+	if err := this.countLookup(); err != nil {
+		return false, err
+	}
+	target, err := this.targetDomain(term, domain)
+	if err != nil {
+		return false, err
+	}
+
+	switch term.name {
+	case "include":
+		result, _, ierr := this.checkHost(target)
+		switch result {
+		case SpfPass:
+			return true, nil
+		case SpfFail, SpfSoftFail, SpfNeutral:
+			return false, nil
+		case SpfNone:
+			return false, spfPermError(errSpfIncludeNone)
+		}
+		return false, ierr
+	case "a":
+		return this.matchHost(target, term)
+	case "mx":
+		return this.matchMx(target, term)
+	case "ptr":
+		return this.matchPtr(target)
+	case "exists":
+		ips, err := this.lookupIP(target)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, this.countVoid()
+	}
+	return false, nil
+}
+
+func (this *spfEval) lookupIP(host string) ([]net.IP, *spfError) {
+	ips, err := this.checker.resolver.LookupIP(host)
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, spfTempError(err)
+	}
+	return ips, nil
+}
+
+func (this *spfEval) ipMatch(ips []net.IP, term *spfTerm) bool {
+	isV4 := this.ip.To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) != isV4 {
+			continue
+		}
+		var mask net.IPMask
+		if isV4 {
+			if term.cidr4 == -1 {
+				mask = net.CIDRMask(32, 32)
+			} else {
+				mask = net.CIDRMask(term.cidr4, 32)
+			}
+			ip = ip.To4()
+		} else {
+			if term.cidr6 == -1 {
+				mask = net.CIDRMask(128, 128)
+			} else {
+				mask = net.CIDRMask(term.cidr6, 128)
+			}
+		}
+		network := net.IPNet{IP: ip.Mask(mask), Mask: mask}
+		if network.Contains(this.ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *spfEval) matchHost(host string, term *spfTerm) (bool, *spfError) {
+	ips, err := this.lookupIP(host)
+	if err != nil {
+		return false, err
+	}
+	if len(ips) == 0 {
+		return false, this.countVoid()
+	}
+	return this.ipMatch(ips, term), nil
+}
+
+func (this *spfEval) matchMx(domain string, term *spfTerm) (bool, *spfError) {
+	mxs, err := this.checker.resolver.LookupMX(domain)
+	if err != nil && !IsNotFound(err) {
+		return false, spfTempError(err)
+	}
+	if len(mxs) == 0 {
+		return false, this.countVoid()
+	}
+	if len(mxs) > spfMxLimit {
+		return false, spfPermError(errSpfMxLimit)
+	}
+
+	for _, mx := range mxs {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			continue
+		}
+		ips, err := this.lookupIP(host)
+		if err != nil {
+			return false, err
+		}
+		if this.ipMatch(ips, term) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// validatedNames returns the names pointing back to the client ip.
+func (this *spfEval) validatedNames() ([]string, *spfError) {
+	names, err := this.checker.resolver.LookupAddr(this.ip.String())
+	if err != nil {
+		if IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, spfTempError(err)
+	}
+	if len(names) > spfPtrLimit {
+		names = names[:spfPtrLimit]
+	}
+
+	validated := []string{}
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		ips, err := this.checker.resolver.LookupIP(name)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips {
+			if ip.Equal(this.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated, nil
+}
+
+func (this *spfEval) matchPtr(target string) (bool, *spfError) {
+	names, err := this.validatedNames()
+	if err != nil {
+		return false, err
+	}
+	if len(names) == 0 {
+		return false, this.countVoid()
+	}
+	target = strings.ToLower(target)
+	for _, name := range names {
+		name = strings.ToLower(name)
+		if name == target || strings.HasSuffix(name, "."+target) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (this *spfEval) expandDomain(spec, domain string) (string, *spfError) {
+	expanded, err := this.expand(spec, domain, false)
+	if err != nil {
+		return "", spfPermError(err)
+	}
+	expanded = strings.TrimSuffix(expanded, ".")
+	// truncate from the left until the name fits
+	for len(expanded) > maxDomainLength {
+		i := strings.Index(expanded, ".")
+		if i == -1 {
+			break
+		}
+		expanded = expanded[i+1:]
+	}
+	return expanded, nil
+}
+
+func (this *spfEval) explain(spec, domain string) {
+	target, serr := this.expandDomain(spec, domain)
+	if serr != nil || !isValidDomain(target) {
+		return
+	}
+	txts, err := this.checker.resolver.LookupTXT(target)
+	if err != nil || len(txts) != 1 {
+		return
+	}
+	if exp, err := this.expand(txts[0], domain, true); err == nil {
+		this.explanation = exp
+	}
+}
+
+func isValidDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > maxDomainLength {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > maxLabelLength {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,248 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const spfDefaultDelimiter = "."
+
+var errSpfMacro = fmt.Errorf("invalid macro")
+
+type spfMacro struct {
+	letter     byte
+	digits     int
+	reverse    bool
+	delimiters string
+}
+
+// nextMacro parses the macro starting at s[i] == '%'
+// and returns it with the index following it.
+func nextMacro(s string, i int) (*spfMacro, string, int, error) {
+	if i+1 >= len(s) {
+		return nil, "", 0, errSpfMacro
+	}
+
+	switch s[i+1] {
+	case '%':
+		return nil, "%", i + 2, nil
+	case '_':
+		return nil, " ", i + 2, nil
+	case '-':
+		return nil, "%20", i + 2, nil
+	case '{':
+	default:
+		return nil, "", 0, errSpfMacro
+	}
+
+	end := strings.IndexByte(s[i:], '}')
+	if end == -1 {
+		return nil, "", 0, errSpfMacro
+	}
+	body := s[i+2 : i+end]
+	if len(body) == 0 {
+		return nil, "", 0, errSpfMacro
+	}
+
+	m := &spfMacro{letter: body[0]}
+	if !strings.ContainsRune("slodiphcrtvSLODIPHCRTV", rune(m.letter)) {
+		return nil, "", 0, errSpfMacro
+	}
+
+	rest := body[1:]
+	j := 0
+	for j < len(rest) && rest[j] >= '0' && rest[j] <= '9' {
+		j++
+	}
+	if j > 0 {
+		digits, err := strconv.Atoi(rest[:j])
+		if err != nil || digits == 0 {
+			return nil, "", 0, errSpfMacro
+		}
+		m.digits = digits
+	}
+	rest = rest[j:]
+	if strings.HasPrefix(rest, "r") || strings.HasPrefix(rest, "R") {
+		m.reverse = true
+		rest = rest[1:]
+	}
+	for _, r := range rest {
+		if !strings.ContainsRune(".-+,/_=", r) {
+			return nil, "", 0, errSpfMacro
+		}
+	}
+	m.delimiters = rest
+	return m, "", i + end + 1, nil
+}
+
+func validateMacro(s string) error {
+	for i := 0; i < len(s); {
+		if s[i] != '%' {
+			i++
+			continue
+		}
+		_, _, next, err := nextMacro(s, i)
+		if err != nil {
+			return err
+		}
+		i = next
+	}
+	return nil
+}
+
+// expand expands the macro-string s in the context of the current domain.
+// The c, r and t letters are only allowed in explanation strings.
+func (this *spfEval) expand(s, domain string, exp bool) (string, error) {
+	buf := []byte{}
+	for i := 0; i < len(s); {
+		if s[i] != '%' {
+			buf = append(buf, s[i])
+			i++
+			continue
+		}
+
+		m, literal, next, err := nextMacro(s, i)
+		if err != nil {
+			return "", err
+		}
+		i = next
+		if m == nil {
+			buf = append(buf, literal...)
+			continue
+		}
+
+		value, err := this.macroValue(m, domain, exp)
+		if err != nil {
+			return "", err
+		}
+		buf = append(buf, m.transform(value)...)
+	}
+	return string(buf), nil
+}
+
+func (this *spfEval) macroValue(m *spfMacro, domain string, exp bool) (string, error) {
+	local, senderDomain := this.sender, this.sender
+	if i := strings.LastIndex(this.sender, "@"); i != -1 {
+		local, senderDomain = this.sender[:i], this.sender[i+1:]
+	}
+
+	var value string
+	switch m.letter | 0x20 {
+	case 's':
+		value = this.sender
+	case 'l':
+		value = local
+	case 'o':
+		value = senderDomain
+	case 'd':
+		value = domain
+	case 'i':
+		value = dottedIP(this.ip)
+	case 'p':
+		value = this.validatedName(domain)
+	case 'v':
+		value = "in-addr"
+		if this.ip.To4() == nil {
+			value = "ip6"
+		}
+	case 'h':
+		value = this.helo
+	case 'c', 'r', 't':
+		if !exp {
+			return "", errSpfMacro
+		}
+		switch m.letter | 0x20 {
+		case 'c':
+			value = this.ip.String()
+		case 'r':
+			value = this.checker.hostname
+			if value == "" {
+				value = "unknown"
+			}
+		case 't':
+			value = strconv.FormatInt(time.Now().Unix(), 10)
+		}
+	}
+
+	// uppercase letters are url escaped
+	if m.letter >= 'A' && m.letter <= 'Z' {
+		value = escapeMacro(value)
+	}
+	return value, nil
+}
+
+func (this *spfMacro) transform(value string) string {
+	if this.digits == 0 && !this.reverse && this.delimiters == "" {
+		return value
+	}
+
+	delimiters := this.delimiters
+	if delimiters == "" {
+		delimiters = spfDefaultDelimiter
+	}
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+
+	if this.reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if this.digits > 0 && this.digits < len(parts) {
+		parts = parts[len(parts)-this.digits:]
+	}
+	return strings.Join(parts, ".")
+}
+
+// validatedName returns the name used by the p macro.
+func (this *spfEval) validatedName(domain string) string {
+	names, err := this.validatedNames()
+	if err != nil || len(names) == 0 {
+		return "unknown"
+	}
+	domain = strings.ToLower(domain)
+	for _, name := range names {
+		if strings.ToLower(name) == domain {
+			return name
+		}
+	}
+	for _, name := range names {
+		if strings.HasSuffix(strings.ToLower(name), "."+domain) {
+			return name
+		}
+	}
+	return names[0]
+}
+
+// dottedIP formats ipv4 addresses normally
+// and ipv6 addresses as dot separated nibbles.
+func dottedIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatInt(int64(b>>4), 16), strconv.FormatInt(int64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
+
+// escapeMacro escapes everything but the unreserved characters of RFC 3986.
+func escapeMacro(s string) string {
+	buf := []byte{}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '.' || c == '_' || c == '~' {
+			buf = append(buf, c)
+			continue
+		}
+		buf = append(buf, fmt.Sprintf("%%%02X", c)...)
+	}
+	return string(buf)
+}
@@ -0,0 +1,189 @@
+package dns
+
+import (
+	"net"
+	"testing"
+)
+
+type fakeResolver struct {
+	txt  map[string][]string
+	mx   map[string][]*net.MX
+	ip   map[string][]net.IP
+	addr map[string][]string
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (this *fakeResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := this.txt[name]; ok {
+		return txts, nil
+	}
+	return nil, notFound(name)
+}
+
+func (this *fakeResolver) LookupMX(name string) ([]*net.MX, error) {
+	if mxs, ok := this.mx[name]; ok {
+		return mxs, nil
+	}
+	return nil, notFound(name)
+}
+
+func (this *fakeResolver) LookupIP(host string) ([]net.IP, error) {
+	if ips, ok := this.ip[host]; ok {
+		return ips, nil
+	}
+	return nil, notFound(host)
+}
+
+func (this *fakeResolver) LookupAddr(addr string) ([]string, error) {
+	if names, ok := this.addr[addr]; ok {
+		return names, nil
+	}
+	return nil, notFound(addr)
+}
+
+func newSpfTestResolver() *fakeResolver {
+	return &fakeResolver{
+		txt: map[string][]string{
+			"example.com":             {"v=spf1 mx a:mail.example.com ip4:192.0.2.0/24 include:_spf.example.net -all"},
+			"_spf.example.net":        {"v=spf1 ip6:2001:db8::/32 ~all"},
+			"redirect.example.com":    {"v=spf1 redirect=example.com"},
+			"soft.example.com":        {"v=spf1 a/24 ~all"},
+			"exists.example.com":      {"v=spf1 exists:%{ir}.%{l1r+-}._spf.%{d} -all"},
+			"multi.example.com":       {"v=spf1 -all", "v=spf1 +all"},
+			"bad.example.com":         {"v=spf1 foo:bar -all"},
+			"neutral.example.com":     {"v=spf1 ip4:198.51.100.1"},
+			"exp.example.com":         {"v=spf1 -all exp=explain.example.com"},
+			"explain.example.com":     {"%{i} is not one of %{d}'s designated mail servers."},
+			"loop.example.com":        {"v=spf1 include:loop.example.com -all"},
+			"void.example.com":        {"v=spf1 a:a.nx.example.com a:b.nx.example.com a:c.nx.example.com -all"},
+			"ptr.example.com":         {"v=spf1 ptr -all"},
+			"includenone.example.com": {"v=spf1 include:none.example.com -all"},
+		},
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: "mx.example.com.", Pref: 10}},
+		},
+		ip: map[string][]net.IP{
+			"mx.example.com":                       {net.ParseIP("203.0.113.10")},
+			"mail.example.com":                     {net.ParseIP("203.0.113.20")},
+			"soft.example.com":                     {net.ParseIP("203.0.113.30")},
+			"1.2.0.192.in._spf.exists.example.com": {net.ParseIP("127.0.0.2")},
+			"host.ptr.example.com":                 {net.ParseIP("203.0.113.40")},
+		},
+		addr: map[string][]string{
+			"203.0.113.40": {"host.ptr.example.com."},
+		},
+	}
+}
+
+func TestSpfCheckHost(t *testing.T) {
+	checker := NewSpfChecker(newSpfTestResolver(), "mx.dtynn.me")
+
+	cases := []struct {
+		ip     string
+		domain string
+		sender string
+		result SpfResult
+	}{
+		{"203.0.113.10", "example.com", "a@example.com", SpfPass},
+		{"203.0.113.20", "example.com", "a@example.com", SpfPass},
+		{"192.0.2.55", "example.com", "a@example.com", SpfPass},
+		{"2001:db8::1", "example.com", "a@example.com", SpfPass},
+		{"2001:db9::1", "example.com", "a@example.com", SpfFail},
+		{"198.51.100.7", "example.com", "a@example.com", SpfFail},
+		{"192.0.2.55", "redirect.example.com", "a@redirect.example.com", SpfPass},
+		{"198.51.100.7", "redirect.example.com", "a@redirect.example.com", SpfFail},
+		{"203.0.113.99", "soft.example.com", "a@soft.example.com", SpfPass},
+		{"198.51.100.7", "soft.example.com", "a@soft.example.com", SpfSoftFail},
+		{"192.0.2.1", "exists.example.com", "in-valid@exists.example.com", SpfPass},
+		{"192.0.2.2", "exists.example.com", "in-valid@exists.example.com", SpfFail},
+		{"192.0.2.1", "multi.example.com", "a@multi.example.com", SpfPermError},
+		{"192.0.2.1", "bad.example.com", "a@bad.example.com", SpfPermError},
+		{"192.0.2.1", "neutral.example.com", "a@neutral.example.com", SpfNeutral},
+		{"192.0.2.1", "none.example.com", "a@none.example.com", SpfNone},
+		{"192.0.2.1", "loop.example.com", "a@loop.example.com", SpfPermError},
+		{"192.0.2.1", "void.example.com", "a@void.example.com", SpfPermError},
+		{"203.0.113.40", "ptr.example.com", "a@ptr.example.com", SpfPass},
+		{"203.0.113.41", "ptr.example.com", "a@ptr.example.com", SpfFail},
+		{"192.0.2.1", "includenone.example.com", "a@includenone.example.com", SpfPermError},
+		{"192.0.2.1", "localhost", "a@localhost", SpfNone},
+	}
+
+	for _, c := range cases {
+		check := checker.CheckHost(net.ParseIP(c.ip), c.domain, c.sender, "helo.example.org")
+		if check.Result != c.result {
+			t.Errorf("%s from %s: expect %s, get %s (%s)", c.domain, c.ip, c.result, check.Result, check.Reason)
+		}
+	}
+}
+
+func TestSpfExplanation(t *testing.T) {
+	checker := NewSpfChecker(newSpfTestResolver(), "mx.dtynn.me")
+	check := checker.CheckMailFrom(net.ParseIP("192.0.2.1"), "a@exp.example.com", "helo.example.org")
+	if check.Result != SpfFail {
+		t.Fatalf("expect fail, get %s", check.Result)
+	}
+	expect := "192.0.2.1 is not one of exp.example.com's designated mail servers."
+	if check.Explanation != expect {
+		t.Errorf("expect explanation %q, get %q", expect, check.Explanation)
+	}
+}
+
+func TestSpfMacro(t *testing.T) {
+	e := &spfEval{
+		checker: NewSpfChecker(newSpfTestResolver(), "mx.dtynn.me"),
+		ip:      net.ParseIP("192.0.2.3"),
+		sender:  "strong-bad@email.example.com",
+		helo:    "helo.example.org",
+	}
+
+	// examples from RFC 7208 section 7.4
+	cases := map[string]string{
+		"%{s}":                              "strong-bad@email.example.com",
+		"%{o}":                              "email.example.com",
+		"%{d}":                              "email.example.com",
+		"%{d4}":                             "email.example.com",
+		"%{d3}":                             "email.example.com",
+		"%{d2}":                             "example.com",
+		"%{d1}":                             "com",
+		"%{dr}":                             "com.example.email",
+		"%{d2r}":                            "example.email",
+		"%{l}":                              "strong-bad",
+		"%{l-}":                             "strong.bad",
+		"%{lr}":                             "strong-bad",
+		"%{lr-}":                            "bad.strong",
+		"%{l1r-}":                           "strong",
+		"%{ir}.%{v}._spf.%{d2}":             "3.2.0.192.in-addr._spf.example.com",
+		"%{lr-}.lp._spf.%{d2}":              "bad.strong.lp._spf.example.com",
+		"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}":  "3.2.0.192.in-addr.strong.lp._spf.example.com",
+		"%{d2}.trusted-domains.example.net": "example.com.trusted-domains.example.net",
+		"%{S}":                              "strong-bad%40email.example.com",
+		"%%%_%-":                            "% %20",
+	}
+
+	for in, expect := range cases {
+		out, err := e.expand(in, "email.example.com", false)
+		if err != nil {
+			t.Errorf("expand %q: %s", in, err)
+			continue
+		}
+		if out != expect {
+			t.Errorf("expand %q: expect %q, get %q", in, expect, out)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	out, _ := e.expand("%{ir}.%{v}._spf.%{d2}", "email.example.com", false)
+	expect := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if out != expect {
+		t.Errorf("expand ipv6: expect %q, get %q", expect, out)
+	}
+
+	for _, bad := range []string{"%", "%{", "%{x}", "%{d0}", "%a", "%{c}"} {
+		if _, err := e.expand(bad, "email.example.com", false); err == nil {
+			t.Errorf("expand %q: expect error", bad)
+		}
+	}
+}
@@ -0,0 +1,521 @@
+package dmail
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/qiniu/log"
+)
+
+const (
+	spoolMessageDir  = "msg"
+	spoolEnvelopeDir = "env"
+	spoolTmpDir      = "tmp"
+	envelopeExt      = ".json"
+
+	spoolDirMode  os.FileMode = 0700
+	spoolFileMode os.FileMode = 0600
+
+	queuePollInterval = time.Second
+
+	rcptPending   = "pending"
+	rcptDelivered = "delivered"
+	rcptFailed    = "failed"
+)
+
+// QueueConfig configures the workers and the retry schedule of a Queue.
+// RFC 5321 section 4.5.4.1: the retry interval should be at least 30 minutes
+// and the give-up time at least 4-5 days.
+type QueueConfig struct {
+	Workers int
+	// deliveries running at the same time to one recipient domain
+	DomainConcurrency int
+	// delay after the nth failed attempt, the last one repeats
+	RetryIntervals []time.Duration
+	// messages still undelivered after Expire are bounced
+	Expire time.Duration
+	// the reporting host of bounces
+	Hostname string
+}
+
+func DefaultQueueConfig() *QueueConfig {
+	hostname, _ := os.Hostname()
+	return &QueueConfig{
+		Workers:           4,
+		DomainConcurrency: 2,
+		RetryIntervals:    []time.Duration{30 * time.Minute, time.Hour, 2 * time.Hour, 4 * time.Hour},
+		Expire:            5 * 24 * time.Hour,
+		Hostname:          hostname,
+	}
+}
+
+type queueRecipient struct {
+	Address  string    `json:"address"`
+	State    string    `json:"state"`
+	Attempts int       `json:"attempts"`
+	Code     int       `json:"code,omitempty"`
+	Status   string    `json:"status,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+	Ip       string    `json:"ip,omitempty"`
+	Tls      string    `json:"tls,omitempty"`
+	Updated  time.Time `json:"updated"`
+}
+
+// envelope is the state of a spooled message, stored next to it as json.
+type envelope struct {
+	Id          string            `json:"id"`
+	From        string            `json:"from"`
+	Recipients  []*queueRecipient `json:"recipients"`
+	Created     time.Time         `json:"created"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"nextAttempt"`
+}
+
+func (this *envelope) pending() []*queueRecipient {
+	rcpts := []*queueRecipient{}
+	for _, r := range this.Recipients {
+		if r.State == rcptPending {
+			rcpts = append(rcpts, r)
+		}
+	}
+	return rcpts
+}
+
+// Queue is an on-disk spool of outbound messages delivered by a pool of workers.
+// A message file and its json envelope are kept in dir until every recipient
+// is delivered or has failed, so queued mail survives restarts.
+type Queue struct {
+	dir     string
+	sender  *Sender
+	conf    *QueueConfig
+	now     func() time.Time
+	deliver func(ctx context.Context, from string, to []string, raw []byte) (map[string]error, map[string]*Delivery)
+
+	lock     sync.Mutex
+	entries  map[string]*envelope
+	busy     map[string]bool
+	domains  map[string]chan struct{}
+	ready    chan *envelope
+	wake     chan struct{}
+	stop     chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	running  bool
+	wg       sync.WaitGroup
+	sequence uint64
+}
+
+// NewQueue opens the spool in dir, creating it if missing, and loads the queued messages.
+// Call Start to begin delivering through the sender.
+func NewQueue(dir string, sender *Sender, conf *QueueConfig) (*Queue, error) {
+	if conf == nil {
+		conf = DefaultQueueConfig()
+	}
+	q := &Queue{
+		dir:     dir,
+		sender:  sender,
+		conf:    conf,
+		now:     time.Now,
+		deliver: sender.sendOnce,
+		entries: map[string]*envelope{},
+		busy:    map[string]bool{},
+		domains: map[string]chan struct{}{},
+		ready:   make(chan *envelope),
+		wake:    make(chan struct{}, 1),
+	}
+	for _, sub := range []string{spoolMessageDir, spoolEnvelopeDir, spoolTmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), spoolDirMode); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.load(); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// load reads the envelopes of the spool and removes messages without one,
+// which are leftovers of an interrupted Enqueue.
+func (this *Queue) load() error {
+	files, err := ioutil.ReadDir(filepath.Join(this.dir, spoolEnvelopeDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range files {
+		if !strings.HasSuffix(fi.Name(), envelopeExt) {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(this.dir, spoolEnvelopeDir, fi.Name()))
+		if err != nil {
+			return err
+		}
+		env := &envelope{}
+		if err := json.Unmarshal(b, env); err != nil || env.Id == "" {
+			log.Warn("queue: invalid envelope ", fi.Name(), err)
+			continue
+		}
+		if _, err := os.Stat(this.messagePath(env.Id)); err != nil {
+			log.Warn("queue: message missing for ", env.Id, err)
+			os.Remove(this.envelopePath(env.Id))
+			continue
+		}
+		this.entries[env.Id] = env
+	}
+
+	messages, err := ioutil.ReadDir(filepath.Join(this.dir, spoolMessageDir))
+	if err != nil {
+		return err
+	}
+	for _, fi := range messages {
+		if _, ok := this.entries[fi.Name()]; !ok {
+			os.Remove(filepath.Join(this.dir, spoolMessageDir, fi.Name()))
+		}
+	}
+	return nil
+}
+
+// Start runs the scheduler and the workers.
+func (this *Queue) Start() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.running {
+		return
+	}
+	this.running = true
+	this.stop = make(chan struct{})
+	this.ctx, this.cancel = context.WithCancel(context.Background())
+
+	workers := this.conf.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+	this.wg.Add(workers + 1)
+	go this.schedule()
+	for i := 0; i < workers; i++ {
+		go this.work()
+	}
+}
+
+// Stop aborts the running deliveries and stops the workers.
+// Messages stay in the spool for the next Start.
+func (this *Queue) Stop() {
+	this.lock.Lock()
+	if !this.running {
+		this.lock.Unlock()
+		return
+	}
+	this.running = false
+	close(this.stop)
+	this.cancel()
+	this.lock.Unlock()
+	this.wg.Wait()
+}
+
+// Len returns the number of queued messages.
+func (this *Queue) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.entries)
+}
+
+// Enqueue spools a message for delivery and returns its queue id.
+// The message is delivered as is, it should be signed already.
+func (this *Queue) Enqueue(from string, to []string, raw []byte) (string, error) {
+	now := this.now()
+	env := &envelope{
+		Id:          this.newId(now),
+		From:        from,
+		Created:     now,
+		NextAttempt: now,
+	}
+	for _, rcpt := range to {
+		env.Recipients = append(env.Recipients, &queueRecipient{Address: rcpt, State: rcptPending, Updated: now})
+	}
+
+	if err := this.writeFile(this.messagePath(env.Id), raw); err != nil {
+		return "", err
+	}
+	if err := this.save(env); err != nil {
+		os.Remove(this.messagePath(env.Id))
+		return "", err
+	}
+
+	this.lock.Lock()
+	this.entries[env.Id] = env
+	this.lock.Unlock()
+	this.notify()
+	return env.Id, nil
+}
+
+func (this *Queue) newId(now time.Time) string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	this.lock.Lock()
+	this.sequence++
+	seq := this.sequence
+	this.lock.Unlock()
+	return fmt.Sprintf("%x%x%s", now.UnixNano(), seq, hex.EncodeToString(b))
+}
+
+func (this *Queue) notify() {
+	select {
+	case this.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (this *Queue) schedule() {
+	defer this.wg.Done()
+	ticker := time.NewTicker(queuePollInterval)
+	defer ticker.Stop()
+	for {
+		envs := this.due()
+		for i, env := range envs {
+			select {
+			case this.ready <- env:
+			case <-this.stop:
+				this.release(envs[i:])
+				return
+			}
+		}
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		case <-this.wake:
+		}
+	}
+}
+
+// due marks the messages whose next attempt has come as busy and returns them, oldest first.
+func (this *Queue) due() []*envelope {
+	now := this.now()
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	envs := []*envelope{}
+	for id, env := range this.entries {
+		if !this.busy[id] && !env.NextAttempt.After(now) {
+			this.busy[id] = true
+			envs = append(envs, env)
+		}
+	}
+	sort.Slice(envs, func(i, j int) bool {
+		return envs[i].NextAttempt.Before(envs[j].NextAttempt)
+	})
+	return envs
+}
+
+func (this *Queue) release(envs []*envelope) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, env := range envs {
+		delete(this.busy, env.Id)
+	}
+}
+
+func (this *Queue) work() {
+	defer this.wg.Done()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case env := <-this.ready:
+			this.process(this.ctx, env)
+		}
+	}
+}
+
+// process makes one delivery attempt to the pending recipients of a message,
+// one transaction per domain, then removes, bounces or reschedules it.
+func (this *Queue) process(ctx context.Context, env *envelope) {
+	done := true
+	defer func() {
+		this.lock.Lock()
+		delete(this.busy, env.Id)
+		if done {
+			delete(this.entries, env.Id)
+		}
+		this.lock.Unlock()
+	}()
+
+	raw, err := ioutil.ReadFile(this.messagePath(env.Id))
+	if err != nil {
+		log.Error("queue: read message ", env.Id, err)
+		this.remove(env.Id)
+		return
+	}
+
+	failed := []*queueRecipient{}
+	aborted := false
+	for _, rcpts := range groupByDomain(env.pending()) {
+		to := make([]string, len(rcpts))
+		for i, rcpt := range rcpts {
+			to[i] = rcpt.Address
+		}
+		release := this.acquire(to[0])
+		errs, delivered := this.deliver(ctx, env.From, to, raw)
+		release()
+		// a delivery aborted by Stop is no attempt, it is made again after the next Start
+		aborted = ctx.Err() != nil
+
+		for _, rcpt := range rcpts {
+			err, ok := errs[rcpt.Address]
+			if ok && aborted {
+				continue
+			}
+			rcpt.Attempts++
+			rcpt.Updated = this.now()
+			if !ok {
+				rcpt.State = rcptDelivered
+				rcpt.Code, rcpt.Status, rcpt.Detail, rcpt.Ip, rcpt.Tls = 0, "", "", "", ""
+				if d := delivered[rcpt.Address]; d != nil {
+					rcpt.Ip, rcpt.Tls = d.Ip, d.Tls
+				}
+				continue
+			}
+			f := newFail(rcpt.Address, err, rcpt.Attempts)
+			rcpt.Code, rcpt.Status, rcpt.Detail, rcpt.Ip, rcpt.Tls = f.Code, f.Status, f.Detail, f.Ip, f.Tls
+			if !f.Temporary {
+				rcpt.State = rcptFailed
+				failed = append(failed, rcpt)
+			}
+		}
+		if aborted {
+			break
+		}
+	}
+
+	now := this.now()
+	pending := env.pending()
+	if !aborted {
+		env.Attempts++
+	}
+	if !aborted && len(pending) != 0 && now.Sub(env.Created) >= this.conf.Expire {
+		for _, rcpt := range pending {
+			rcpt.State = rcptFailed
+			if rcpt.Status == "" || rcpt.Status[0] != '5' {
+				// RFC 3463 delivery time expired
+				rcpt.Status = "4.4.7"
+			}
+			failed = append(failed, rcpt)
+		}
+		pending = nil
+	}
+
+	if len(failed) != 0 {
+		if err := this.bounce(env, failed, raw); err != nil {
+			log.Error("queue: bounce ", env.Id, err)
+		}
+	}
+	if len(pending) == 0 {
+		this.remove(env.Id)
+		return
+	}
+
+	if !aborted {
+		env.NextAttempt = now.Add(this.retryInterval(env.Attempts))
+	}
+	if err := this.save(env); err != nil {
+		log.Error("queue: save envelope ", env.Id, err)
+	}
+	done = false
+}
+
+func (this *Queue) retryInterval(attempts int) time.Duration {
+	intervals := this.conf.RetryIntervals
+	if len(intervals) == 0 {
+		return DefaultQueueConfig().RetryIntervals[0]
+	}
+	if attempts > len(intervals) {
+		attempts = len(intervals)
+	}
+	return intervals[attempts-1]
+}
+
+// groupByDomain groups the recipients by domain, keeping their order.
+func groupByDomain(rcpts []*queueRecipient) [][]*queueRecipient {
+	groups := [][]*queueRecipient{}
+	index := map[string]int{}
+	for _, rcpt := range rcpts {
+		domain := strings.ToLower(rcpt.Address[strings.LastIndex(rcpt.Address, "@")+1:])
+		i, ok := index[domain]
+		if !ok {
+			i = len(groups)
+			index[domain] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], rcpt)
+	}
+	return groups
+}
+
+// acquire waits for a delivery slot of the recipient's domain and returns its release.
+func (this *Queue) acquire(rcpt string) func() {
+	limit := this.conf.DomainConcurrency
+	if limit <= 0 {
+		return func() {}
+	}
+	domain := strings.ToLower(rcpt[strings.LastIndex(rcpt, "@")+1:])
+	this.lock.Lock()
+	sem, ok := this.domains[domain]
+	if !ok {
+		sem = make(chan struct{}, limit)
+		this.domains[domain] = sem
+	}
+	this.lock.Unlock()
+	sem <- struct{}{}
+	return func() { <-sem }
+}
+
+func (this *Queue) messagePath(id string) string {
+	return filepath.Join(this.dir, spoolMessageDir, id)
+}
+
+func (this *Queue) envelopePath(id string) string {
+	return filepath.Join(this.dir, spoolEnvelopeDir, id+envelopeExt)
+}
+
+func (this *Queue) save(env *envelope) error {
+	b, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+	return this.writeFile(this.envelopePath(env.Id), b)
+}
+
+func (this *Queue) remove(id string) {
+	os.Remove(this.envelopePath(id))
+	os.Remove(this.messagePath(id))
+}
+
+// writeFile replaces path atomically: the data is synced to a temporary file which is then renamed.
+func (this *Queue) writeFile(path string, data []byte) error {
+	tmp := filepath.Join(this.dir, spoolTmpDir, filepath.Base(path))
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, spoolFileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
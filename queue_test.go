@@ -0,0 +1,203 @@
+package dmail
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/smtp"
+)
+
+type fakeDelivery struct {
+	lock    sync.Mutex
+	replies map[string]error
+	sent    map[string][]string
+}
+
+func (this *fakeDelivery) deliver(ctx context.Context, from string, to []string, raw []byte) (map[string]error, map[string]*Delivery) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	errs := map[string]error{}
+	delivered := map[string]*Delivery{}
+	for _, rcpt := range to {
+		if err, ok := this.replies[rcpt]; ok {
+			errs[rcpt] = err
+			continue
+		}
+		this.sent[rcpt] = append(this.sent[rcpt], string(raw))
+		delivered[rcpt] = &Delivery{rcpt, "192.0.2.1:25", "TLS 1.3 TLS_AES_128_GCM_SHA256"}
+	}
+	return errs, delivered
+}
+
+func newTestQueue(t *testing.T, dir string, d *fakeDelivery, now *time.Time) *Queue {
+	conf := DefaultQueueConfig()
+	conf.Hostname = "mx.dtynn.me"
+	conf.RetryIntervals = []time.Duration{time.Minute, time.Hour}
+	conf.Expire = 24 * time.Hour
+	q, err := NewQueue(dir, NewSender(NewDefaultSenderConfig(0, false)), conf)
+	if err != nil {
+		t.Fatal("new queue: ", err)
+	}
+	q.deliver = d.deliver
+	q.now = func() time.Time { return *now }
+	return q
+}
+
+// runDue processes the due messages in the test goroutine.
+func runDue(q *Queue) int {
+	envs := q.due()
+	for _, env := range envs {
+		q.process(context.Background(), env)
+	}
+	return len(envs)
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2014, 11, 25, 10, 0, 0, 0, time.UTC)
+	d := &fakeDelivery{
+		replies: map[string]error{
+			"busy@example.com":    &smtp.Reply{Code: 451, Enhanced: "4.7.1", Lines: []string{"4.7.1 Greylisted"}},
+			"unknown@example.com": &smtp.Reply{Code: 550, Enhanced: "5.1.1", Lines: []string{"5.1.1 User unknown"}},
+		},
+		sent: map[string][]string{},
+	}
+	q := newTestQueue(t, dir, d, &now)
+	raw := "From: a@dtynn.me\r\nSubject: queued\r\n\r\nbody\r\n"
+	to := []string{"bob@example.com", "busy@example.com", "unknown@example.com"}
+	if _, err := q.Enqueue("a@dtynn.me", to, []byte(raw)); err != nil {
+		t.Fatal("enqueue: ", err)
+	}
+
+	if n := runDue(q); n != 1 {
+		t.Fatalf("expect 1 due message, get %d", n)
+	}
+	if len(d.sent["bob@example.com"]) != 1 || d.sent["bob@example.com"][0] != raw {
+		t.Errorf("expect delivery to bob, get %v", d.sent)
+	}
+	q.lock.Lock()
+	for _, env := range q.entries {
+		for _, rcpt := range env.Recipients {
+			if rcpt.Address == "bob@example.com" && (rcpt.State != rcptDelivered || rcpt.Ip != "192.0.2.1:25" || rcpt.Tls == "") {
+				t.Errorf("expect the delivery of bob recorded, get %+v", rcpt)
+			}
+		}
+	}
+	q.lock.Unlock()
+	// the bounce of unknown is delivered right away
+	if n := runDue(q); n != 1 {
+		t.Fatalf("expect the bounce due, get %d", n)
+	}
+	bounces := d.sent["a@dtynn.me"]
+	if len(bounces) != 1 || !strings.Contains(bounces[0], "Final-Recipient: rfc822; unknown@example.com\r\n") ||
+		!strings.Contains(bounces[0], "Status: 5.1.1\r\n") || !strings.Contains(bounces[0], "Subject: queued\r\n") {
+		t.Errorf("unexpected bounce %q", bounces)
+	}
+	if q.Len() != 1 || runDue(q) != 0 {
+		t.Fatalf("expect busy to wait for its retry, len %d", q.Len())
+	}
+
+	// a restarted queue continues with the spooled message
+	q = newTestQueue(t, dir, d, &now)
+	if q.Len() != 1 {
+		t.Fatalf("expect 1 spooled message after restart, get %d", q.Len())
+	}
+	now = now.Add(time.Minute)
+	if runDue(q) != 1 || len(d.sent["bob@example.com"]) != 1 {
+		t.Fatalf("expect a retry of busy only, get %v", d.sent)
+	}
+	now = now.Add(30 * time.Minute)
+	if runDue(q) != 0 {
+		t.Error("expect the second retry after an hour")
+	}
+
+	// expiry
+	now = now.Add(24 * time.Hour)
+	if runDue(q) != 1 || runDue(q) != 1 {
+		t.Fatal("expect the expired message and its bounce")
+	}
+	bounces = d.sent["a@dtynn.me"]
+	if len(bounces) != 2 || !strings.Contains(bounces[1], "Final-Recipient: rfc822; busy@example.com\r\n") ||
+		!strings.Contains(bounces[1], "Status: 4.4.7\r\n") {
+		t.Errorf("unexpected expiry bounce %q", bounces)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expect empty queue, get %d", q.Len())
+	}
+	if files, _ := ioutil.ReadDir(dir + "/msg"); len(files) != 0 {
+		t.Errorf("expect empty spool, get %d files", len(files))
+	}
+}
+
+func TestQueueStopped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2014, 11, 25, 10, 0, 0, 0, time.UTC)
+	d := &fakeDelivery{replies: map[string]error{"bob@example.com": context.Canceled}, sent: map[string][]string{}}
+	q := newTestQueue(t, dir, d, &now)
+	if _, err := q.Enqueue("a@dtynn.me", []string{"bob@example.com"}, []byte("Subject: x\r\n\r\n")); err != nil {
+		t.Fatal("enqueue: ", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	envs := q.due()
+	if len(envs) != 1 {
+		t.Fatalf("expect 1 due message, get %d", len(envs))
+	}
+	next := envs[0].NextAttempt
+	q.process(ctx, envs[0])
+	rcpt := envs[0].Recipients[0]
+	if envs[0].Attempts != 0 || envs[0].NextAttempt != next || rcpt.Attempts != 0 || rcpt.Status != "" {
+		t.Errorf("expect the aborted delivery not counted, get %+v %+v", envs[0], rcpt)
+	}
+
+	delete(d.replies, "bob@example.com")
+	if runDue(q) != 1 || len(d.sent["bob@example.com"]) != 1 {
+		t.Errorf("expect the delivery made again at once, get %v", d.sent)
+	}
+}
+
+func TestQueueWorkers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Now()
+	d := &fakeDelivery{sent: map[string][]string{}}
+	q := newTestQueue(t, dir, d, &now)
+	s := q.sender
+	s.SetQueue(q)
+	q.Start()
+	defer q.Stop()
+
+	for i := 0; i < 10; i++ {
+		if err := s.SendRaw("a@dtynn.me", []string{"bob@example.com", "carol@example.org"}, []byte("Subject: x\r\n\r\nbody\r\n")); err != nil {
+			t.Fatal("send: ", err)
+		}
+	}
+	for i := 0; i < 200 && q.Len() != 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if q.Len() != 0 || len(d.sent["bob@example.com"]) != 10 || len(d.sent["carol@example.org"]) != 10 {
+		t.Errorf("expect all delivered, len %d, sent %d %d", q.Len(), len(d.sent["bob@example.com"]), len(d.sent["carol@example.org"]))
+	}
+}
@@ -0,0 +1,142 @@
+package dmail
+
+import (
+	"context"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/dtynn/dmail/smtp"
+)
+
+const (
+	defaultBackoffBase = 2 * time.Second
+	defaultBackoffMax  = 2 * time.Minute
+)
+
+type fail struct {
+	Email, Detail string
+	// Code and Status are the SMTP reply code and enhanced status of the
+	// last attempt, 0 and "" if it failed without a reply.
+	Code      int
+	Status    string
+	Attempts  int
+	Temporary bool
+	// the ip:port of the last attempt, "" if it did not connect
+	Ip string
+	// the tls version and cipher suite of the last attempt, see smtp.Session.Tls
+	Tls string
+}
+
+func newFail(email string, err error, attempts int) *fail {
+	f := &fail{Email: email, Detail: err.Error(), Attempts: attempts}
+	if e, ok := err.(*hostError); ok {
+		f.Ip, f.Tls = e.ip, e.tls
+	}
+	f.Code, f.Status, f.Temporary = classify(err)
+	return f
+}
+
+// hostError is the error of a delivery attempt at ip.
+type hostError struct {
+	ip  string
+	tls string
+	err error
+}
+
+func (this *hostError) Error() string {
+	return this.err.Error()
+}
+
+// classify returns the reply code, the enhanced status and whether err is worth a retry.
+// 4xx replies, network errors and timeouts are transient, 5xx replies and anything else permanent.
+// An aborted attempt is transient too, it says nothing about the message.
+func classify(err error) (int, string, bool) {
+	if e, ok := err.(*hostError); ok {
+		err = e.err
+	}
+	switch err {
+	case smtp.ErrSizeExceeded:
+		return 552, "5.3.4", false
+	case smtp.ErrNoSmtpUtf8:
+		return 553, "5.6.7", false
+	case smtp.ErrNo8BitMime:
+		return 554, "5.6.3", false
+	}
+	switch e := err.(type) {
+	case *smtp.Reply:
+		return e.Code, e.Enhanced, e.Temporary()
+	case *smtp.TlsError:
+		// RFC 3463 encryption needed, deferred until the destination is fixed
+		return 0, "4.7.10", true
+	case *net.DNSError:
+		return 0, "", !e.IsNotFound
+	case net.Error:
+		return 0, "", true
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || err == context.Canceled || err == context.DeadlineExceeded {
+		return 0, "", true
+	}
+	return 0, "", false
+}
+
+// SetRetryBackoff sets the delay before the first retry and its upper bound.
+// The delay doubles with every attempt.
+func (this *Sender) SetRetryBackoff(base, max time.Duration) {
+	this.backoffBase = base
+	this.backoffMax = max
+}
+
+// withRetry calls send with the recipients until they succeed, fail permanently,
+// the retry count of the config is exhausted or ctx is done. send returns the errors of the failed
+// recipients, only the transient ones are passed to the next attempt.
+func (this *Sender) withRetry(ctx context.Context, to []string, send func(rcpts []string) map[string]error) Fails {
+	fails := Fails{}
+	pending := to
+	for attempts := 1; len(pending) != 0; attempts++ {
+		errs := send(pending)
+		retry := []string{}
+		for _, rcpt := range pending {
+			err, ok := errs[rcpt]
+			if !ok {
+				continue
+			}
+			f := newFail(rcpt, err, attempts)
+			if f.Temporary && attempts <= this.conf.retry && ctx.Err() == nil {
+				retry = append(retry, rcpt)
+				continue
+			}
+			fails = append(fails, f)
+		}
+		if len(retry) != 0 {
+			this.sleep(ctx, this.backoff(attempts))
+		}
+		pending = retry
+	}
+	return fails
+}
+
+func sleepContext(ctx context.Context, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+	case <-t.C:
+	}
+}
+
+// backoff returns the delay after the given attempt, jittered between half and the full value.
+func (this *Sender) backoff(attempts int) time.Duration {
+	d := this.backoffBase
+	for i := 1; i < attempts && d < this.backoffMax; i++ {
+		d *= 2
+	}
+	if d > this.backoffMax {
+		d = this.backoffMax
+	}
+	if d <= 1 {
+		return d
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
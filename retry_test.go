@@ -0,0 +1,120 @@
+package dmail
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/smtp"
+)
+
+func TestClassify(t *testing.T) {
+	cases := []struct {
+		err       error
+		code      int
+		status    string
+		temporary bool
+	}{
+		{&smtp.Reply{Code: 450, Enhanced: "4.2.1", Lines: []string{"4.2.1 Mailbox busy"}}, 450, "4.2.1", true},
+		{&smtp.Reply{Code: 550, Enhanced: "5.1.1", Lines: []string{"5.1.1 User unknown"}}, 550, "5.1.1", false},
+		{&smtp.Reply{Code: 554, Lines: []string{"rejected"}}, 554, "", false},
+		{&net.OpError{Op: "dial", Err: fmt.Errorf("connection refused")}, 0, "", true},
+		{&net.DNSError{Err: "no such host", IsNotFound: true}, 0, "", false},
+		{&net.DNSError{Err: "timeout", IsTimeout: true}, 0, "", true},
+		{io.EOF, 0, "", true},
+		{context.Canceled, 0, "", true},
+		{&hostError{"10.0.0.1:25", "none", &smtp.TlsError{Err: fmt.Errorf("no STARTTLS")}}, 0, "4.7.10", true},
+		{smtp.ErrNo8BitMime, 554, "5.6.3", false},
+		{errInvalidFromAddress, 0, "", false},
+	}
+	for _, c := range cases {
+		code, status, temporary := classify(c.err)
+		if code != c.code || status != c.status || temporary != c.temporary {
+			t.Errorf("%v: expect %d %q %v, get %d %q %v", c.err, c.code, c.status, c.temporary, code, status, temporary)
+		}
+	}
+}
+
+// single returns a send func of withRetry for one recipient.
+func single(send func() error) func([]string) map[string]error {
+	return func(rcpts []string) map[string]error {
+		if err := send(); err != nil {
+			return map[string]error{rcpts[0]: err}
+		}
+		return nil
+	}
+}
+
+func TestRetry(t *testing.T) {
+	s := NewSender(NewDefaultSenderConfig(3, false))
+	delays := []time.Duration{}
+	s.sleep = func(ctx context.Context, d time.Duration) { delays = append(delays, d) }
+	s.SetRetryBackoff(time.Second, 3*time.Second)
+
+	replies := []error{
+		&smtp.Reply{Code: 421, Enhanced: "4.3.2", Lines: []string{"4.3.2 Try later"}},
+		io.EOF,
+		&smtp.Reply{Code: 451, Enhanced: "4.7.1", Lines: []string{"4.7.1 Greylisted"}},
+		&smtp.Reply{Code: 452, Enhanced: "4.2.2", Lines: []string{"4.2.2 Over quota"}},
+		nil,
+	}
+	calls := 0
+	fails := s.withRetry(context.Background(), []string{"bob@dtynn.me"}, single(func() error {
+		calls++
+		return replies[calls-1]
+	}))
+	if len(fails) != 1 || calls != 4 {
+		t.Fatalf("expect failure after 4 attempts, get %d calls %v", calls, fails)
+	}
+	if f := fails[0]; f.Attempts != 4 || f.Code != 452 || f.Status != "4.2.2" || !f.Temporary {
+		t.Errorf("unexpected fail %+v", f)
+	}
+	bounds := []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	for i, d := range delays {
+		if d < bounds[i]/2 || d > bounds[i] {
+			t.Errorf("delay %d: %s out of [%s, %s]", i, d, bounds[i]/2, bounds[i])
+		}
+	}
+
+	calls = 0
+	fails = s.withRetry(context.Background(), []string{"bob@dtynn.me"}, single(func() error {
+		calls++
+		return &smtp.Reply{Code: 550, Enhanced: "5.1.1", Lines: []string{"5.1.1 User unknown"}}
+	}))
+	if len(fails) != 1 || calls != 1 || fails[0].Attempts != 1 || fails[0].Temporary {
+		t.Errorf("expect permanent failure without retry, get %d calls %v", calls, fails)
+	}
+
+	calls = 0
+	if fails = s.withRetry(context.Background(), []string{"bob@dtynn.me"}, single(func() error {
+		calls++
+		if calls < 3 {
+			return io.EOF
+		}
+		return nil
+	})); len(fails) != 0 || calls != 3 {
+		t.Errorf("expect success on third attempt, get %d calls %v", calls, fails)
+	}
+
+	// only the transient failures of a batch are retried
+	batches := [][]string{}
+	fails = s.withRetry(context.Background(), []string{"a@dtynn.me", "b@dtynn.me", "c@dtynn.me"}, func(rcpts []string) map[string]error {
+		batches = append(batches, rcpts)
+		if len(batches) > 1 {
+			return nil
+		}
+		return map[string]error{
+			"b@dtynn.me": &smtp.Reply{Code: 450, Enhanced: "4.2.1", Lines: []string{"4.2.1 Mailbox busy"}},
+			"c@dtynn.me": &smtp.Reply{Code: 550, Enhanced: "5.1.1", Lines: []string{"5.1.1 User unknown"}},
+		}
+	})
+	if len(batches) != 2 || len(batches[1]) != 1 || batches[1][0] != "b@dtynn.me" {
+		t.Errorf("expect a retry of b only, get %v", batches)
+	}
+	if len(fails) != 1 || fails[0].Email != "c@dtynn.me" {
+		t.Errorf("expect c to fail, get %v", fails)
+	}
+}
@@ -2,15 +2,22 @@ package dmail
 
 import (
 	"bytes"
-	"crypto/tls"
+	"context"
 	"fmt"
+	"net"
+	"net/mail"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dtynn/dmail/dkim"
+	"github.com/dtynn/dmail/dmarc"
 	"github.com/dtynn/dmail/dns"
 	"github.com/dtynn/dmail/message"
 	. "github.com/dtynn/dmail/safeMap"
 	"github.com/dtynn/dmail/smtp"
+	"github.com/dtynn/dmail/srs"
 	"github.com/qiniu/log"
 )
 
@@ -40,13 +47,22 @@ func NewDefaultSenderConfig(retry int, enableTls bool) *senderConfig {
 }
 
 type Sender struct {
-	conf     *senderConfig
-	dkimConf *dkim.DkimConf
-	dnsCache *SafeMap
-}
+	conf      *senderConfig
+	dkimConfs []*dkim.DkimConf
+	keyStore  *dkim.KeyStore
+	smartHost string
+	srs       *srs.Rewriter
+	queue     *Queue
+	pool      *smtp.Pool
+	dialer    *smtp.Dialer
+	dnsCache  *SafeMap
+	// tls policies by recipient domain, "" for the others
+	tlsPolicies map[string]*smtp.TlsPolicy
+	onDelivery  func(*Delivery)
 
-type fail struct {
-	Email, Detail string
+	backoffBase time.Duration
+	backoffMax  time.Duration
+	sleep       func(context.Context, time.Duration)
 }
 
 type Fails []*fail
@@ -54,30 +70,121 @@ type Fails []*fail
 func (this Fails) Error() string {
 	buf := bytes.NewBufferString("\n")
 	for _, f := range this {
-		buf.WriteString(fmt.Sprintf("%s: %s\n", f.Email, f.Detail))
+		if f.Ip != "" {
+			buf.WriteString(fmt.Sprintf("%s: %s (attempts %d, at %s)\n", f.Email, f.Detail, f.Attempts, f.Ip))
+		} else {
+			buf.WriteString(fmt.Sprintf("%s: %s (attempts %d)\n", f.Email, f.Detail, f.Attempts))
+		}
 	}
 	return buf.String()
 }
 
-func NewSender(conf *senderConfig, dkimConf *dkim.DkimConf) *Sender {
+// Delivery records where the message of a recipient was delivered, e.g. for reputation tracking.
+type Delivery struct {
+	Email string
+	// the ip:port of the MX
+	Ip string
+	// the tls version and cipher suite, see smtp.Session.Tls
+	Tls string
+}
+
+// NewSender returns a sender signing every message with each of the dkim confs,
+// e.g. a rsa and an ed25519 key for dual signing.
+func NewSender(conf *senderConfig, dkimConfs ...*dkim.DkimConf) *Sender {
 	s := Sender{
-		conf:     conf,
-		dkimConf: dkimConf,
-		dnsCache: NewSafeMap(),
+		conf:        conf,
+		dnsCache:    NewSafeMap(),
+		tlsPolicies: map[string]*smtp.TlsPolicy{},
+		backoffBase: defaultBackoffBase,
+		backoffMax:  defaultBackoffMax,
+		sleep:       sleepContext,
+	}
+	for _, dkimConf := range dkimConfs {
+		if dkimConf != nil {
+			s.dkimConfs = append(s.dkimConfs, dkimConf)
+		}
 	}
 	return &s
 }
 
+// SetKeyStore makes the sender pick the dkim keys by the From domain.
+// Messages from domains without an active key fall back to the confs given to NewSender
+// aligned with the From domain, and are not signed if none is.
+func (this *Sender) SetKeyStore(store *dkim.KeyStore) {
+	this.keyStore = store
+}
+
+// SetSmartHost makes the sender deliver everything to host:port instead of the MX of the recipients.
+func (this *Sender) SetSmartHost(addr string) {
+	this.smartHost = addr
+}
+
+// SetSrs makes SendRaw rewrite the envelope sender of forwarded messages,
+// so SPF of the original sender's domain does not fail at the destination.
+func (this *Sender) SetSrs(rewriter *srs.Rewriter) {
+	this.srs = rewriter
+}
+
+// SetQueue makes the sender spool the messages to the queue instead of delivering
+// them in the caller's goroutine. The queue delivers through the sender.
+func (this *Sender) SetQueue(queue *Queue) {
+	this.queue = queue
+}
+
+// Queued reports whether the messages are spooled to a queue, see SetQueue.
+func (this *Sender) Queued() bool {
+	return this.queue != nil
+}
+
+// SetPool makes the sender reuse the connections of the pool.
+func (this *Sender) SetPool(pool *smtp.Pool) {
+	this.pool = pool
+}
+
+// SetDialer sets how the sender connects to the addresses of a host, e.g. to prefer IPv6.
+// A pool connects with the dialer of its config.
+func (this *Sender) SetDialer(dialer *smtp.Dialer) {
+	this.dialer = dialer
+}
+
+// SetTlsPolicy sets how the MX hosts of a recipient domain are connected to,
+// an empty domain sets the policy of the domains without one.
+// Without policies enableTls of the config means opportunistic STARTTLS.
+func (this *Sender) SetTlsPolicy(domain string, policy *smtp.TlsPolicy) {
+	this.tlsPolicies[strings.ToLower(domain)] = policy
+}
+
+// tlsPolicy returns the policy of a recipient domain and the domain it is set for.
+func (this *Sender) tlsPolicy(domain string) (*smtp.TlsPolicy, string) {
+	if policy, ok := this.tlsPolicies[domain]; ok {
+		return policy, domain
+	}
+	if policy, ok := this.tlsPolicies[""]; ok {
+		return policy, ""
+	}
+	if this.conf.enableTls {
+		return &smtp.TlsPolicy{Mode: smtp.TlsOpportunistic}, ""
+	}
+	return nil, ""
+}
+
+// SetDeliveryHook makes the sender call hook for each delivered recipient,
+// whether it was sent synchronously or by the queue.
+func (this *Sender) SetDeliveryHook(hook func(*Delivery)) {
+	this.onDelivery = hook
+}
+
 func (this *Sender) Send(from string, to []string, subject string, body string) error {
 	mail := NewMail(defaultContentType, from, to, subject, body)
 	return this.SendMail(mail)
 }
 
 func (this *Sender) SendMail(mail *Mail) error {
-	pieces := strings.Split(mail.From, "@")
-	if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
-		return errInvalidFromAddress
-	}
+	return this.SendMailContext(context.Background(), mail)
+}
+
+// SendMailContext is SendMail aborted when ctx is done.
+func (this *Sender) SendMailContext(ctx context.Context, mail *Mail) error {
 	msg := message.NewMessage(this.conf.encoding, this.conf.charset, mail.ContentType)
 	msg.AddContentType()
 	msg.AddTransferEncodingHeader()
@@ -90,62 +197,266 @@ func (this *Sender) SendMail(mail *Mail) error {
 	msg.AddNormalHeader("Subject", mail.Subject)
 	msg.SetBody(mail.Body)
 
-	if this.dkimConf != nil {
-		d := dkim.NewDefaultDkim(msg, this.dkimConf)
-		header, err := d.SignatureHeader()
+	return this.SendMessageContext(ctx, mail.From, mail.To, msg)
+}
+
+// SendMessage signs and delivers a prepared message.
+func (this *Sender) SendMessage(from string, to []string, msg *message.Message) error {
+	return this.SendMessageContext(context.Background(), from, to, msg)
+}
+
+// SendMessageContext is SendMessage aborted when ctx is done.
+func (this *Sender) SendMessageContext(ctx context.Context, from string, to []string, msg *message.Message) error {
+	pieces := strings.Split(from, "@")
+	if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
+		return errInvalidFromAddress
+	}
+
+	if confs := this.signingConfs(this.messageFromDomain(msg, pieces[1])); len(confs) != 0 {
+		headers, err := dkim.SignatureHeaders(msg, confs...)
 		if err != nil {
 			return err
 		}
-		msg.AddHeader(header)
+		for _, header := range headers {
+			msg.AddHeader(header)
+		}
 	}
 
-	b := msg.Bytes()
-	fails := Fails{}
-	for _, rcpt := range mail.To {
-		piece := strings.Split(rcpt, "@")
-		if len(piece) != 2 || piece[0] == "" || piece[1] == "" {
-			fails = append(fails, &fail{rcpt, errInvalidRcptAddress.Error()})
-			continue
+	return this.deliver(ctx, from, to, msg.Bytes())
+}
+
+// SendRaw signs and delivers a serialized message, e.g. one relayed from the server.
+// An empty from is the null reverse path of bounces.
+// Messages without a From header are not signed.
+func (this *Sender) SendRaw(from string, to []string, raw []byte) error {
+	return this.SendRawContext(context.Background(), from, to, raw)
+}
+
+// SendRawContext is SendRaw aborted when ctx is done.
+func (this *Sender) SendRawContext(ctx context.Context, from string, to []string, raw []byte) error {
+	if from != "" {
+		pieces := strings.Split(from, "@")
+		if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
+			return errInvalidFromAddress
+		}
+	}
+	if this.srs != nil {
+		rewritten, err := this.srs.Forward(from)
+		if err != nil {
+			return err
 		}
-		err := this.send(piece[1], mail.From, []string{rcpt}, b)
+		from = rewritten
+	}
+	signed, err := this.signRaw(raw)
+	if err != nil {
+		return err
+	}
+	return this.deliver(ctx, from, to, signed)
+}
+
+// signRaw prepends the dkim signatures for the domain of the From header.
+func (this *Sender) signRaw(raw []byte) ([]byte, error) {
+	domain := ""
+	if m, err := mail.ReadMessage(bytes.NewReader(raw)); err == nil {
+		if addr, err := mail.ParseAddress(m.Header.Get("From")); err == nil {
+			domain = addr.Address[strings.LastIndex(addr.Address, "@")+1:]
+		}
+	}
+	if domain == "" {
+		return raw, nil
+	}
+
+	headers := []byte{}
+	for _, conf := range this.signingConfs(domain) {
+		header, err := dkim.SignRaw(raw, conf, nil)
 		if err != nil {
-			fails = append(fails, &fail{rcpt, err.Error()})
+			return nil, err
 		}
+		headers = append(headers, header.String()+"\r\n"...)
+	}
+	return append(headers, raw...), nil
+}
+
+// deliver sends the message to every recipient, or spools it if the sender has a queue.
+func (this *Sender) deliver(ctx context.Context, from string, to []string, b []byte) error {
+	if this.queue != nil {
+		_, err := this.queue.Enqueue(from, to, b)
+		return err
 	}
+	fails := this.withRetry(ctx, to, func(rcpts []string) map[string]error {
+		errs, _ := this.sendOnce(ctx, from, rcpts, b)
+		return errs
+	})
 	if len(fails) == 0 {
 		return nil
 	}
 	return fails
 }
 
-func (this *Sender) getMxHost(name string) (string, error) {
-	if host, err := this.dnsCache.Get(name); err == nil {
-		return host.(string), nil
+// sendOnce makes a delivery attempt to each recipient and returns the errors of the failed ones
+// and the deliveries of the others.
+// Recipients sharing their MX hosts and tls policy, or all of them with a smart host,
+// are sent in one transaction.
+func (this *Sender) sendOnce(ctx context.Context, from string, to []string, b []byte) (map[string]error, map[string]*Delivery) {
+	errs := map[string]error{}
+	delivered := map[string]*Delivery{}
+	groups := map[string][]string{}
+	routes := map[string][]string{}
+	policies := map[string]*smtp.TlsPolicy{}
+	keys := []string{}
+	for _, rcpt := range to {
+		piece := strings.Split(rcpt, "@")
+		if len(piece) != 2 || piece[0] == "" || piece[1] == "" {
+			errs[rcpt] = errInvalidRcptAddress
+			continue
+		}
+		domain := strings.ToLower(piece[1])
+		addrs, err := this.route(domain)
+		if err != nil {
+			errs[rcpt] = err
+			continue
+		}
+		policy, policyDomain := this.tlsPolicy(domain)
+		key := policyDomain + "|" + strings.Join(addrs, ",")
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+			routes[key] = addrs
+			policies[key] = policy
+		}
+		groups[key] = append(groups[key], rcpt)
 	}
 
-	mx, err := dns.ChoseMx(name)
-	if err != nil {
-		return "", err
+	for _, key := range keys {
+		hostErrs, hostDelivered := this.sendHosts(ctx, routes[key], policies[key], from, groups[key], b)
+		for rcpt, err := range hostErrs {
+			errs[rcpt] = err
+		}
+		for rcpt, d := range hostDelivered {
+			delivered[rcpt] = d
+			if this.onDelivery != nil {
+				this.onDelivery(d)
+			}
+		}
 	}
-	this.dnsCache.Setex(name, mx.Host, cacheExpire)
-	return mx.Host, nil
+	return errs, delivered
 }
 
-func (this *Sender) send(hostname, from string, to []string, msg []byte) error {
-	local := strings.Split(from, "@")[1]
-	host, err := this.getMxHost(hostname)
+// sendHosts tries the hosts in order until the recipients are delivered or rejected permanently.
+// Recipients failing with a connection error or a 4xx reply move on to the next host.
+func (this *Sender) sendHosts(ctx context.Context, addrs []string, policy *smtp.TlsPolicy, from string, to []string, b []byte) (map[string]error, map[string]*Delivery) {
+	errs := map[string]error{}
+	delivered := map[string]*Delivery{}
+	deliver := func(rcpt string, session *smtp.Session) {
+		log.Info("send: delivered to ", rcpt, " via ", session.Remote, " tls ", session.Tls())
+		delete(errs, rcpt)
+		delivered[rcpt] = &Delivery{rcpt, session.Remote, session.Tls()}
+	}
+	pending := to
+	for _, addr := range addrs {
+		session, err := this.send(ctx, addr, policy, from, pending, b)
+		if err == nil {
+			for _, rcpt := range pending {
+				deliver(rcpt, session)
+			}
+			break
+		}
+
+		rejected, partial := err.(smtp.RcptErrors)
+		retry := []string{}
+		for _, rcpt := range pending {
+			e := err
+			if partial {
+				if e = rejected[rcpt]; e == nil {
+					deliver(rcpt, session)
+					continue
+				}
+			}
+			if session.Remote != "" {
+				e = &hostError{session.Remote, session.Tls(), e}
+			}
+			errs[rcpt] = e
+			if _, _, temporary := classify(e); temporary {
+				retry = append(retry, rcpt)
+			}
+		}
+		if len(retry) == 0 || ctx.Err() != nil {
+			break
+		}
+		log.Warn("send: ", addr, " failed, trying next host: ", err)
+		pending = retry
+	}
+	return errs, delivered
+}
+
+// route returns the host:port candidates delivering the mail of a domain.
+func (this *Sender) route(domain string) ([]string, error) {
+	if this.smartHost != "" {
+		return []string{this.smartHost}, nil
+	}
+	hosts, err := this.getMxHosts(domain)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	addr := fmt.Sprintf("%s:%d", host, smtp.DefaultPort)
+	addrs := make([]string, len(hosts))
+	for i, host := range hosts {
+		addrs[i] = net.JoinHostPort(host, strconv.Itoa(smtp.DefaultPort))
+	}
+	return addrs, nil
+}
 
-	var tlsConfig *tls.Config
-	if this.conf.enableTls {
-		tlsConfig = &tls.Config{
-			ServerName: hostname,
+// messageFromDomain returns the domain of the From header, or the envelope domain without one.
+func (this *Sender) messageFromDomain(msg *message.Message, envelopeDomain string) string {
+	domain := envelopeDomain
+	for _, h := range msg.Headers() {
+		if strings.EqualFold(h.Field(), "From") {
+			addr := h.Value()
+			if i := strings.LastIndex(addr, "<"); i != -1 {
+				addr = strings.TrimSuffix(addr[i+1:], ">")
+			}
+			if i := strings.LastIndex(addr, "@"); i != -1 {
+				domain = addr[i+1:]
+			}
+			break
 		}
-	} else {
-		tlsConfig = nil
+	}
+	return domain
+}
+
+func (this *Sender) signingConfs(domain string) []*dkim.DkimConf {
+	if this.keyStore == nil {
+		return this.dkimConfs
+	}
+	if confs := this.keyStore.Lookup(domain); len(confs) != 0 {
+		return confs
+	}
+	// a signature of another domain would not align with the From domain for DMARC
+	aligned := []*dkim.DkimConf{}
+	for _, conf := range this.dkimConfs {
+		if dmarc.OrganizationalDomain(conf.Domain()) == dmarc.OrganizationalDomain(domain) {
+			aligned = append(aligned, conf)
+		}
+	}
+	return aligned
+}
+
+func (this *Sender) getMxHosts(name string) ([]string, error) {
+	if hosts, err := this.dnsCache.Get(name); err == nil {
+		return hosts.([]string), nil
+	}
+
+	hosts, err := dns.MxHosts(name)
+	if err != nil {
+		return nil, err
+	}
+	this.dnsCache.Setex(name, hosts, cacheExpire)
+	return hosts, nil
+}
+
+// send makes one transaction and returns the session it was made on.
+func (this *Sender) send(ctx context.Context, addr string, policy *smtp.TlsPolicy, from string, to []string, msg []byte) (*smtp.Session, error) {
+	local, _ := os.Hostname()
+	if i := strings.LastIndex(from, "@"); i != -1 {
+		local = from[i+1:]
 	}
 
 	log.Info("send: addr ", addr)
@@ -153,6 +464,12 @@ func (this *Sender) send(hostname, from string, to []string, msg []byte) error {
 	log.Info("send: from ", from)
 	log.Info("send: to ", to)
 	log.Info("send: msg ", string(msg))
-	log.Info("send: tls", tlsConfig)
-	return smtp.SendEmail(addr, local, from, to, msg, tlsConfig)
+	if policy != nil {
+		log.Info("send: tls ", policy.Mode)
+	}
+	env := &smtp.Envelope{From: from, To: to}
+	if this.pool != nil {
+		return this.pool.SendEnvelopeContext(ctx, addr, local, env, msg, policy)
+	}
+	return smtp.SendEnvelopeContext(ctx, this.dialer, addr, local, env, msg, policy)
 }
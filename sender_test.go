@@ -0,0 +1,284 @@
+package dmail
+
+import (
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/dkim"
+	"github.com/dtynn/dmail/smtp"
+)
+
+// testTransaction is a mail transaction received by a testSmtpServer.
+type testTransaction struct {
+	from  string
+	rcpts []string
+	data  string
+}
+
+// testSmtpServer accepts mail on a local port, rejecting the RCPT TO of the addresses in reject.
+type testSmtpServer struct {
+	l      net.Listener
+	reject map[string]string
+
+	lock         sync.Mutex
+	connections  int
+	conns        []net.Conn
+	transactions []*testTransaction
+}
+
+func newTestSmtpServer(t *testing.T, reject map[string]string) *testSmtpServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+	s := &testSmtpServer{l: l, reject: reject}
+	go s.serve()
+	return s
+}
+
+func (this *testSmtpServer) Addr() string {
+	return this.l.Addr().String()
+}
+
+func (this *testSmtpServer) Close() {
+	this.l.Close()
+}
+
+// drop closes the open connections as a server timing out idle sessions would.
+func (this *testSmtpServer) drop() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, conn := range this.conns {
+		conn.Close()
+	}
+	this.conns = nil
+}
+
+func (this *testSmtpServer) serve() {
+	for {
+		conn, err := this.l.Accept()
+		if err != nil {
+			return
+		}
+		this.lock.Lock()
+		this.connections++
+		this.conns = append(this.conns, conn)
+		this.lock.Unlock()
+		go this.handle(conn)
+	}
+}
+
+func (this *testSmtpServer) handle(conn net.Conn) {
+	defer conn.Close()
+	c := textproto.NewConn(conn)
+	c.PrintfLine("220 test ESMTP")
+	var tx *testTransaction
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			c.PrintfLine("250 test")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			tx = &testTransaction{from: strings.Trim(line[10:], "<>")}
+			c.PrintfLine("250 OK")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			rcpt := strings.Trim(line[8:], "<>")
+			if reply, ok := this.reject[rcpt]; ok {
+				c.PrintfLine("%s", reply)
+				continue
+			}
+			tx.rcpts = append(tx.rcpts, rcpt)
+			c.PrintfLine("250 OK")
+		case cmd == "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			tx.data = string(data)
+			this.lock.Lock()
+			this.transactions = append(this.transactions, tx)
+			this.lock.Unlock()
+			c.PrintfLine("250 queued")
+		case cmd == "RSET", cmd == "NOOP":
+			c.PrintfLine("250 OK")
+		case cmd == "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSendBatch(t *testing.T) {
+	srv := newTestSmtpServer(t, map[string]string{
+		"unknown@example.com": "550 5.1.1 User unknown",
+		"busy@example.org":    "450 4.2.1 Mailbox busy",
+	})
+	defer srv.Close()
+
+	s := NewSender(NewDefaultSenderConfig(0, false))
+	s.SetSmartHost(srv.Addr())
+	delivered := map[string]string{}
+	s.SetDeliveryHook(func(d *Delivery) { delivered[d.Email] = d.Ip })
+	to := []string{"bob@example.com", "unknown@example.com", "carol@example.org", "busy@example.org", "invalid"}
+	err := s.SendRaw("a@dtynn.me", to, []byte("Subject: batch\r\n\r\nbody\r\n"))
+	fails, ok := err.(Fails)
+	if !ok || len(fails) != 3 {
+		t.Fatalf("expect 3 fails, get %v", err)
+	}
+	if len(delivered) != 2 || delivered["bob@example.com"] != srv.Addr() || delivered["carol@example.org"] != srv.Addr() {
+		t.Errorf("expect bob and carol delivered at %s, get %v", srv.Addr(), delivered)
+	}
+	codes := map[string]int{}
+	for _, f := range fails {
+		codes[f.Email] = f.Code
+	}
+	if codes["unknown@example.com"] != 550 || codes["busy@example.org"] != 450 || codes["invalid"] != 0 {
+		t.Errorf("unexpected fails %v", fails)
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.connections != 1 || len(srv.transactions) != 1 {
+		t.Fatalf("expect a single transaction, get %d connections %d transactions", srv.connections, len(srv.transactions))
+	}
+	tx := srv.transactions[0]
+	if tx.from != "a@dtynn.me" || strings.Join(tx.rcpts, ",") != "bob@example.com,carol@example.org" ||
+		tx.data != "Subject: batch\n\nbody\n" {
+		t.Errorf("unexpected transaction %+v", tx)
+	}
+}
+
+func TestSendPool(t *testing.T) {
+	srv := newTestSmtpServer(t, map[string]string{"unknown@example.com": "550 5.1.1 User unknown"})
+	defer srv.Close()
+
+	pool := smtp.NewPool(&smtp.PoolConfig{MaxIdle: 2, MaxMessages: 3, IdleTimeout: time.Minute})
+	defer pool.Close()
+	s := NewSender(NewDefaultSenderConfig(0, false))
+	s.SetSmartHost(srv.Addr())
+	s.SetPool(pool)
+
+	send := func(to string) error {
+		return s.SendRaw("a@dtynn.me", []string{to}, []byte("Subject: pooled\r\n\r\nbody\r\n"))
+	}
+	connections := func() int {
+		srv.lock.Lock()
+		defer srv.lock.Unlock()
+		return srv.connections
+	}
+
+	if err := send("bob@example.com"); err != nil {
+		t.Fatal("send: ", err)
+	}
+	if err := send("unknown@example.com"); err == nil {
+		t.Error("expect rejection")
+	}
+	// refused before MAIL FROM, the session stays pooled
+	err := s.SendRaw("a@dtynn.me", []string{"bob@example.com"}, []byte("Subject: caf\xc3\xa9\r\n\r\nbody\r\n"))
+	if fails, ok := err.(Fails); !ok || fails[0].Status != "5.6.3" {
+		t.Errorf("expect the 8-bit message refused, get %v", err)
+	}
+	if err := send("bob@example.com"); err != nil {
+		t.Fatal("send: ", err)
+	}
+	if n := connections(); n != 1 {
+		t.Errorf("expect 1 connection for 3 messages, get %d", n)
+	}
+
+	// max messages reached
+	if err := send("bob@example.com"); err != nil {
+		t.Fatal("send: ", err)
+	}
+	if n := connections(); n != 2 {
+		t.Errorf("expect a new connection after max messages, get %d", n)
+	}
+
+	// dead idle connection
+	srv.drop()
+	if err := send("bob@example.com"); err != nil {
+		t.Fatal("send after drop: ", err)
+	}
+	if n := connections(); n != 3 {
+		t.Errorf("expect a new connection after the server dropped the idle one, get %d", n)
+	}
+
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if len(srv.transactions) != 4 {
+		t.Errorf("expect 4 transactions, get %d", len(srv.transactions))
+	}
+}
+
+func TestSendFailover(t *testing.T) {
+	primary := newTestSmtpServer(t, map[string]string{
+		"busy@example.com":    "450 4.2.1 Mailbox busy",
+		"unknown@example.com": "550 5.1.1 User unknown",
+	})
+	defer primary.Close()
+	backup := newTestSmtpServer(t, nil)
+	defer backup.Close()
+	down := newTestSmtpServer(t, nil)
+	down.Close()
+
+	s := NewSender(NewDefaultSenderConfig(0, false))
+	to := []string{"bob@example.com", "busy@example.com", "unknown@example.com"}
+	errs, delivered := s.sendHosts(context.Background(), []string{down.Addr(), primary.Addr(), backup.Addr()}, nil, "a@dtynn.me", to, []byte("Subject: x\r\n\r\nbody\r\n"))
+	if len(errs) != 1 || errs["unknown@example.com"] == nil {
+		t.Fatalf("expect only unknown to fail, get %v", errs)
+	}
+	if d := delivered["bob@example.com"]; d == nil || d.Ip != primary.Addr() || d.Tls != "none" {
+		t.Errorf("expect bob delivered at %s, get %+v", primary.Addr(), d)
+	}
+	if d := delivered["busy@example.com"]; d == nil || d.Ip != backup.Addr() {
+		t.Errorf("expect busy delivered at %s, get %+v", backup.Addr(), d)
+	}
+	if f := newFail("unknown@example.com", errs["unknown@example.com"], 1); f.Ip != primary.Addr() || f.Code != 550 {
+		t.Errorf("expect a 550 at %s, get %+v", primary.Addr(), f)
+	}
+	primary.lock.Lock()
+	defer primary.lock.Unlock()
+	backup.lock.Lock()
+	defer backup.lock.Unlock()
+	if len(primary.transactions) != 1 || strings.Join(primary.transactions[0].rcpts, ",") != "bob@example.com" {
+		t.Errorf("unexpected primary transactions %v", primary.transactions)
+	}
+	if len(backup.transactions) != 1 || strings.Join(backup.transactions[0].rcpts, ",") != "busy@example.com" {
+		t.Errorf("unexpected backup transactions %v", backup.transactions)
+	}
+}
+
+func TestSigningConfs(t *testing.T) {
+	store := dkim.NewKeyStore()
+	store.Add(&dkim.KeyEntry{Conf: dkim.NewDkimConf("brand.com", "", "s1", false, nil)})
+	s := NewSender(NewDefaultSenderConfig(0, false), dkim.NewDkimConf("dtynn.me", "", "abc", false, nil))
+	s.SetKeyStore(store)
+
+	cases := []struct {
+		domain, expect string
+	}{
+		{"brand.com", "brand.com"},
+		{"news.dtynn.me", "dtynn.me"},
+		{"other.org", ""},
+	}
+	for _, c := range cases {
+		domains := []string{}
+		for _, conf := range s.signingConfs(c.domain) {
+			domains = append(domains, conf.Domain())
+		}
+		if strings.Join(domains, ",") != c.expect {
+			t.Errorf("%s: expect signing as %q, get %v", c.domain, c.expect, domains)
+		}
+	}
+}
@@ -0,0 +1,345 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errBadReply    = fmt.Errorf("smtp: malformed reply")
+	errNoStartTls  = fmt.Errorf("smtp: server does not support STARTTLS")
+	enhancedRegexp = regexp.MustCompile(`^[245]\.\d{1,3}\.\d{1,3}\b`)
+
+	// a deadline in the past aborting the pending io
+	aborted = time.Unix(1, 0)
+)
+
+// Reply is a SMTP reply, RFC 5321 section 4.2.
+// Negative replies are returned as errors.
+type Reply struct {
+	Code int
+	// RFC 3463 enhanced status code of the first line, "" if none
+	Enhanced string
+	Lines    []string
+}
+
+func (this *Reply) Error() string {
+	return fmt.Sprintf("%d %s", this.Code, strings.Join(this.Lines, " "))
+}
+
+// Temporary reports whether the reply is a transient negative one (4xx).
+func (this *Reply) Temporary() bool {
+	return this.Code >= 400 && this.Code < 500
+}
+
+// Timeouts of a session, RFC 5321 section 4.5.3.2.
+type Timeouts struct {
+	Greeting  time.Duration
+	Command   time.Duration
+	Mail      time.Duration
+	Rcpt      time.Duration
+	DataInit  time.Duration
+	DataBlock time.Duration
+	DataTerm  time.Duration
+}
+
+// DefaultTimeouts are the minimums recommended by RFC 5321.
+var DefaultTimeouts = &Timeouts{
+	Greeting:  5 * time.Minute,
+	Command:   5 * time.Minute,
+	Mail:      5 * time.Minute,
+	Rcpt:      5 * time.Minute,
+	DataInit:  2 * time.Minute,
+	DataBlock: 3 * time.Minute,
+	DataTerm:  10 * time.Minute,
+}
+
+// Client is a SMTP client session. Every command is bounded by its timeout,
+// and the replies are available as is.
+type Client struct {
+	conn     net.Conn
+	text     *textproto.Conn
+	timeouts *Timeouts
+	local    string
+	ext      Extensions
+	tls      bool
+	reply    *Reply
+
+	lock     sync.Mutex
+	ctx      context.Context
+	canceled bool
+}
+
+// NewClient reads the greeting of the server on conn.
+func NewClient(conn net.Conn, timeouts *Timeouts) (*Client, error) {
+	c := newClient(conn, timeouts)
+	if err := c.greet(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newClient(conn net.Conn, timeouts *Timeouts) *Client {
+	if timeouts == nil {
+		timeouts = DefaultTimeouts
+	}
+	return &Client{
+		conn:     conn,
+		text:     textproto.NewConn(conn),
+		timeouts: timeouts,
+		ctx:      context.Background(),
+	}
+}
+
+func (this *Client) greet() error {
+	_, err := this.read(this.timeouts.Greeting, 2)
+	return err
+}
+
+// Reply returns the last reply of the server.
+func (this *Client) Reply() *Reply {
+	return this.reply
+}
+
+// Hello sends EHLO, or HELO if the server does not know EHLO.
+func (this *Client) Hello(local string) error {
+	this.local = local
+	reply, err := this.cmd(this.timeouts.Command, 2, "EHLO %s", local)
+	if err != nil {
+		if reply == nil || reply.Code < 500 {
+			return err
+		}
+		this.ext = Extensions{}
+		_, err = this.cmd(this.timeouts.Command, 2, "HELO %s", local)
+		return err
+	}
+
+	this.ext = parseExtensions(reply.Lines[1:])
+	return nil
+}
+
+// Extensions returns the extensions advertised in the EHLO reply.
+func (this *Client) Extensions() Extensions {
+	return this.ext
+}
+
+// Extension reports whether the server advertised the extension in its EHLO reply, and its parameters.
+func (this *Client) Extension(name string) (bool, string) {
+	value, ok := this.ext[strings.ToUpper(name)]
+	return ok, value
+}
+
+// StartTLS upgrades the session and sends EHLO again.
+func (this *Client) StartTLS(config *tls.Config) error {
+	if ok, _ := this.Extension("STARTTLS"); !ok {
+		return errNoStartTls
+	}
+	if _, err := this.cmd(this.timeouts.Command, 2, "STARTTLS"); err != nil {
+		return err
+	}
+	conn := tls.Client(this.conn, config)
+	this.setDeadline(this.timeouts.Command)
+	if err := conn.Handshake(); err != nil {
+		return this.ioError(err)
+	}
+	this.lock.Lock()
+	this.conn = conn
+	this.lock.Unlock()
+	this.text = textproto.NewConn(conn)
+	this.tls = true
+	return this.Hello(this.local)
+}
+
+// TLSConnectionState returns the state of the tls session, if the session uses tls.
+func (this *Client) TLSConnectionState() (tls.ConnectionState, bool) {
+	if conn, ok := this.conn.(*tls.Conn); ok {
+		return conn.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+func (this *Client) Mail(from string) error {
+	_, err := this.cmd(this.timeouts.Mail, 2, "MAIL FROM:<%s>", from)
+	return err
+}
+
+func (this *Client) Rcpt(to string) error {
+	_, err := this.cmd(this.timeouts.Rcpt, 2, "RCPT TO:<%s>", to)
+	return err
+}
+
+// Data starts the message, which is dot-stuffed while written and ended by Close.
+func (this *Client) Data() (io.WriteCloser, error) {
+	if _, err := this.cmd(this.timeouts.DataInit, 3, "DATA"); err != nil {
+		return nil, err
+	}
+	return &dataWriter{c: this, w: this.text.DotWriter()}, nil
+}
+
+func (this *Client) Reset() error {
+	_, err := this.cmd(this.timeouts.Command, 2, "RSET")
+	return err
+}
+
+func (this *Client) Noop() error {
+	_, err := this.cmd(this.timeouts.Command, 2, "NOOP")
+	return err
+}
+
+// Quit ends the session and closes the connection.
+func (this *Client) Quit() error {
+	_, err := this.cmd(this.timeouts.Command, 2, "QUIT")
+	if cerr := this.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (this *Client) Close() error {
+	return this.text.Close()
+}
+
+// bind makes the session fail with the error of ctx once it is done,
+// until the returned release is called.
+func (this *Client) bind(ctx context.Context) func() {
+	this.lock.Lock()
+	this.ctx = ctx
+	this.canceled = false
+	this.lock.Unlock()
+	if ctx.Done() == nil {
+		return func() {}
+	}
+
+	done, exited := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(exited)
+		select {
+		case <-ctx.Done():
+			this.lock.Lock()
+			this.canceled = true
+			this.conn.SetDeadline(aborted)
+			this.lock.Unlock()
+		case <-done:
+		}
+	}()
+	return func() {
+		close(done)
+		// a cancel racing the release must not abort the next user of the session
+		<-exited
+		this.lock.Lock()
+		this.ctx = context.Background()
+		this.lock.Unlock()
+	}
+}
+
+// setDeadline bounds the next io by timeout and by the deadline of the bound context.
+func (this *Client) setDeadline(timeout time.Duration) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if this.canceled {
+		return
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := this.ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+	this.conn.SetDeadline(deadline)
+}
+
+// ioError returns the error of the bound context if it aborted the io.
+func (this *Client) ioError(err error) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if ctxErr := this.ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
+}
+
+// cmd sends a command and reads the reply, which is an error unless its code starts with expect.
+func (this *Client) cmd(timeout time.Duration, expect int, format string, args ...interface{}) (*Reply, error) {
+	this.setDeadline(timeout)
+	if err := this.text.PrintfLine(format, args...); err != nil {
+		return nil, this.ioError(err)
+	}
+	return this.read(timeout, expect)
+}
+
+func (this *Client) read(timeout time.Duration, expect int) (*Reply, error) {
+	this.setDeadline(timeout)
+	reply, err := readReply(this.text)
+	if err != nil {
+		return nil, this.ioError(err)
+	}
+	this.reply = reply
+	if reply.Code/100 != expect {
+		return reply, reply
+	}
+	return reply, nil
+}
+
+// readReply reads the lines of a reply, "250-first", "250-second", "250 last".
+func readReply(text *textproto.Conn) (*Reply, error) {
+	reply := &Reply{}
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) < 3 || (len(line) > 3 && line[3] != ' ' && line[3] != '-') {
+			return nil, errBadReply
+		}
+		code, err := strconv.Atoi(line[:3])
+		if err != nil || code < 200 || code > 599 || (reply.Code != 0 && code != reply.Code) {
+			return nil, errBadReply
+		}
+		reply.Code = code
+		s := ""
+		if len(line) > 4 {
+			s = line[4:]
+		}
+		if len(reply.Lines) == 0 {
+			reply.Enhanced = enhancedRegexp.FindString(s)
+		}
+		reply.Lines = append(reply.Lines, s)
+		if len(line) == 3 || line[3] == ' ' {
+			return reply, nil
+		}
+	}
+}
+
+type dataWriter struct {
+	c *Client
+	w io.WriteCloser
+}
+
+func (this *dataWriter) Write(p []byte) (int, error) {
+	this.c.setDeadline(this.c.timeouts.DataBlock)
+	n, err := this.w.Write(p)
+	if err != nil {
+		err = this.c.ioError(err)
+	}
+	return n, err
+}
+
+// Close ends the message and reads the final reply.
+func (this *dataWriter) Close() error {
+	this.c.setDeadline(this.c.timeouts.DataBlock)
+	if err := this.w.Close(); err != nil {
+		return this.c.ioError(err)
+	}
+	_, err := this.c.read(this.c.timeouts.DataTerm, 2)
+	return err
+}
@@ -0,0 +1,158 @@
+package smtp
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveScript answers the commands of a client with the replies of script,
+// in order, after the greeting. A missing reply makes the server hang.
+func serveScript(t *testing.T, greeting string, script map[string]string) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				c := textproto.NewConn(conn)
+				c.PrintfLine("%s", greeting)
+				for {
+					line, err := c.ReadLine()
+					if err != nil {
+						return
+					}
+					verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+					if verb == "DATA" {
+						c.PrintfLine("354 go ahead")
+						if _, err := c.ReadDotBytes(); err != nil {
+							return
+						}
+						verb = "."
+					}
+					reply, ok := script[verb]
+					if !ok {
+						// tarpit
+						bufio.NewReader(conn).ReadString('\n')
+						return
+					}
+					c.PrintfLine("%s", reply)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestReadReply(t *testing.T) {
+	text := textproto.NewConn(struct {
+		*strings.Reader
+		nopWriteCloser
+	}{strings.NewReader("250-mx.example.com\r\n250-SIZE 1000\r\n250 8BITMIME\r\n550 5.1.1 <bob@example.com> unknown\r\n250-bad\r\n251 mixed\r\n"), nopWriteCloser{}})
+
+	reply, err := readReply(text)
+	if err != nil || reply.Code != 250 || len(reply.Lines) != 3 || reply.Lines[1] != "SIZE 1000" {
+		t.Errorf("unexpected multiline reply %+v %v", reply, err)
+	}
+	reply, err = readReply(text)
+	if err != nil || reply.Code != 550 || reply.Enhanced != "5.1.1" || reply.Error() != "550 5.1.1 <bob@example.com> unknown" {
+		t.Errorf("unexpected reply %+v %v", reply, err)
+	}
+	if _, err = readReply(text); err != errBadReply {
+		t.Errorf("expect bad reply for mixed codes, get %v", err)
+	}
+}
+
+type nopWriteCloser struct{}
+
+func (nopWriteCloser) Write(p []byte) (int, error) { return len(p), nil }
+func (nopWriteCloser) Close() error                { return nil }
+
+var okScript = map[string]string{
+	"EHLO": "250-test\r\n250 PIPELINING",
+	"MAIL": "250 OK",
+	"NOOP": "250 OK",
+	"RCPT": "250 OK",
+	".":    "250 2.0.0 queued",
+	"RSET": "250 OK",
+	"QUIT": "221 bye",
+}
+
+func TestSendMailContext(t *testing.T) {
+	addr, stop := serveScript(t, "220 test ESMTP", okScript)
+	defer stop()
+
+	remote, err := SendMailContext(context.Background(), nil, addr, "local", "a@dtynn.me", []string{"b@example.com"}, []byte("Subject: x\r\n\r\nbody\r\n"), nil)
+	if err != nil || remote != addr {
+		t.Errorf("expect delivery via %s, get %s %v", addr, remote, err)
+	}
+
+	addr, stop = serveScript(t, "554 go away", okScript)
+	defer stop()
+	_, err = SendMailContext(context.Background(), nil, addr, "local", "a@dtynn.me", []string{"b@example.com"}, nil, nil)
+	if reply, ok := err.(*Reply); !ok || reply.Code != 554 {
+		t.Errorf("expect the greeting reply, get %v", err)
+	}
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	tarpit := map[string]string{"EHLO": "250 test"}
+	addr, stop := serveScript(t, "220 test ESMTP", tarpit)
+	defer stop()
+
+	d := &Dialer{Timeout: time.Second, Timeouts: &Timeouts{Command: time.Second, Mail: 100 * time.Millisecond}}
+	start := time.Now()
+	_, err := SendMailContext(context.Background(), d, addr, "local", "a@dtynn.me", []string{"b@example.com"}, nil, nil)
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("expect a timeout, get %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expect the MAIL timeout, took %s", time.Since(start))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	start = time.Now()
+	_, err = SendMailContext(ctx, nil, addr, "local", "a@dtynn.me", []string{"b@example.com"}, nil, nil)
+	if err != context.Canceled {
+		t.Errorf("expect canceled, get %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expect the cancel to abort, took %s", time.Since(start))
+	}
+}
+
+func TestBindRelease(t *testing.T) {
+	addr, stop := serveScript(t, "220 test ESMTP", okScript)
+	defer stop()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dial: ", err)
+	}
+	c, err := NewClient(conn, nil)
+	if err != nil {
+		t.Fatal("greeting: ", err)
+	}
+	defer c.Close()
+
+	// a context canceled after the release does not abort the next transaction
+	for i := 0; i < 100; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		release := c.bind(ctx)
+		release()
+		cancel()
+		if err := c.Noop(); err != nil {
+			t.Fatalf("attempt %d: expect the session alive, get %v", i, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package smtp
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+var errNoAddress = fmt.Errorf("smtp: no address to dial")
+
+// Dialer connects to every address of a host in turn, racing them as
+// described in RFC 8305 (Happy Eyeballs): the next address is tried when the
+// previous one failed or did not connect within FallbackDelay.
+type Dialer struct {
+	// LookupIP resolves the host, net.DefaultResolver if nil
+	LookupIP func(ctx context.Context, host string) ([]net.IP, error)
+	// try the IPv6 addresses first, mail servers often lack IPv6 reputation so it is off by default
+	PreferIPv6 bool
+	// connection timeout of each address
+	Timeout time.Duration
+	// delay before racing the next address
+	FallbackDelay time.Duration
+	// command timeouts of the sessions, DefaultTimeouts if nil
+	Timeouts *Timeouts
+}
+
+var DefaultDialer = &Dialer{
+	Timeout:       30 * time.Second,
+	FallbackDelay: 300 * time.Millisecond,
+}
+
+// Dial connects to host:port. The remote address of the connection is the ip it used.
+func (this *Dialer) Dial(addr string) (net.Conn, error) {
+	return this.DialContext(context.Background(), addr)
+}
+
+// DialContext is Dial aborted when ctx is done.
+func (this *Dialer) DialContext(ctx context.Context, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := this.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	return this.race(ctx, orderAddrs(ips, this.PreferIPv6), port)
+}
+
+func (this *Dialer) lookup(ctx context.Context, host string) ([]net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+	if this.LookupIP != nil {
+		return this.LookupIP(ctx, host)
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+func (this *Dialer) race(ctx context.Context, ips []net.IP, port string) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, errNoAddress
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := &net.Dialer{Timeout: this.Timeout}
+	results := make(chan dialResult, len(ips))
+	// fires FallbackDelay after the last attempt started, while addresses are left
+	fallback := time.NewTimer(this.FallbackDelay)
+	defer fallback.Stop()
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), port)
+		next++
+		pending++
+		go func() {
+			conn, err := d.DialContext(ctx, "tcp", addr)
+			results <- dialResult{conn, err}
+		}()
+
+		if !fallback.Stop() {
+			select {
+			case <-fallback.C:
+			default:
+			}
+		}
+		if next < len(ips) {
+			fallback.Reset(this.FallbackDelay)
+		}
+	}
+
+	var firstErr error
+	start()
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// close the connections of the losers
+				go func(n int) {
+					for i := 0; i < n; i++ {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			}
+		case <-fallback.C:
+			start()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return nil, firstErr
+}
+
+// orderAddrs interleaves the address families, starting with the preferred one.
+func orderAddrs(ips []net.IP, preferIPv6 bool) []net.IP {
+	v4, v6 := []net.IP{}, []net.IP{}
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	first, second := v4, v6
+	if preferIPv6 {
+		first, second = v6, v4
+	}
+	ordered := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			ordered = append(ordered, first[i])
+		}
+		if i < len(second) {
+			ordered = append(ordered, second[i])
+		}
+	}
+	return ordered
+}
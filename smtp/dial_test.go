@@ -0,0 +1,84 @@
+package smtp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestOrderAddrs(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3"),
+		net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2"),
+	}
+	expect := map[bool]string{
+		false: "[192.0.2.1 2001:db8::1 192.0.2.2 2001:db8::2 192.0.2.3]",
+		true:  "[2001:db8::1 192.0.2.1 2001:db8::2 192.0.2.2 192.0.2.3]",
+	}
+	for prefer, s := range expect {
+		if got := orderAddrs(ips, prefer); fmtIPs(got) != s {
+			t.Errorf("prefer ipv6 %v: expect %s, get %s", prefer, s, fmtIPs(got))
+		}
+	}
+}
+
+func fmtIPs(ips []net.IP) string {
+	s := "["
+	for i, ip := range ips {
+		if i != 0 {
+			s += " "
+		}
+		s += ip.String()
+	}
+	return s + "]"
+}
+
+func TestDialFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	d := &Dialer{
+		LookupIP: func(ctx context.Context, host string) ([]net.IP, error) {
+			// an unreachable test address first
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}, nil
+		},
+		Timeout:       5 * time.Second,
+		FallbackDelay: 50 * time.Millisecond,
+	}
+	start := time.Now()
+	conn, err := d.Dial(net.JoinHostPort("mx.example.com", port))
+	if err != nil {
+		t.Fatal("dial: ", err)
+	}
+	defer conn.Close()
+	if host, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); host != "127.0.0.1" {
+		t.Errorf("expect 127.0.0.1, get %s", conn.RemoteAddr())
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("expect the fallback not to wait for the timeout, took %s", time.Since(start))
+	}
+
+	d.LookupIP = func(ctx context.Context, host string) ([]net.IP, error) { return nil, ctx.Err() }
+	if _, err := d.Dial("mx.example.com:25"); err != errNoAddress {
+		t.Errorf("expect %v, get %v", errNoAddress, err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := d.DialContext(ctx, "mx.example.com:25"); err != context.Canceled {
+		t.Errorf("expect the lookup to get the context, get %v", err)
+	}
+}
@@ -0,0 +1,304 @@
+package smtp
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const bdatChunkSize = 1 << 20
+
+var (
+	// ErrSizeExceeded is returned before MAIL FROM when the message is larger than the SIZE of the server.
+	ErrSizeExceeded = fmt.Errorf("smtp: message exceeds the SIZE of the server")
+	// ErrNoSmtpUtf8 is returned when the addresses are internationalized and the server lacks SMTPUTF8.
+	ErrNoSmtpUtf8 = fmt.Errorf("smtp: server does not support SMTPUTF8 for the internationalized addresses")
+	// ErrNo8BitMime is returned when the message has 8-bit bytes and the server lacks 8BITMIME, RFC 6152.
+	ErrNo8BitMime = fmt.Errorf("smtp: server does not support 8BITMIME for the 8-bit message")
+)
+
+// Extensions are the ESMTP extensions of an EHLO reply, keyword to parameters.
+type Extensions map[string]string
+
+func (this Extensions) Has(name string) bool {
+	_, ok := this[strings.ToUpper(name)]
+	return ok
+}
+
+// Size returns the maximum message size of RFC 1870, 0 if the server has no limit.
+func (this Extensions) Size() int64 {
+	size, _ := strconv.ParseInt(this["SIZE"], 10, 64)
+	return size
+}
+
+// Auth returns the SASL mechanisms of RFC 4954.
+func (this Extensions) Auth() []string {
+	return strings.Fields(this["AUTH"])
+}
+
+func parseExtensions(lines []string) Extensions {
+	ext := Extensions{}
+	for _, line := range lines {
+		fields := strings.SplitN(line, " ", 2)
+		value := ""
+		if len(fields) == 2 {
+			value = fields[1]
+		}
+		ext[strings.ToUpper(fields[0])] = value
+	}
+	return ext
+}
+
+// Envelope is the MAIL FROM and RCPT TO of a transaction.
+// The DSN parameters of RFC 3461 are sent if the server supports them.
+type Envelope struct {
+	From string
+	To   []string
+	// FULL or HDRS
+	Ret   string
+	EnvId string
+	// NEVER, or some of SUCCESS, FAILURE and DELAY
+	Notify []string
+}
+
+// Send makes a transaction, using the extensions of the server:
+// SIZE is declared and checked, BODY=8BITMIME and SMTPUTF8 are set when the message
+// or the addresses need them, the commands are pipelined with PIPELINING and the
+// message is sent with BDAT if the server has CHUNKING.
+// The line endings of the message are made CRLF.
+// The recipients rejected at RCPT TO are returned as RcptErrors, with the error
+// of the message for the accepted ones if it failed.
+func (this *Client) Send(env *Envelope, msg []byte) error {
+	msg = crlf(msg)
+	mail, err := this.mailCommand(env, msg)
+	if err != nil {
+		return err
+	}
+	rcpts := make([]string, len(env.To))
+	for i, to := range env.To {
+		rcpts[i] = this.rcptCommand(env, to)
+	}
+
+	var rcptErrs []error
+	if this.ext.Has("PIPELINING") {
+		rcptErrs, err = this.pipeline(mail, rcpts)
+	} else {
+		if _, err = this.cmd(this.timeouts.Mail, 2, "%s", mail); err == nil {
+			for _, rcpt := range rcpts {
+				_, rerr := this.cmd(this.timeouts.Rcpt, 2, "%s", rcpt)
+				rcptErrs = append(rcptErrs, rerr)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	rejected := RcptErrors{}
+	for i, rerr := range rcptErrs {
+		if rerr == nil {
+			continue
+		}
+		if _, ok := rerr.(*Reply); !ok {
+			return rerr
+		}
+		rejected[env.To[i]] = rerr
+	}
+	if len(rejected) != 0 && len(rejected) == len(env.To) {
+		if err := this.Reset(); err != nil {
+			return err
+		}
+		return rejected
+	}
+
+	if this.ext.Has("CHUNKING") {
+		err = this.bdat(msg)
+	} else {
+		err = this.data(msg)
+	}
+	if err != nil && len(rejected) == 0 {
+		return err
+	}
+	if err != nil {
+		// the accepted recipients get the error, the rejections are kept
+		for _, to := range env.To {
+			if rejected[to] == nil {
+				rejected[to] = err
+			}
+		}
+	}
+	if len(rejected) != 0 {
+		return rejected
+	}
+	return nil
+}
+
+// sessionError returns the error of Send telling the state of the session: nil when the
+// server replied to everything, e.g. with rejections at RCPT TO, or the error which ended it.
+func sessionError(err error) error {
+	rejected, ok := err.(RcptErrors)
+	if !ok {
+		return err
+	}
+	for _, rerr := range rejected {
+		if _, ok := rerr.(*Reply); !ok {
+			return rerr
+		}
+	}
+	return nil
+}
+
+func (this *Client) mailCommand(env *Envelope, msg []byte) (string, error) {
+	cmd := "MAIL FROM:<" + env.From + ">"
+	if this.ext.Has("SIZE") {
+		if max := this.ext.Size(); max > 0 && int64(len(msg)) > max {
+			return "", ErrSizeExceeded
+		}
+		cmd += " SIZE=" + strconv.Itoa(len(msg))
+	}
+	if !isASCII(msg) {
+		if !this.ext.Has("8BITMIME") {
+			return "", ErrNo8BitMime
+		}
+		cmd += " BODY=8BITMIME"
+	}
+	if !isASCII([]byte(env.From + strings.Join(env.To, ""))) {
+		if !this.ext.Has("SMTPUTF8") {
+			return "", ErrNoSmtpUtf8
+		}
+		cmd += " SMTPUTF8"
+	}
+	if this.ext.Has("DSN") {
+		if env.Ret != "" {
+			cmd += " RET=" + env.Ret
+		}
+		if env.EnvId != "" {
+			cmd += " ENVID=" + xtext(env.EnvId)
+		}
+	}
+	return cmd, nil
+}
+
+func (this *Client) rcptCommand(env *Envelope, to string) string {
+	cmd := "RCPT TO:<" + to + ">"
+	if this.ext.Has("DSN") && len(env.Notify) != 0 {
+		cmd += " NOTIFY=" + strings.Join(env.Notify, ",") + " ORCPT=rfc822;" + xtext(to)
+	}
+	return cmd
+}
+
+// pipeline sends MAIL and the RCPTs at once, RFC 2920, and reads their replies.
+func (this *Client) pipeline(mail string, rcpts []string) ([]error, error) {
+	this.setDeadline(this.timeouts.Mail)
+	w := this.text.W
+	fmt.Fprintf(w, "%s\r\n", mail)
+	for _, rcpt := range rcpts {
+		fmt.Fprintf(w, "%s\r\n", rcpt)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, this.ioError(err)
+	}
+
+	_, mailErr := this.read(this.timeouts.Mail, 2)
+	if _, ok := mailErr.(*Reply); mailErr != nil && !ok {
+		return nil, mailErr
+	}
+	rcptErrs := make([]error, len(rcpts))
+	for i := range rcpts {
+		_, err := this.read(this.timeouts.Rcpt, 2)
+		if _, ok := err.(*Reply); err != nil && !ok {
+			return nil, err
+		}
+		rcptErrs[i] = err
+	}
+	return rcptErrs, mailErr
+}
+
+func (this *Client) data(msg []byte) error {
+	w, err := this.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// bdat sends the message in chunks, RFC 3030. The message is sent as is, without dot-stuffing.
+func (this *Client) bdat(msg []byte) error {
+	for off := 0; ; {
+		end := off + bdatChunkSize
+		if end > len(msg) {
+			end = len(msg)
+		}
+		last := ""
+		timeout := this.timeouts.DataBlock
+		if end == len(msg) {
+			last = " LAST"
+			timeout = this.timeouts.DataTerm
+		}
+
+		this.setDeadline(this.timeouts.DataBlock)
+		fmt.Fprintf(this.text.W, "BDAT %d%s\r\n", end-off, last)
+		this.text.W.Write(msg[off:end])
+		if err := this.text.W.Flush(); err != nil {
+			return this.ioError(err)
+		}
+		if _, err := this.read(timeout, 2); err != nil {
+			return err
+		}
+		if last != "" {
+			return nil
+		}
+		off = end
+	}
+}
+
+// crlf turns the bare LFs into CRLF and ends the message with CRLF, as the DotWriter of DATA does.
+func crlf(msg []byte) []byte {
+	n := 0
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			n++
+		}
+	}
+	if n == 0 && (len(msg) == 0 || bytes.HasSuffix(msg, []byte("\r\n"))) {
+		return msg
+	}
+	out := make([]byte, 0, len(msg)+n+2)
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	if len(out) != 0 && !bytes.HasSuffix(out, []byte("\r\n")) {
+		out = append(out, '\r', '\n')
+	}
+	return out
+}
+
+func isASCII(b []byte) bool {
+	for _, c := range b {
+		if c >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// xtext encodes a DSN parameter, RFC 3461 section 4.
+func xtext(s string) string {
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '+' || c == '=' {
+			buf = append(buf, fmt.Sprintf("+%02X", c)...)
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return string(buf)
+}
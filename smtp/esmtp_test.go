@@ -0,0 +1,205 @@
+package smtp
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// serveEsmtp advertises ext and records the commands of a session,
+// the bodies of DATA and BDAT are recorded as one line. RCPT to reject gets 550,
+// and a body with an X-Reject header 554.
+func serveEsmtp(t *testing.T, ext []string, reject string) (string, func() []string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+	lock := sync.Mutex{}
+	lines := []string{}
+	record := func(line string) {
+		lock.Lock()
+		lines = append(lines, line)
+		lock.Unlock()
+	}
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := textproto.NewConn(conn)
+		c.PrintfLine("220 test ESMTP")
+		for {
+			line, err := c.ReadLine()
+			if err != nil {
+				return
+			}
+			record(line)
+			fields := strings.Fields(line)
+			switch strings.ToUpper(fields[0]) {
+			case "EHLO":
+				reply := "250-test"
+				for _, e := range ext {
+					reply += "\r\n250-" + e
+				}
+				c.PrintfLine("%s\r\n250 HELP", reply)
+			case "RCPT":
+				if strings.Contains(line, "<"+reject+">") {
+					c.PrintfLine("550 5.1.1 unknown")
+				} else {
+					c.PrintfLine("250 OK")
+				}
+			case "DATA":
+				c.PrintfLine("354 go ahead")
+				body, err := c.ReadDotBytes()
+				if err != nil {
+					return
+				}
+				record(string(body))
+				if strings.Contains(string(body), "X-Reject:") {
+					c.PrintfLine("554 5.6.0 rejected")
+				} else {
+					c.PrintfLine("250 queued")
+				}
+			case "BDAT":
+				n, _ := strconv.Atoi(fields[1])
+				body := make([]byte, n)
+				if _, err := io.ReadFull(c.R, body); err != nil {
+					return
+				}
+				record(string(body))
+				c.PrintfLine("250 received")
+			case "QUIT":
+				c.PrintfLine("221 bye")
+				return
+			default:
+				c.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	recorded := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string{}, lines...)
+	}
+	return l.Addr().String(), recorded, func() { l.Close() }
+}
+
+func TestSendExtensions(t *testing.T) {
+	addr, recorded, stop := serveEsmtp(t, []string{"PIPELINING", "SIZE 1000", "8BITMIME", "SMTPUTF8", "DSN", "CHUNKING"}, "c@example.com")
+	defer stop()
+
+	msg := []byte("Subject: caf\xc3\xa9\r\n\r\nbody\r\n")
+	env := &Envelope{
+		From:   "a@dtynn.me",
+		To:     []string{"b@exämple.com", "c@example.com"},
+		Ret:    "HDRS",
+		EnvId:  "id=1",
+		Notify: []string{"FAILURE", "DELAY"},
+	}
+	_, err := SendEnvelopeContext(context.Background(), nil, addr, "local", env, msg, nil)
+	rejected, ok := err.(RcptErrors)
+	if !ok || len(rejected) != 1 || rejected["c@example.com"] == nil {
+		t.Fatalf("expect c@example.com rejected, get %v", err)
+	}
+
+	expect := []string{
+		"EHLO local",
+		"MAIL FROM:<a@dtynn.me> SIZE=" + strconv.Itoa(len(msg)) + " BODY=8BITMIME SMTPUTF8 RET=HDRS ENVID=id+3D1",
+		"RCPT TO:<b@exämple.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;b@ex+C3+A4mple.com",
+		"RCPT TO:<c@example.com> NOTIFY=FAILURE,DELAY ORCPT=rfc822;c@example.com",
+		"BDAT " + strconv.Itoa(len(msg)) + " LAST",
+		string(msg),
+		"QUIT",
+	}
+	lines := recorded()
+	if strings.Join(lines, "\n") != strings.Join(expect, "\n") {
+		t.Errorf("unexpected session\n%s\nexpect\n%s", strings.Join(lines, "\n"), strings.Join(expect, "\n"))
+	}
+}
+
+func TestSendDataRejected(t *testing.T) {
+	addr, _, stop := serveEsmtp(t, nil, "c@example.com")
+	defer stop()
+
+	env := &Envelope{From: "a@dtynn.me", To: []string{"b@example.com", "c@example.com"}}
+	_, err := SendEnvelopeContext(context.Background(), nil, addr, "local", env, []byte("X-Reject: yes\r\n\r\nbody\r\n"), nil)
+	errs, ok := err.(RcptErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expect the errors of both recipients, get %v", err)
+	}
+	if reply, ok := errs["c@example.com"].(*Reply); !ok || reply.Code != 550 {
+		t.Errorf("expect the rejection of c@example.com kept, get %v", errs["c@example.com"])
+	}
+	if reply, ok := errs["b@example.com"].(*Reply); !ok || reply.Code != 554 {
+		t.Errorf("expect the DATA error for b@example.com, get %v", errs["b@example.com"])
+	}
+}
+
+func TestSendPlain(t *testing.T) {
+	addr, recorded, stop := serveEsmtp(t, nil, "")
+	defer stop()
+
+	env := &Envelope{From: "a@dtynn.me", To: []string{"b@example.com"}, Ret: "FULL", Notify: []string{"NEVER"}}
+	if _, err := SendEnvelopeContext(context.Background(), nil, addr, "local", env, []byte("Subject: x\r\n\r\nbody\r\n"), nil); err != nil {
+		t.Fatal("send: ", err)
+	}
+	lines := recorded()
+	if len(lines) != 6 || lines[1] != "MAIL FROM:<a@dtynn.me>" || lines[2] != "RCPT TO:<b@example.com>" || lines[3] != "DATA" {
+		t.Errorf("expect no extension parameters, get %q", lines)
+	}
+}
+
+func TestSendPrecheck(t *testing.T) {
+	addr, recorded, stop := serveEsmtp(t, []string{"SIZE 10"}, "")
+	defer stop()
+
+	_, err := SendMailContext(context.Background(), nil, addr, "local", "a@dtynn.me", []string{"b@example.com"}, []byte("Subject: too large\r\n\r\n"), nil)
+	if err != ErrSizeExceeded {
+		t.Errorf("expect size exceeded, get %v", err)
+	}
+	if lines := recorded(); len(lines) != 1 {
+		t.Errorf("expect no MAIL, get %q", lines)
+	}
+
+	addr, _, stop = serveEsmtp(t, nil, "")
+	defer stop()
+	_, err = SendMailContext(context.Background(), nil, addr, "local", "a@dtynn.me", []string{"b@exämple.com"}, nil, nil)
+	if err != ErrNoSmtpUtf8 {
+		t.Errorf("expect no smtputf8, get %v", err)
+	}
+
+	addr, _, stop = serveEsmtp(t, nil, "")
+	defer stop()
+	_, err = SendMailContext(context.Background(), nil, addr, "local", "a@dtynn.me", []string{"b@example.com"}, []byte("Subject: caf\xc3\xa9\r\n\r\n"), nil)
+	if err != ErrNo8BitMime {
+		t.Errorf("expect no 8bitmime, get %v", err)
+	}
+}
+
+func TestSendLineEndings(t *testing.T) {
+	for _, ext := range [][]string{nil, {"CHUNKING"}} {
+		addr, recorded, stop := serveEsmtp(t, ext, "")
+		_, err := SendMailContext(context.Background(), nil, addr, "local", "a@dtynn.me", []string{"b@example.com"}, []byte("Subject: x\n\nbare\nlines"), nil)
+		stop()
+		if err != nil {
+			t.Fatalf("%v: send: %s", ext, err)
+		}
+		lines := recorded()
+		// DotBytes of DATA reads the lines without their CR
+		expect := "Subject: x\r\n\r\nbare\r\nlines\r\n"
+		if ext == nil {
+			expect = "Subject: x\n\nbare\nlines\n"
+		}
+		if len(lines) < 5 || lines[4] != expect {
+			t.Errorf("%v: expect the body %q, get %q", ext, expect, lines)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package smtp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// how long a discarded connection waits for the reply to QUIT
+const quitTimeout = 5 * time.Second
+
+var errPoolClosed = fmt.Errorf("smtp: pool closed")
+
+type PoolConfig struct {
+	// idle connections kept per host
+	MaxIdle int
+	// transactions per connection before it is closed, 0 for no limit
+	MaxMessages int
+	// idle connections are closed after IdleTimeout
+	IdleTimeout time.Duration
+	// DefaultDialer if nil
+	Dialer *Dialer
+}
+
+func DefaultPoolConfig() *PoolConfig {
+	return &PoolConfig{
+		MaxIdle:     4,
+		MaxMessages: 100,
+		IdleTimeout: 30 * time.Second,
+	}
+}
+
+type pooledConn struct {
+	c        *Client
+	session  *Session
+	messages int
+	lastUsed time.Time
+}
+
+// Pool keeps the sessions to a host open after a transaction and reuses them,
+// sending RSET before the next one. A connection failing RSET is dead and replaced.
+// Sessions are keyed by address, greeting name and tls policy.
+type Pool struct {
+	conf *PoolConfig
+	now  func() time.Time
+
+	lock   sync.Mutex
+	idle   map[string][]*pooledConn
+	closed bool
+	stop   chan struct{}
+}
+
+func NewPool(conf *PoolConfig) *Pool {
+	if conf == nil {
+		conf = DefaultPoolConfig()
+	}
+	p := &Pool{
+		conf: conf,
+		now:  time.Now,
+		idle: map[string][]*pooledConn{},
+		stop: make(chan struct{}),
+	}
+	if conf.IdleTimeout > 0 {
+		go p.janitor()
+	}
+	return p
+}
+
+// SendEmail is SendMailContext without a context.
+func (this *Pool) SendEmail(addr, local, from string, to []string, msg []byte, tlsConfig *tls.Config) (string, error) {
+	return this.SendMailContext(context.Background(), addr, local, from, to, msg, tlsConfig)
+}
+
+// SendMailContext is SendMailContext over a pooled connection.
+func (this *Pool) SendMailContext(ctx context.Context, addr, local, from string, to []string, msg []byte, tlsConfig *tls.Config) (string, error) {
+	session, err := this.SendEnvelopeContext(ctx, addr, local, &Envelope{From: from, To: to}, msg, opportunistic(tlsConfig))
+	return session.Remote, err
+}
+
+// SendEnvelopeContext is SendEnvelopeContext over a pooled connection.
+func (this *Pool) SendEnvelopeContext(ctx context.Context, addr, local string, env *Envelope, msg []byte, policy *TlsPolicy) (*Session, error) {
+	key := addr + "|" + local + "|" + policy.key()
+	pc, err := this.get(ctx, key)
+	if err != nil {
+		return &Session{}, err
+	}
+	if pc == nil {
+		c, session, err := dial(ctx, this.conf.Dialer, addr, local, policy)
+		if err != nil {
+			return session, err
+		}
+		pc = &pooledConn{c: c, session: session}
+	}
+
+	release := pc.c.bind(ctx)
+	err = pc.c.Send(env, msg)
+	release()
+	if err == ErrSizeExceeded || err == ErrNoSmtpUtf8 || err == ErrNo8BitMime {
+		// refused before any command was sent
+		this.put(key, pc)
+		return pc.session, err
+	}
+	pc.messages++
+	switch sessionError(err).(type) {
+	case nil:
+		this.put(key, pc)
+	case *Reply:
+		// the server refused the transaction but the session is fine
+		release := pc.c.bind(ctx)
+		rerr := pc.c.Reset()
+		release()
+		if rerr == nil {
+			this.put(key, pc)
+		} else {
+			pc.c.Close()
+		}
+	default:
+		pc.c.Close()
+	}
+	return pc.session, err
+}
+
+// Close closes the idle connections, later connections are not pooled.
+func (this *Pool) Close() {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return
+	}
+	this.closed = true
+	close(this.stop)
+	idle := this.idle
+	this.idle = map[string][]*pooledConn{}
+	this.lock.Unlock()
+
+	wg := sync.WaitGroup{}
+	for _, conns := range idle {
+		for _, pc := range conns {
+			wg.Add(1)
+			go func(pc *pooledConn) {
+				defer wg.Done()
+				quit(pc)
+			}(pc)
+		}
+	}
+	wg.Wait()
+}
+
+// get returns a live idle connection of key, or nil if there is none.
+func (this *Pool) get(ctx context.Context, key string) (*pooledConn, error) {
+	for {
+		this.lock.Lock()
+		if this.closed {
+			this.lock.Unlock()
+			return nil, errPoolClosed
+		}
+		conns := this.idle[key]
+		if len(conns) == 0 {
+			this.lock.Unlock()
+			return nil, nil
+		}
+		pc := conns[len(conns)-1]
+		this.idle[key] = conns[:len(conns)-1]
+		this.lock.Unlock()
+
+		if this.expired(pc) {
+			go quit(pc)
+			continue
+		}
+		release := pc.c.bind(ctx)
+		err := pc.c.Reset()
+		release()
+		if err != nil {
+			pc.c.Close()
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+		return pc, nil
+	}
+}
+
+func (this *Pool) put(key string, pc *pooledConn) {
+	if this.conf.MaxMessages > 0 && pc.messages >= this.conf.MaxMessages {
+		go quit(pc)
+		return
+	}
+	pc.lastUsed = this.now()
+
+	this.lock.Lock()
+	if this.closed || len(this.idle[key]) >= this.conf.MaxIdle {
+		this.lock.Unlock()
+		go quit(pc)
+		return
+	}
+	this.idle[key] = append(this.idle[key], pc)
+	this.lock.Unlock()
+}
+
+func (this *Pool) expired(pc *pooledConn) bool {
+	return this.conf.IdleTimeout > 0 && this.now().Sub(pc.lastUsed) >= this.conf.IdleTimeout
+}
+
+// janitor closes the expired idle connections, so servers do not time them out first.
+func (this *Pool) janitor() {
+	ticker := time.NewTicker(this.conf.IdleTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-this.stop:
+			return
+		case <-ticker.C:
+		}
+
+		expired := []*pooledConn{}
+		this.lock.Lock()
+		for key, conns := range this.idle {
+			alive := conns[:0]
+			for _, pc := range conns {
+				if this.expired(pc) {
+					expired = append(expired, pc)
+				} else {
+					alive = append(alive, pc)
+				}
+			}
+			if len(alive) == 0 {
+				delete(this.idle, key)
+			} else {
+				this.idle[key] = alive
+			}
+		}
+		this.lock.Unlock()
+
+		for _, pc := range expired {
+			go quit(pc)
+		}
+	}
+}
+
+// quit ends the session of a discarded connection, waiting for the reply at most quitTimeout.
+// It is run in its own goroutine not to hold up the transactions.
+func quit(pc *pooledConn) {
+	ctx, cancel := context.WithTimeout(context.Background(), quitTimeout)
+	defer cancel()
+	release := pc.c.bind(ctx)
+	pc.c.Quit()
+	release()
+}
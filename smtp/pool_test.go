@@ -0,0 +1,59 @@
+package smtp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPoolQuit(t *testing.T) {
+	// QUIT is never answered
+	script := map[string]string{}
+	for verb, reply := range okScript {
+		if verb != "QUIT" {
+			script[verb] = reply
+		}
+	}
+	addr, stop := serveScript(t, "220 test ESMTP", script)
+	defer stop()
+
+	pool := NewPool(&PoolConfig{MaxIdle: 1, MaxMessages: 1})
+	env := &Envelope{From: "a@dtynn.me", To: []string{"b@example.com"}}
+	start := time.Now()
+	if _, err := pool.SendEnvelopeContext(context.Background(), addr, "local", env, []byte("Subject: x\r\n\r\n"), nil); err != nil {
+		t.Fatal("send: ", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect the discarded connection not to hold up the send, took %s", elapsed)
+	}
+	pool.Close()
+}
+
+func TestPoolResetContext(t *testing.T) {
+	// RSET is never answered
+	script := map[string]string{}
+	for verb, reply := range okScript {
+		if verb != "RSET" {
+			script[verb] = reply
+		}
+	}
+	addr, stop := serveScript(t, "220 test ESMTP", script)
+	defer stop()
+
+	pool := NewPool(&PoolConfig{MaxIdle: 1})
+	defer pool.Close()
+	env := &Envelope{From: "a@dtynn.me", To: []string{"b@example.com"}}
+	if _, err := pool.SendEnvelopeContext(context.Background(), addr, "local", env, []byte("Subject: x\r\n\r\n"), nil); err != nil {
+		t.Fatal("send: ", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := pool.SendEnvelopeContext(ctx, addr, "local", env, []byte("Subject: x\r\n\r\n"), nil); err != context.DeadlineExceeded {
+		t.Errorf("expect the deadline of the caller during RSET, get %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expect the probe bounded by the context, took %s", elapsed)
+	}
+}
@@ -0,0 +1,117 @@
+// Package maildir delivers messages to Maildir++ directories.
+package maildir
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dtynn/dmail/utils"
+	"github.com/qiniu/log"
+)
+
+const (
+	dirMode  os.FileMode = 0700
+	fileMode os.FileMode = 0600
+
+	// marks a Maildir++ folder
+	folderFile = "maildirfolder"
+)
+
+var (
+	subdirs  = []string{"tmp", "new", "cur"}
+	sequence uint64
+)
+
+// Maildir is the path of a maildir.
+type Maildir string
+
+// Folder returns the Maildir++ folder of the maildir, "a/b" is stored as ".a.b".
+// The empty name is the maildir itself (INBOX).
+func (this Maildir) Folder(name string) Maildir {
+	name = strings.Trim(name, "/")
+	if name == "" || strings.EqualFold(name, "INBOX") {
+		return this
+	}
+	return Maildir(filepath.Join(string(this), "."+strings.Replace(name, "/", ".", -1)))
+}
+
+// Create makes the tmp, new and cur directories if missing.
+func (this Maildir) Create() error {
+	for _, sub := range subdirs {
+		if err := os.MkdirAll(filepath.Join(string(this), sub), dirMode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (this Maildir) createFolder() error {
+	if err := this.Create(); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(string(this), folderFile), os.O_WRONLY|os.O_CREATE, fileMode)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// Deliver stores a message as described in https://cr.yp.to/proto/maildir.html:
+// it is written and synced in tmp, then moved to new.
+// The returned key is the file name of the message.
+func (this Maildir) Deliver(data []byte) (string, error) {
+	key := uniqueName(len(data))
+	tmp := filepath.Join(string(this), "tmp", key)
+
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fileMode)
+	if err != nil {
+		return "", err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	newDir := filepath.Join(string(this), "new")
+	if err := os.Rename(tmp, filepath.Join(newDir, key)); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	// the message is delivered once in new, a failed sync must not make the client send it again
+	if err := syncDir(newDir); err != nil {
+		log.Warn("maildir: sync ", newDir, err)
+	}
+	return key, nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// uniqueName returns "<sec>.M<usec>P<pid>Q<seq>R<rand>.<host>,S=<size>".
+func uniqueName(size int) string {
+	now := time.Now()
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	host = strings.Replace(host, "/", `\057`, -1)
+	host = strings.Replace(host, ":", `\072`, -1)
+	return fmt.Sprintf("%d.M%dP%dQ%dR%s.%s,S=%d", now.Unix(), now.Nanosecond()/1000, os.Getpid(),
+		atomic.AddUint64(&sequence, 1), utils.RandString(8), host, size)
+}
@@ -0,0 +1,84 @@
+package maildir
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/dtynn/dmail/dmarc"
+)
+
+func TestReceiver(t *testing.T) {
+	root, err := ioutil.TempDir("", "maildir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	mapper := func(rcpt string) (Maildir, string, error) {
+		i := strings.Index(rcpt, "@")
+		local, folder := rcpt[:i], ""
+		if j := strings.Index(local, "+"); j != -1 {
+			local, folder = local[:j], "Lists/"+local[j+1:]
+		}
+		if local == "nobody" {
+			return "", "", fmt.Errorf("unknown user")
+		}
+		return Maildir(filepath.Join(root, local)), folder, nil
+	}
+
+	r, _ := NewReceiver(mapper).New("id")
+	r.SetEhlo("client.example.com")
+	r.SetFrom("a@example.com")
+	if err := r.AddRcpt("nobody@dtynn.me"); err == nil {
+		t.Error("expect error for unknown user")
+	}
+	r.AddRcpt("bob@dtynn.me")
+	r.AddRcpt("bob+golang@dtynn.me")
+	if err := r.SetData("Subject: hi\r\n\r\nbody\r\n"); err != nil {
+		t.Fatal("set data: ", err)
+	}
+
+	for _, c := range []struct {
+		dir, rcpt string
+	}{
+		{filepath.Join(root, "bob"), "bob@dtynn.me"},
+		{filepath.Join(root, "bob", ".Lists.golang"), "bob+golang@dtynn.me"},
+	} {
+		files, err := ioutil.ReadDir(filepath.Join(c.dir, "new"))
+		if err != nil || len(files) != 1 {
+			t.Fatalf("%s: expect 1 message, get %d %v", c.dir, len(files), err)
+		}
+		if tmp, _ := ioutil.ReadDir(filepath.Join(c.dir, "tmp")); len(tmp) != 0 {
+			t.Errorf("%s: tmp not empty", c.dir)
+		}
+		data, _ := ioutil.ReadFile(filepath.Join(c.dir, "new", files[0].Name()))
+		expect := "Return-Path: <a@example.com>\r\nDelivered-To: " + c.rcpt + "\r\nSubject: hi\r\n\r\nbody\r\n"
+		if string(data) != expect {
+			t.Errorf("%s: unexpected message %q", c.dir, data)
+		}
+		if !strings.HasSuffix(files[0].Name(), fmt.Sprintf(",S=%d", len(expect))) {
+			t.Errorf("%s: unexpected name %s", c.dir, files[0].Name())
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "bob", ".Lists.golang", folderFile)); err != nil {
+		t.Error("folder not marked: ", err)
+	}
+
+	if err := r.SetData("Subject: again\r\n\r\n"); err != errNoRecipient {
+		t.Errorf("expect %q after delivery, get %v", errNoRecipient, err)
+	}
+
+	r.SetFrom("spoofed@example.com")
+	r.AddRcpt("bob@dtynn.me")
+	r.(*Receiver).SetDmarc(&dmarc.Result{Status: dmarc.StatusFail, Disposition: dmarc.PolicyQuarantine})
+	if err := r.SetData("Subject: spoofed\r\n\r\n"); err != nil {
+		t.Fatal("set data: ", err)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(root, "bob", ".Junk", "new")); len(files) != 1 {
+		t.Errorf("expect the quarantined message in Junk, get %d", len(files))
+	}
+}
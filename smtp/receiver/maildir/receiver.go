@@ -0,0 +1,117 @@
+package maildir
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dtynn/dmail/dmarc"
+	"github.com/dtynn/dmail/smtp/server"
+)
+
+// the folder of the messages quarantined by DMARC
+const junkFolder = "Junk"
+
+var errNoRecipient = fmt.Errorf("no recipient")
+
+// Mapper resolves a recipient to its maildir and the folder to deliver to, "" for INBOX.
+type Mapper func(rcpt string) (dir Maildir, folder string, err error)
+
+// Receiver is a server.Receiver delivering every message to the maildirs of its recipients.
+type Receiver struct {
+	mapper Mapper
+
+	id         string
+	from       string
+	targets    []*target
+	quarantine bool
+}
+
+type target struct {
+	rcpt   string
+	dir    Maildir
+	folder string
+}
+
+// create makes the maildir and the folder if missing.
+func (this *target) create(name string) (Maildir, error) {
+	if err := this.dir.Create(); err != nil {
+		return "", err
+	}
+	folder := this.dir.Folder(name)
+	if folder == this.dir {
+		return folder, nil
+	}
+	return folder, folder.createFolder()
+}
+
+func NewReceiver(mapper Mapper) *Receiver {
+	return &Receiver{mapper: mapper}
+}
+
+func (this *Receiver) New(id string) (server.Receiver, error) {
+	return &Receiver{mapper: this.mapper, id: id}, nil
+}
+
+func (this *Receiver) Reset() error {
+	this.from = ""
+	this.targets = nil
+	this.quarantine = false
+	return nil
+}
+
+func (this *Receiver) SetEhlo(local string) error {
+	return this.Reset()
+}
+
+func (this *Receiver) SetFrom(from string) error {
+	this.Reset()
+	this.from = from
+	return nil
+}
+
+func (this *Receiver) AddRcpt(rcpt string) error {
+	dir, folder, err := this.mapper(rcpt)
+	if err != nil {
+		return err
+	}
+	this.targets = append(this.targets, &target{rcpt, dir, folder})
+	return nil
+}
+
+// SetDmarc makes the message go to the Junk folder if DMARC quarantines it.
+func (this *Receiver) SetDmarc(result *dmarc.Result) error {
+	this.quarantine = result.Quarantine()
+	return nil
+}
+
+// SetData delivers the message with Return-Path and Delivered-To headers
+// to every recipient and fails if any delivery failed.
+func (this *Receiver) SetData(data string) error {
+	if len(this.targets) == 0 {
+		return errNoRecipient
+	}
+
+	errs := []string{}
+	for _, t := range this.targets {
+		folder := t.folder
+		if this.quarantine {
+			folder = junkFolder
+		}
+		dir, err := t.create(folder)
+		if err == nil {
+			_, err = dir.Deliver([]byte("Return-Path: <" + this.from + ">\r\nDelivered-To: " + t.rcpt + "\r\n" + data))
+		}
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", t.rcpt, err))
+		}
+	}
+	this.Reset()
+	if len(errs) != 0 {
+		return fmt.Errorf("maildir delivery: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (this *Receiver) Close() error {
+	return nil
+}
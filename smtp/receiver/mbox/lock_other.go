@@ -0,0 +1,17 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package mbox
+
+import (
+	"os"
+)
+
+// no advisory locking, the file is only opened for appending
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
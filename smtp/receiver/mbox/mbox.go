@@ -0,0 +1,171 @@
+// Package mbox reads and writes mboxrd files.
+package mbox
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const fileMode os.FileMode = 0600
+
+var (
+	fromLinePrefix = []byte("From ")
+	errNoFromLine  = fmt.Errorf("mbox does not start with a From line")
+
+	// the sender of the From line of messages with a null reverse path
+	DefaultSender = "MAILER-DAEMON"
+)
+
+// isQuotedFrom matches ">*From " lines.
+func isQuotedFrom(line []byte) bool {
+	return bytes.HasPrefix(bytes.TrimLeft(line, ">"), fromLinePrefix)
+}
+
+// Writer writes messages in mboxrd format, with LF line endings.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w}
+}
+
+// WriteMessage writes the From line of the envelope sender and time
+// followed by the message with ">*From " lines quoted and a blank line.
+func (this *Writer) WriteMessage(from string, t time.Time, data []byte) error {
+	if from == "" {
+		from = DefaultSender
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "From %s %s\n", from, t.UTC().Format(time.ANSIC))
+
+	data = bytes.Replace(data, []byte("\r\n"), []byte("\n"), -1)
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		line := data
+		if i != -1 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+		if isQuotedFrom(line) {
+			buf.WriteByte('>')
+		}
+		buf.Write(line)
+	}
+	if b := buf.Bytes(); b[len(b)-1] != '\n' {
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+
+	_, err := this.w.Write(buf.Bytes())
+	return err
+}
+
+// Append adds a message to the mbox file at path, creating it if needed.
+// The file is locked while writing.
+func Append(path, from string, t time.Time, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, fileMode)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer unlockFile(f)
+
+	w := bufio.NewWriter(f)
+	if err := NewWriter(w).WriteMessage(from, t, data); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// Message is one message of a mbox.
+type Message struct {
+	From string
+	Date time.Time
+	// the message with CRLF line endings and the quoting removed
+	Data []byte
+}
+
+// Reader iterates the messages of a mboxrd file.
+type Reader struct {
+	r    *bufio.Reader
+	next []byte // the From line of the next message
+	err  error
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Next returns the next message or io.EOF.
+func (this *Reader) Next() (*Message, error) {
+	if this.next == nil && this.err == nil {
+		line, err := this.r.ReadBytes('\n')
+		if len(line) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		if !bytes.HasPrefix(line, fromLinePrefix) {
+			return nil, errNoFromLine
+		}
+		this.next, this.err = line, err
+	}
+	if this.next == nil {
+		return nil, this.err
+	}
+
+	msg := parseFromLine(this.next)
+	this.next = nil
+	buf := new(bytes.Buffer)
+	blank := false
+	for this.err == nil {
+		var line []byte
+		line, this.err = this.r.ReadBytes('\n')
+		if len(line) == 0 {
+			break
+		}
+		if blank && bytes.HasPrefix(line, fromLinePrefix) {
+			this.next = line
+			break
+		}
+		// the blank line before a From line belongs to the mbox
+		if blank {
+			buf.WriteString("\r\n")
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		blank = len(line) == 0
+		if blank {
+			continue
+		}
+		if isQuotedFrom(line) {
+			line = line[1:]
+		}
+		buf.Write(line)
+		buf.WriteString("\r\n")
+	}
+	if this.err != nil && this.err != io.EOF {
+		return nil, this.err
+	}
+	msg.Data = buf.Bytes()
+	return msg, nil
+}
+
+func parseFromLine(line []byte) *Message {
+	fields := strings.SplitN(strings.TrimRight(string(line[len(fromLinePrefix):]), "\r\n"), " ", 2)
+	msg := &Message{From: fields[0]}
+	if len(fields) == 2 {
+		msg.Date, _ = time.Parse(time.ANSIC, strings.TrimSpace(fields[1]))
+	}
+	return msg
+}
@@ -0,0 +1,143 @@
+package mbox
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/dkim"
+)
+
+func TestWriteRead(t *testing.T) {
+	date := time.Date(2014, 11, 25, 10, 0, 0, 0, time.UTC)
+	messages := []*Message{
+		{"a@example.com", date, []byte("Subject: one\r\n\r\nFrom here\r\n>From there\r\n\r\n\r\nend\r\n")},
+		{DefaultSender, date.Add(time.Hour), []byte("Subject: two\r\n\r\n")},
+		{"c@example.com", date, []byte("Subject: three\r\n\r\nno newline")},
+	}
+
+	buf := new(bytes.Buffer)
+	w := NewWriter(buf)
+	for _, m := range messages {
+		from := m.From
+		if from == DefaultSender {
+			from = ""
+		}
+		if err := w.WriteMessage(from, m.Date, m.Data); err != nil {
+			t.Fatal("write: ", err)
+		}
+	}
+
+	expect := "From a@example.com Tue Nov 25 10:00:00 2014\n" +
+		"Subject: one\n\n>From here\n>>From there\n\n\nend\n\n"
+	if !bytes.HasPrefix(buf.Bytes(), []byte(expect)) {
+		t.Errorf("unexpected mbox %q", buf.String())
+	}
+
+	r := NewReader(buf)
+	for i, m := range messages {
+		got, err := r.Next()
+		if err != nil {
+			t.Fatalf("message %d: %s", i, err)
+		}
+		data := m.Data
+		if i == 2 {
+			data = append(data, "\r\n"...)
+		}
+		if got.From != m.From || !got.Date.Equal(m.Date) || !bytes.Equal(got.Data, data) {
+			t.Errorf("message %d: expect %s %s %q, get %s %s %q", i, m.From, m.Date, data, got.From, got.Date, got.Data)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("expect EOF, get %v", err)
+	}
+
+	if _, err := NewReader(bytes.NewBufferString("Subject: x\n")).Next(); err != errNoFromLine {
+		t.Errorf("expect %q, get %v", errNoFromLine, err)
+	}
+}
+
+func TestReceiver(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bob")
+
+	proto := NewReceiver(func(rcpt string) (string, error) { return path, nil })
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, _ := proto.New("id")
+			r.SetFrom("a@example.com")
+			r.AddRcpt("bob@dtynn.me")
+			if err := r.SetData("Subject: hi\r\n\r\nFrom me\r\n"); err != nil {
+				t.Error("set data: ", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	r := NewReader(f)
+	n := 0
+	for {
+		m, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal("read: ", err)
+		}
+		if string(m.Data) != "Delivered-To: bob@dtynn.me\r\nSubject: hi\r\n\r\nFrom me\r\n" || m.From != "a@example.com" {
+			t.Errorf("unexpected message %s %q", m.From, m.Data)
+		}
+		n++
+	}
+	if n != 10 {
+		t.Errorf("expect 10 messages, get %d", n)
+	}
+}
+
+type keyResolver map[string]string
+
+func (this keyResolver) LookupTXT(name string) ([]string, error) {
+	return []string{this[name]}, nil
+}
+
+func TestReadVerify(t *testing.T) {
+	pemBytes, record, err := dkim.GenerateKey(dkim.KeyTypeEd25519)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := []byte("From: a@dtynn.me\r\nSubject: archived\r\n\r\nFrom the archive\r\n  spaces  \r\n")
+	header, err := dkim.SignRaw(raw, dkim.NewDkimConf("dtynn.me", "", "s1", false, pemBytes),
+		&dkim.Options{HeaderCanonicalization: "simple", BodyCanonicalization: "simple"})
+	if err != nil {
+		t.Fatal("sign: ", err)
+	}
+	raw = append([]byte(header.String()+"\r\n"), raw...)
+
+	buf := new(bytes.Buffer)
+	NewWriter(buf).WriteMessage("a@dtynn.me", time.Now(), raw)
+	m, err := NewReader(buf).Next()
+	if err != nil {
+		t.Fatal("read: ", err)
+	}
+	results, err := dkim.NewVerifier(keyResolver{"s1._domainkey.dtynn.me": record}).Verify(m.Data)
+	if err != nil || len(results) != 1 || results[0].Status != dkim.StatusPass {
+		t.Errorf("expect pass, get %v %v", results, err)
+	}
+}
@@ -0,0 +1,85 @@
+package mbox
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dtynn/dmail/smtp/server"
+)
+
+var errNoRecipient = fmt.Errorf("no recipient")
+
+// Mapper resolves a recipient to the path of its mbox file.
+type Mapper func(rcpt string) (path string, err error)
+
+// Receiver is a server.Receiver appending every message to the mbox files of its recipients.
+type Receiver struct {
+	mapper Mapper
+	now    func() time.Time
+
+	id    string
+	from  string
+	rcpts []string
+	paths []string
+}
+
+func NewReceiver(mapper Mapper) *Receiver {
+	return &Receiver{mapper: mapper, now: time.Now}
+}
+
+func (this *Receiver) New(id string) (server.Receiver, error) {
+	return &Receiver{mapper: this.mapper, now: this.now, id: id}, nil
+}
+
+func (this *Receiver) Reset() error {
+	this.from = ""
+	this.rcpts = nil
+	this.paths = nil
+	return nil
+}
+
+func (this *Receiver) SetEhlo(local string) error {
+	return this.Reset()
+}
+
+func (this *Receiver) SetFrom(from string) error {
+	this.Reset()
+	this.from = from
+	return nil
+}
+
+func (this *Receiver) AddRcpt(rcpt string) error {
+	path, err := this.mapper(rcpt)
+	if err != nil {
+		return err
+	}
+	this.rcpts = append(this.rcpts, rcpt)
+	this.paths = append(this.paths, path)
+	return nil
+}
+
+// SetData appends the message with a Delivered-To header to the mbox of every recipient
+// and fails if any delivery failed.
+func (this *Receiver) SetData(data string) error {
+	if len(this.rcpts) == 0 {
+		return errNoRecipient
+	}
+
+	now := this.now()
+	errs := []string{}
+	for i, rcpt := range this.rcpts {
+		if err := Append(this.paths[i], this.from, now, []byte("Delivered-To: "+rcpt+"\r\n"+data)); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %s", rcpt, err))
+		}
+	}
+	this.Reset()
+	if len(errs) != 0 {
+		return fmt.Errorf("mbox delivery: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+func (this *Receiver) Close() error {
+	return nil
+}
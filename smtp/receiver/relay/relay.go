@@ -0,0 +1,209 @@
+// Package relay forwards the messages received by the server through a dmail.Sender.
+package relay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/dtynn/dmail/smtp/server"
+	"github.com/dtynn/dmail/srs"
+)
+
+const (
+	// RFC 5321 section 6.3 loop detection
+	maxReceivedHeaders = 30
+	receivedHeaderName = "Received:"
+)
+
+var (
+	errNoRecipient = fmt.Errorf("no recipient")
+	errMailLoop    = fmt.Errorf("too many hops, mail loop?")
+	errNotQueued   = fmt.Errorf("relay: the sender must queue the messages")
+
+	respRelayDenied = server.NewSmtpResponse(550, "Relaying denied")
+	respBadAddress  = server.NewSmtpResponse(553, "Invalid address")
+	respBadSrs      = server.NewSmtpResponse(550, "Invalid SRS address")
+)
+
+// Sender delivers the relayed messages, see dmail.Sender with a queue.
+// A message is accepted once SendRaw returns, so it must be spooled
+// and the failed recipients bounced rather than returned.
+type Sender interface {
+	SendRaw(from string, to []string, raw []byte) error
+	Queued() bool
+}
+
+// Policy protects from open relaying.
+// Mail to Domains is accepted from anyone, mail to other domains only from
+// Networks or, if Authenticated is set, from authenticated users.
+type Policy struct {
+	Domains       []string
+	Networks      []*net.IPNet
+	Authenticated bool
+}
+
+func (this *Policy) allowDomain(domain string) bool {
+	for _, d := range this.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (this *Policy) allowClient(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range this.Networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Receiver is a server.Receiver relaying every message through a Sender.
+type Receiver struct {
+	hostname string
+	sender   Sender
+	policy   *Policy
+	srs      *srs.Rewriter
+	now      func() time.Time
+
+	id     string
+	client net.IP
+	helo   string
+	user   string
+	from   string
+	rcpts  []string
+}
+
+// NewReceiver fails unless the sender queues the messages. A nil policy relays nothing.
+func NewReceiver(hostname string, sender Sender, policy *Policy) (*Receiver, error) {
+	if !sender.Queued() {
+		return nil, errNotQueued
+	}
+	if policy == nil {
+		policy = &Policy{}
+	}
+	return &Receiver{hostname: hostname, sender: sender, policy: policy, now: time.Now}, nil
+}
+
+func (this *Receiver) New(id string) (server.Receiver, error) {
+	return &Receiver{hostname: this.hostname, sender: this.sender, policy: this.policy, srs: this.srs, now: this.now, id: id}, nil
+}
+
+// SetSrs makes the receiver route bounces to SRS addresses of the rewriter's
+// domain back to the original senders. The domain must be one of the policy's Domains.
+func (this *Receiver) SetSrs(rewriter *srs.Rewriter) {
+	this.srs = rewriter
+}
+
+func (this *Receiver) SetClient(addr net.Addr) error {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		this.client = tcp.IP
+	}
+	return nil
+}
+
+func (this *Receiver) SetUser(user string) error {
+	this.user = user
+	return nil
+}
+
+func (this *Receiver) Reset() error {
+	this.from = ""
+	this.rcpts = nil
+	return nil
+}
+
+func (this *Receiver) SetEhlo(local string) error {
+	this.helo = local
+	return this.Reset()
+}
+
+func (this *Receiver) SetFrom(from string) error {
+	this.Reset()
+	if from != "" && !validAddress(from) {
+		return respBadAddress
+	}
+	this.from = from
+	return nil
+}
+
+func (this *Receiver) AddRcpt(rcpt string) error {
+	if !validAddress(rcpt) {
+		return respBadAddress
+	}
+	if this.srs != nil && this.srs.IsSrs(rcpt) {
+		orig, err := this.srs.Reverse(rcpt)
+		if err != nil {
+			return respBadSrs
+		}
+		this.rcpts = append(this.rcpts, orig)
+		return nil
+	}
+	domain := rcpt[strings.LastIndex(rcpt, "@")+1:]
+	if !this.policy.allowDomain(domain) && !this.policy.allowClient(this.client) &&
+		!(this.policy.Authenticated && this.user != "") {
+		return respRelayDenied
+	}
+	this.rcpts = append(this.rcpts, rcpt)
+	return nil
+}
+
+// SetData adds a Received header and queues the message.
+func (this *Receiver) SetData(data string) error {
+	defer this.Reset()
+	if len(this.rcpts) == 0 {
+		return errNoRecipient
+	}
+	if countReceived(data) >= maxReceivedHeaders {
+		return errMailLoop
+	}
+	raw := []byte(this.received() + data)
+	return this.sender.SendRaw(this.from, this.rcpts, raw)
+}
+
+func (this *Receiver) Close() error {
+	return nil
+}
+
+// received returns the trace header of RFC 5321 section 4.4.
+func (this *Receiver) received() string {
+	client := "unknown"
+	if this.client != nil {
+		client = this.client.String()
+	}
+	with := "ESMTP"
+	if this.user != "" {
+		with = "ESMTPA"
+	}
+	header := fmt.Sprintf("%s from %s ([%s])\r\n\tby %s (dmail) with %s id %s",
+		receivedHeaderName, this.helo, client, this.hostname, with, this.id)
+	if len(this.rcpts) == 1 {
+		header += "\r\n\tfor <" + this.rcpts[0] + ">"
+	}
+	return header + "; " + this.now().Format(time.RFC1123Z) + "\r\n"
+}
+
+func countReceived(data string) int {
+	n := 0
+	for _, line := range strings.Split(data, "\r\n") {
+		if line == "" {
+			break
+		}
+		if len(line) >= len(receivedHeaderName) && strings.EqualFold(line[:len(receivedHeaderName)], receivedHeaderName) {
+			n++
+		}
+	}
+	return n
+}
+
+func validAddress(addr string) bool {
+	i := strings.LastIndex(addr, "@")
+	return i > 0 && i < len(addr)-1 && !strings.ContainsAny(addr, " <>\r\n")
+}
@@ -0,0 +1,209 @@
+package relay
+
+import (
+	"encoding/base64"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/dns"
+	"github.com/dtynn/dmail/smtp/server"
+	"github.com/dtynn/dmail/srs"
+	"github.com/qiniu/log"
+)
+
+type fakeSender struct {
+	from     string
+	to       []string
+	raw      []byte
+	unqueued bool
+}
+
+func (this *fakeSender) Queued() bool {
+	return !this.unqueued
+}
+
+func (this *fakeSender) SendRaw(from string, to []string, raw []byte) error {
+	this.from, this.to, this.raw = from, to, raw
+	return nil
+}
+
+func newTestReceiver(t *testing.T, client string, s Sender) *Receiver {
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	proto, err := NewReceiver("mx.dtynn.me", s, &Policy{
+		Domains:       []string{"dtynn.me"},
+		Networks:      []*net.IPNet{network},
+		Authenticated: true,
+	})
+	if err != nil {
+		t.Fatal("new receiver: ", err)
+	}
+	proto.now = func() time.Time { return time.Date(2014, 11, 25, 10, 0, 0, 0, time.UTC) }
+	r, _ := proto.New("abc")
+	r.(server.ClientReceiver).SetClient(&net.TCPAddr{IP: net.ParseIP(client), Port: 2525})
+	r.SetEhlo("client.example.com")
+	return r.(*Receiver)
+}
+
+func TestRelayPolicy(t *testing.T) {
+	cases := []struct {
+		client, user, rcpt string
+		allowed            bool
+	}{
+		{"198.51.100.1", "", "bob@dtynn.me", true},
+		{"198.51.100.1", "", "bob@DTYNN.ME", true},
+		{"198.51.100.1", "", "bob@example.com", false},
+		{"192.0.2.10", "", "bob@example.com", true},
+		{"198.51.100.1", "alice", "bob@example.com", true},
+		{"192.0.2.10", "", "bob", false},
+	}
+	for _, c := range cases {
+		r := newTestReceiver(t, c.client, &fakeSender{})
+		if c.user != "" {
+			r.SetUser(c.user)
+		}
+		r.SetFrom("a@example.org")
+		if err := r.AddRcpt(c.rcpt); (err == nil) != c.allowed {
+			t.Errorf("%s %q -> %s: expect allowed %v, get %v", c.client, c.user, c.rcpt, c.allowed, err)
+		}
+	}
+}
+
+func TestNewReceiver(t *testing.T) {
+	if _, err := NewReceiver("mx.dtynn.me", &fakeSender{unqueued: true}, &Policy{}); err != errNotQueued {
+		t.Errorf("expect a sender without queue refused, get %v", err)
+	}
+
+	proto, err := NewReceiver("mx.dtynn.me", &fakeSender{}, nil)
+	if err != nil {
+		t.Fatal("new receiver: ", err)
+	}
+	r, _ := proto.New("abc")
+	r.SetFrom("a@example.org")
+	if err := r.AddRcpt("bob@dtynn.me"); err != respRelayDenied {
+		t.Errorf("expect a nil policy to relay nothing, get %v", err)
+	}
+}
+
+func TestRelay(t *testing.T) {
+	s := &fakeSender{}
+	r := newTestReceiver(t, "198.51.100.1", s)
+	if err := r.SetFrom("not an address"); err == nil {
+		t.Error("expect invalid from to be rejected")
+	}
+	r.SetFrom("")
+	r.AddRcpt("bob@dtynn.me")
+	if err := r.SetData("Subject: bounce\r\n\r\nbody\r\n"); err != nil {
+		t.Fatal("set data: ", err)
+	}
+
+	expect := "Received: from client.example.com ([198.51.100.1])\r\n" +
+		"\tby mx.dtynn.me (dmail) with ESMTP id abc\r\n" +
+		"\tfor <bob@dtynn.me>; Tue, 25 Nov 2014 10:00:00 +0000\r\n" +
+		"Subject: bounce\r\n\r\nbody\r\n"
+	if s.from != "" || strings.Join(s.to, ",") != "bob@dtynn.me" || string(s.raw) != expect {
+		t.Errorf("unexpected relay %q %v %q", s.from, s.to, s.raw)
+	}
+
+	r.SetFrom("a@example.org")
+	r.AddRcpt("bob@dtynn.me")
+	if err := r.SetData(strings.Repeat("Received: from x\r\n", maxReceivedHeaders) + "\r\nbody\r\n"); err != errMailLoop {
+		t.Errorf("expect %q, get %v", errMailLoop, err)
+	}
+}
+
+func TestRelaySrsBounce(t *testing.T) {
+	rewriter := srs.NewRewriter("dtynn.me", "secret")
+	srs0, _ := rewriter.Forward("alice@example.com")
+
+	s := &fakeSender{}
+	r := newTestReceiver(t, "198.51.100.1", s)
+	r.SetSrs(rewriter)
+	r.SetFrom("")
+	if err := r.AddRcpt(strings.Replace(srs0, "alice", "mallory", 1)); err != respBadSrs {
+		t.Errorf("expect %s, get %v", respBadSrs, err)
+	}
+	if err := r.AddRcpt(srs0); err != nil {
+		t.Fatal("add srs rcpt: ", err)
+	}
+	if err := r.SetData("Subject: bounce\r\n\r\nbody\r\n"); err != nil {
+		t.Fatal("set data: ", err)
+	}
+	if strings.Join(s.to, ",") != "alice@example.com" {
+		t.Errorf("expect bounce to the original sender, get %v", s.to)
+	}
+}
+
+// spfResolver publishes "v=spf1 -all" for dtynn.me.
+type spfResolver struct{}
+
+func (spfResolver) LookupTXT(name string) ([]string, error) {
+	if name == "dtynn.me" {
+		return []string{"v=spf1 -all"}, nil
+	}
+	return nil, nil
+}
+func (spfResolver) LookupMX(name string) ([]*net.MX, error)  { return nil, nil }
+func (spfResolver) LookupIP(host string) ([]net.IP, error)   { return nil, nil }
+func (spfResolver) LookupAddr(addr string) ([]string, error) { return nil, nil }
+
+func TestRelaySubmissionSpf(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	srv := server.NewServer(&server.Config{
+		Hostname:      "mx.dtynn.me",
+		Addr:          addr,
+		SConf:         &server.SessionConfig{Timeout: 10, CmdSizeLimit: 1024, DataSizeLimit: 1024, CmdLimit: 100},
+		Auth:          func(user, password string) bool { return user == "alice" && password == "secret" },
+		AuthInsecure:  true,
+		Spf:           dns.NewSpfChecker(spfResolver{}, "mx.dtynn.me"),
+		SpfRejectFail: true,
+	}, log.Std)
+	r, err := NewReceiver("mx.dtynn.me", &fakeSender{}, &Policy{Domains: []string{"dtynn.me"}, Authenticated: true})
+	if err != nil {
+		t.Fatal("new receiver: ", err)
+	}
+	srv.RegisterReceiver(r)
+	go srv.Run()
+
+	session := func(auth bool) int {
+		var conn net.Conn
+		for i := 0; i < 50; i++ {
+			if conn, err = net.Dial("tcp", addr); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal("dial: ", err)
+		}
+		defer conn.Close()
+		c := textproto.NewConn(conn)
+		c.ReadResponse(2)
+		c.Cmd("EHLO client.example.com")
+		c.ReadResponse(2)
+		if auth {
+			c.Cmd("AUTH PLAIN %s", base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")))
+			if _, _, err := c.ReadResponse(2); err != nil {
+				t.Fatal("auth: ", err)
+			}
+		}
+		c.Cmd("MAIL FROM:<alice@dtynn.me>")
+		code, _, _ := c.ReadResponse(0)
+		return code
+	}
+
+	if code := session(false); code/100 != 5 {
+		t.Errorf("expect the spf fail rejected, get %d", code)
+	}
+	if code := session(true); code/100 != 2 {
+		t.Errorf("expect authenticated submission accepted, get %d", code)
+	}
+}
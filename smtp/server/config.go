@@ -2,6 +2,9 @@ package server
 
 import (
 	"crypto/tls"
+
+	"github.com/dtynn/dmail/dmarc"
+	"github.com/dtynn/dmail/dns"
 )
 
 type Config struct {
@@ -9,9 +12,30 @@ type Config struct {
 	Addr     string
 	Verbose  bool
 	SConf    *SessionConfig
-	Tls      *tls.Config
+	// Tls enables STARTTLS when set
+	Tls *tls.Config
+
+	// Auth enables AUTH PLAIN, which is only offered after STARTTLS unless AuthInsecure is set
+	Auth         Authenticator
+	AuthInsecure bool
+
+	// Recipients resolves the recipients at RCPT TO when set, e.g. a virtual.Table
+	Recipients RecipientResolver
+
+	// Spf checks the sender at MAIL FROM when set
+	Spf           *dns.SpfChecker
+	SpfRejectFail bool
+
+	// Dmarc evaluates the messages at DATA when set and adds Authentication-Results.
+	// The messages with the reject disposition are refused, see DmarcReceiver for quarantine.
+	Dmarc *dmarc.Evaluator
+	// DmarcReports collects the evaluations into aggregate reports when set
+	DmarcReports *dmarc.Aggregator
 }
 
+// Authenticator checks the credentials of AUTH.
+type Authenticator func(user, password string) bool
+
 type SessionConfig struct {
 	Timeout       int64
 	CmdSizeLimit  int
@@ -1,5 +1,12 @@
 package server
 
+import (
+	"net"
+
+	"github.com/dtynn/dmail/dmarc"
+	"github.com/dtynn/dmail/dns"
+)
+
 type Logger interface {
 	Debug(v ...interface{})
 	Debugf(format string, v ...interface{})
@@ -15,6 +22,9 @@ type Logger interface {
 	Panicf(format string, v ...interface{})
 }
 
+// Receiver gets the commands of a session.
+// An error of AddRcpt rejects the recipient, with the response itself
+// if it is one made by NewSmtpResponse. An error of SetData answers 451.
 type Receiver interface {
 	New(id string) (Receiver, error)
 	Reset() error
@@ -24,3 +34,32 @@ type Receiver interface {
 	SetData(data string) error
 	Close() error
 }
+
+// SpfReceiver is implemented by receivers which want the SPF result
+// of the MAIL FROM identity.
+type SpfReceiver interface {
+	SetSpf(check *dns.SpfCheck) error
+}
+
+// DmarcReceiver is implemented by receivers which want the DMARC result
+// of the message before SetData, e.g. to quarantine it.
+type DmarcReceiver interface {
+	SetDmarc(result *dmarc.Result) error
+}
+
+// ClientReceiver is implemented by receivers which want the address of the client.
+type ClientReceiver interface {
+	SetClient(addr net.Addr) error
+}
+
+// AuthReceiver is implemented by receivers which want the authenticated user.
+type AuthReceiver interface {
+	SetUser(user string) error
+}
+
+// RecipientResolver maps a RCPT TO address to the addresses passed to the receiver.
+// An error rejects the recipient, with the response itself if it is one made by NewSmtpResponse,
+// with 550 if it has a Permanent method returning true, e.g. an unknown user, and with 451 otherwise.
+type RecipientResolver interface {
+	Resolve(rcpt string) ([]string, error)
+}
@@ -5,18 +5,25 @@ import (
 )
 
 const (
-	codeGreeting          = 220
-	codeBye               = 221
-	codeOK                = 250
-	codeRedyForData       = 354
-	codeTimeout           = 420
-	codeTryAgain          = 421
-	codeRequestNotTaken   = 450
-	codeSyntaxErr         = 500
-	codeSyntaxErrInParams = 501
-	codeCmdNotImplemented = 502
-	codeBadSequense       = 503
-	codeAuthenticationErr = 530
+	codeGreeting            = 220
+	codeBye                 = 221
+	codeOK                  = 250
+	codeAuthenticated       = 235
+	codeAuthContinue        = 334
+	codeRedyForData         = 354
+	codeTimeout             = 420
+	codeTryAgain            = 421
+	codeRequestNotTaken     = 450
+	codeLocalError          = 451
+	codeSyntaxErr           = 500
+	codeSyntaxErrInParams   = 501
+	codeCmdNotImplemented   = 502
+	codeBadSequense         = 503
+	codeParamNotImplemented = 504
+	codeAuthenticationErr   = 530
+	codeAuthFailed          = 535
+	codeEncryptionRequired  = 538
+	codeRejected            = 550
 )
 
 var (
@@ -31,8 +38,20 @@ var (
 		codeRedyForData, "End data with <CR><LF>.<CR><LF>")
 	respSizeLimitExceeded = NewSmtpResponse(
 		codeRequestNotTaken, "Size limit exceeded")
-	respClosing = NewSmtpResponse(codeTryAgain, "closing transmission channel")
-	respTimeout = NewSmtpResponse(codeTimeout, "action timeout")
+	respClosing        = NewSmtpResponse(codeTryAgain, "closing transmission channel")
+	respTimeout        = NewSmtpResponse(codeTimeout, "action timeout")
+	respSpfFail        = NewSmtpResponse(codeRejected, "SPF validation failed")
+	respDmarcReject    = NewSmtpResponse(codeRejected, "5.7.1 Rejected by the DMARC policy of the sender")
+	respLocalError     = NewSmtpResponse(codeLocalError, "Requested action aborted: local error in processing")
+	respRcptRejected   = NewSmtpResponse(codeRejected, "Recipient rejected")
+	respUnknownUser    = NewSmtpResponse(codeRejected, "No such user here")
+	respReadyForTls    = NewSmtpResponse(codeGreeting, "Ready to start TLS")
+	respAuthOK         = NewSmtpResponse(codeAuthenticated, "Authentication successful")
+	respAuthFailed     = NewSmtpResponse(codeAuthFailed, "Authentication credentials invalid")
+	respAuthRequireTls = NewSmtpResponse(codeEncryptionRequired, "Must issue a STARTTLS command first")
+	respAuthContinue   = NewSmtpResponse(codeAuthContinue, "")
+	respAuthMechanism  = NewSmtpResponse(codeParamNotImplemented, "Unrecognized authentication type")
+	respAuthCancelled  = NewSmtpResponse(codeSyntaxErrInParams, "Authentication cancelled")
 )
 
 type smtpResponse struct {
@@ -47,3 +66,8 @@ func NewSmtpResponse(code int, detail string) *smtpResponse {
 func (this *smtpResponse) String() string {
 	return fmt.Sprintf("%d %s", this.statusCode, this.detail)
 }
+
+// Error lets receivers reject a command with a response, see Receiver.AddRcpt.
+func (this *smtpResponse) Error() string {
+	return this.String()
+}
@@ -2,11 +2,15 @@ package server
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/dtynn/dmail/dmarc"
+	"github.com/dtynn/dmail/dns"
 	"github.com/dtynn/dmail/utils"
 )
 
@@ -27,6 +31,7 @@ const (
 	cmdRcpt  = "RCPT TO:"
 	cmdData  = "DATA"
 	cmdTLS   = "STARTTLS"
+	cmdAuth  = "AUTH"
 	cmdQuit  = "QUIT"
 	cmdBlank = ""
 )
@@ -36,6 +41,12 @@ var (
 	errTimeout       = fmt.Errorf("timeout")
 
 	ehloString = "250-%s\r\n250-SIZE %d\r\n"
+	tlsString  = "250-STARTTLS\r\n"
+	authString = "250-AUTH PLAIN\r\n"
+
+	authPlain = "PLAIN"
+
+	nullPath = "<>"
 
 	minCmdLimit       = 30
 	minTimeout  int64 = 10
@@ -62,6 +73,9 @@ type session struct {
 	from  string
 	rcpt  []string
 	data  string
+	spf   *dns.SpfCheck
+	tls   bool
+	user  string
 
 	chErr    chan error
 	timer    *time.Timer
@@ -96,6 +110,11 @@ func newSession(id string, l Logger, conn net.Conn, conf *Config) *session {
 
 func (this *session) registerRecevier(r Receiver) {
 	this.receiver = r
+	if cr, ok := r.(ClientReceiver); ok {
+		if err := cr.SetClient(this.conn.RemoteAddr()); err != nil {
+			this.logVerbose("receiver.SetClient", err)
+		}
+	}
 }
 
 func (this *session) handle() error {
@@ -174,7 +193,7 @@ func (this *session) read() (string, error) {
 				return "", errDataSizeLimit
 			}
 		}
-		if strings.HasSuffix(text, suffix) {
+		if strings.HasSuffix(text, suffix) || (this.state == stateWriteData && text == ".\r\n") {
 			break
 		}
 	}
@@ -196,6 +215,9 @@ func (this *session) parseCmd(s string) *command {
 	} else if strings.Index(upper, cmdRcpt) == 0 {
 		cmd.cmd = cmdRcpt
 		cmd.parameter = utils.Strip(s[len(cmdRcpt):])
+	} else if strings.Index(upper, cmdAuth+" ") == 0 {
+		cmd.cmd = cmdAuth
+		cmd.parameter = utils.Strip(s[len(cmdAuth):])
 	} else {
 		cmd.cmd = utils.Strip(upper)
 	}
@@ -300,8 +322,9 @@ func (this *session) handleWaitForFrom() error {
 	case cmdRcpt, cmdData:
 		err = this.sendResp(respBadSequense)
 	case cmdTLS:
-		// todo tls not implemented
-		err = this.sendResp(respNotImplemented)
+		err = this.doCmdStartTls()
+	case cmdAuth:
+		err = this.doCmdAuth(cmd)
 	case cmdQuit:
 		this.state = stateEnded
 	case cmdBlank:
@@ -374,11 +397,29 @@ func (this *session) handleData() error {
 		return err
 	}
 
-	this.data = msg
+	this.data = unstuff(msg)
+	// authenticated submissions are the sender's own mail, as for SPF
+	if this.conf.Dmarc != nil && this.user == "" {
+		result := this.checkDmarc()
+		if result != nil && result.Reject() {
+			this.state = stateEnded
+			return this.sendResp(respDmarcReject)
+		}
+		if r, ok := this.receiver.(DmarcReceiver); ok && result != nil {
+			if err := r.SetDmarc(result); err != nil {
+				this.logVerbose("receiver.SetDmarc", err)
+			}
+		}
+	}
+	if this.spf != nil {
+		this.data = "Received-SPF: " + this.spf.ReceivedSpf(this.conf.Hostname) + "\r\n" + this.data
+	}
 
 	if this.receiver != nil {
 		if err := this.receiver.SetData(this.data); err != nil {
 			this.logVerbose("receiver.SetData", err)
+			this.state = stateEnded
+			return this.sendResp(respLocalError)
 		}
 	}
 
@@ -387,6 +428,21 @@ func (this *session) handleData() error {
 	return err
 }
 
+// unstuff removes the end of data line and the dot stuffing of RFC 5321 section 4.5.2.
+func unstuff(data string) string {
+	data = strings.TrimPrefix(strings.TrimSuffix("\r\n"+data, "\r\n.\r\n"), "\r\n")
+	if data == "" {
+		return data
+	}
+	lines := strings.SplitAfter(data, "\r\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, ".") {
+			lines[i] = line[1:]
+		}
+	}
+	return strings.Join(lines, "") + "\r\n"
+}
+
 func (this *session) doCmdEhlo(cmd *command) error {
 	if len(cmd.parameter) == 0 {
 		return this.sendResp(respSytaxErr)
@@ -395,6 +451,12 @@ func (this *session) doCmdEhlo(cmd *command) error {
 	if cmd.cmd == cmdEhlo {
 		this.writeString(fmt.Sprintf(ehloString,
 			this.conf.Hostname, this.conf.SConf.DataSizeLimit))
+		if this.conf.Tls != nil && !this.tls {
+			this.writeString(tlsString)
+		}
+		if this.conf.Auth != nil && this.user == "" && (this.tls || this.conf.AuthInsecure) {
+			this.writeString(authString)
+		}
 	}
 
 	if this.receiver != nil {
@@ -409,10 +471,19 @@ func (this *session) doCmdEhlo(cmd *command) error {
 
 func (this *session) doCmdFrom(cmd *command) error {
 	mail, match := utils.CutMail(cmd.parameter)
-	if !match {
+	if !match && !strings.HasPrefix(cmd.parameter, nullPath) {
 		return this.sendResp(respSytaxErr)
 	}
 	this.from = mail
+	this.spf = nil
+
+	// authenticated submissions come from the sender's own, often dynamic, address
+	if this.conf.Spf != nil && this.user == "" {
+		this.checkSpf()
+		if this.spf.Result == dns.SpfFail && this.conf.SpfRejectFail {
+			return this.sendResp(respSpfFail)
+		}
+	}
 
 	if this.receiver != nil {
 		if err := this.receiver.SetFrom(this.from); err != nil {
@@ -424,24 +495,181 @@ func (this *session) doCmdFrom(cmd *command) error {
 	return this.ok()
 }
 
+func (this *session) doCmdStartTls() error {
+	if this.conf.Tls == nil || this.tls {
+		return this.sendResp(respNotImplemented)
+	}
+	if err := this.sendResp(respReadyForTls); err != nil {
+		return err
+	}
+
+	conn := tls.Server(this.conn, this.conf.Tls)
+	this.resetTimeout()
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	// anything the client sent before the handshake is discarded
+	this.conn = conn
+	this.in = bufio.NewReader(conn)
+	this.out = bufio.NewWriter(conn)
+	this.tls = true
+	this.local = ""
+	this.state = stateWaitForEhlo
+	this.resetRcpt()
+	return nil
+}
+
+// doCmdAuth handles AUTH PLAIN of RFC 4954 and RFC 4616.
+func (this *session) doCmdAuth(cmd *command) error {
+	if this.conf.Auth == nil {
+		return this.sendResp(respNotImplemented)
+	}
+	if this.user != "" {
+		return this.sendResp(respBadSequense)
+	}
+	if !this.tls && !this.conf.AuthInsecure {
+		return this.sendResp(respAuthRequireTls)
+	}
+
+	pieces := strings.Fields(cmd.parameter)
+	if len(pieces) == 0 || len(pieces) > 2 {
+		return this.sendResp(respSytaxErr)
+	}
+	if strings.ToUpper(pieces[0]) != authPlain {
+		return this.sendResp(respAuthMechanism)
+	}
+
+	response := "="
+	if len(pieces) == 2 {
+		response = pieces[1]
+	} else {
+		if err := this.sendResp(respAuthContinue); err != nil {
+			return err
+		}
+		line, err := this.read()
+		if err != nil {
+			return err
+		}
+		response = utils.Strip(line)
+	}
+	if response == "*" {
+		return this.sendResp(respAuthCancelled)
+	}
+	if response == "=" {
+		response = ""
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		return this.sendResp(respAuthFailed)
+	}
+	// authzid NUL authcid NUL passwd
+	creds := strings.Split(string(decoded), "\x00")
+	if len(creds) != 3 || creds[1] == "" || !this.conf.Auth(creds[1], creds[2]) {
+		this.logVerbose("Id:", this.id, "auth failed")
+		return this.sendResp(respAuthFailed)
+	}
+
+	this.user = creds[1]
+	if r, ok := this.receiver.(AuthReceiver); ok {
+		if err := r.SetUser(this.user); err != nil {
+			this.logVerbose("receiver.SetUser", err)
+		}
+	}
+	return this.sendResp(respAuthOK)
+}
+
+// remoteIP returns the ip of the client, nil if unknown.
+func (this *session) remoteIP() net.IP {
+	if addr, ok := this.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+func (this *session) checkSpf() {
+	this.spf = this.conf.Spf.CheckMailFrom(this.remoteIP(), this.from, this.local)
+	this.logVerbose("Id:", this.id, "spf", this.spf.Result, this.spf.Reason)
+
+	if r, ok := this.receiver.(SpfReceiver); ok {
+		if err := r.SetSpf(this.spf); err != nil {
+			this.logVerbose("receiver.SetSpf", err)
+		}
+	}
+}
+
+// checkDmarc evaluates the message, adds its Authentication-Results
+// and returns the result, nil if it could not be evaluated.
+func (this *session) checkDmarc() *dmarc.Result {
+	result, dkims, err := this.conf.Dmarc.EvaluateMessage([]byte(this.data), this.spf)
+	if err != nil {
+		this.logVerbose("Id:", this.id, "dmarc", err)
+		return nil
+	}
+	this.logVerbose("Id:", this.id, "dmarc", result.Status, result.Disposition)
+	this.data = dmarc.AuthResultsHeader(this.conf.Hostname, this.spf, dkims, result).String() + "\r\n" + this.data
+	if this.conf.DmarcReports != nil {
+		this.conf.DmarcReports.Add(time.Now(), result, this.remoteIP(), this.from, this.spf, dkims)
+	}
+	return result
+}
+
 func (this *session) doCmdRcpt(cmd *command) error {
 	mail, match := utils.CutMail(cmd.parameter)
 	if !match {
 		return this.sendResp(respSytaxErr)
 	}
 
-	this.rcpt = append(this.rcpt, mail)
+	rcpts := []string{mail}
+	if this.conf.Recipients != nil {
+		resolved, err := this.conf.Recipients.Resolve(mail)
+		if err == nil && len(resolved) == 0 {
+			err = respUnknownUser
+		}
+		if err != nil {
+			this.logVerbose("Id:", this.id, "resolve", mail, err)
+			if p, ok := err.(permanent); ok && p.Permanent() {
+				return this.sendResp(respUnknownUser)
+			}
+			return this.sendResp(rejectResponse(err, respLocalError))
+		}
+		rcpts = resolved
+	}
 
-	if this.receiver != nil {
-		if err := this.receiver.AddRcpt(mail); err != nil {
-			this.logVerbose("receiver.AddRcpt", err)
+	// the recipient is accepted if the receiver takes any of its addresses
+	var rejected error
+	accepted := 0
+	for _, rcpt := range rcpts {
+		if this.receiver != nil {
+			if err := this.receiver.AddRcpt(rcpt); err != nil {
+				this.logVerbose("receiver.AddRcpt", err)
+				rejected = err
+				continue
+			}
 		}
+		this.rcpt = append(this.rcpt, rcpt)
+		accepted++
+	}
+	if accepted == 0 {
+		return this.sendResp(rejectResponse(rejected, respRcptRejected))
 	}
 
 	this.state = stateWaitForData
 	return this.ok()
 }
 
+type permanent interface {
+	Permanent() bool
+}
+
+// rejectResponse returns err if it is a response, def otherwise.
+func rejectResponse(err error, def *smtpResponse) *smtpResponse {
+	if resp, ok := err.(*smtpResponse); ok {
+		return resp
+	}
+	return def
+}
+
 func (this *session) cleanup() {
 	this.conn.Close()
 	this.timer.Stop()
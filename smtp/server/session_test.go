@@ -0,0 +1,175 @@
+package server
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dtynn/dmail/dmarc"
+	"github.com/dtynn/dmail/smtp/virtual"
+	"github.com/qiniu/log"
+)
+
+type fakeResolver map[string][]string
+
+func (this fakeResolver) LookupTXT(name string) ([]string, error) {
+	if txts, ok := this[name]; ok {
+		return txts, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// fakeReceiver records the message and the DMARC result it is given.
+type fakeReceiver struct {
+	data  string
+	dmarc *dmarc.Result
+}
+
+func (this *fakeReceiver) New(id string) (Receiver, error)     { return this, nil }
+func (this *fakeReceiver) Reset() error                        { return nil }
+func (this *fakeReceiver) SetEhlo(local string) error          { return nil }
+func (this *fakeReceiver) SetFrom(from string) error           { return nil }
+func (this *fakeReceiver) AddRcpt(rcpt string) error           { return nil }
+func (this *fakeReceiver) SetData(data string) error           { this.data = data; return nil }
+func (this *fakeReceiver) Close() error                        { return nil }
+func (this *fakeReceiver) SetDmarc(result *dmarc.Result) error { this.dmarc = result; return nil }
+
+// dial runs a session of conf and r, the returned wait closes the client and waits for the session to end.
+func dial(t *testing.T, conf *Config, r Receiver) (*textproto.Conn, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		sess := newSession("abc", log.Std, conn, conf)
+		sess.registerRecevier(r)
+		sess.handle()
+	}()
+
+	c, err := textproto.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dial: ", err)
+	}
+	c.ReadResponse(2)
+	c.PrintfLine("EHLO client.example.com")
+	c.ReadResponse(2)
+	return c, func() {
+		c.PrintfLine("QUIT")
+		c.ReadResponse(2)
+		c.Close()
+		<-done
+	}
+}
+
+// transact sends msg in a session of conf and r, and returns the reply to the end of data.
+func transact(t *testing.T, conf *Config, r Receiver, msg string) string {
+	c, wait := dial(t, conf, r)
+	defer wait()
+	for _, cmd := range []string{"MAIL FROM:<a@example.com>", "RCPT TO:<b@dtynn.me>"} {
+		c.PrintfLine("%s", cmd)
+		if _, _, err := c.ReadResponse(2); err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+	}
+	c.PrintfLine("DATA")
+	c.ReadResponse(3)
+	w := c.DotWriter()
+	w.Write([]byte(msg))
+	w.Close()
+	_, reply, err := c.ReadResponse(2)
+	if err != nil {
+		reply = err.Error()
+	}
+	return reply
+}
+
+func TestSessionRecipients(t *testing.T) {
+	table := virtual.NewTable()
+	table.Load(strings.NewReader("domain dtynn.me\nuser bob@dtynn.me\nalias loop@dtynn.me loop@dtynn.me, x@dtynn.me\nalias x@dtynn.me loop@dtynn.me\n"))
+	conf := &Config{
+		Hostname:   "mx.dtynn.me",
+		SConf:      &SessionConfig{CmdSizeLimit: 1024, DataSizeLimit: 1 << 20},
+		Recipients: table,
+	}
+
+	c, wait := dial(t, conf, &fakeReceiver{})
+	defer wait()
+	c.PrintfLine("MAIL FROM:<a@example.com>")
+	c.ReadResponse(2)
+	for _, expect := range []struct {
+		rcpt string
+		code int
+	}{
+		{"bob@dtynn.me", 250},
+		{"nobody@dtynn.me", 550},
+		// a broken table is not the sender's fault
+		{"x@dtynn.me", 451},
+	} {
+		c.PrintfLine("RCPT TO:<%s>", expect.rcpt)
+		if code, _, _ := c.ReadResponse(0); code != expect.code {
+			t.Errorf("%s: expect %d, get %d", expect.rcpt, expect.code, code)
+		}
+	}
+}
+
+func TestSessionDmarc(t *testing.T) {
+	conf := &Config{
+		Hostname: "mx.dtynn.me",
+		SConf:    &SessionConfig{CmdSizeLimit: 1024, DataSizeLimit: 1 << 20},
+		Dmarc: dmarc.NewEvaluator(fakeResolver{
+			"_dmarc.example.org": {"v=DMARC1; p=reject"},
+			"_dmarc.example.net": {"v=DMARC1; p=quarantine"},
+		}),
+	}
+
+	r := &fakeReceiver{}
+	if reply := transact(t, conf, r, "From: a@example.org\r\nSubject: x\r\n\r\nbody\r\n"); !strings.Contains(reply, "DMARC") {
+		t.Errorf("expect the message rejected by dmarc, get %q", reply)
+	}
+	if r.data != "" || r.dmarc != nil {
+		t.Errorf("expect the rejected message not received")
+	}
+
+	reply := transact(t, conf, r, "From: a@example.net\r\nSubject: x\r\n\r\nbody\r\n")
+	if !strings.Contains(reply, "queued") {
+		t.Fatalf("expect the message accepted, get %q", reply)
+	}
+	if r.dmarc == nil || !r.dmarc.Quarantine() {
+		t.Errorf("expect the receiver to get the quarantine, get %v", r.dmarc)
+	}
+	expect := "Authentication-Results: mx.dtynn.me;\r\n\tspf=none;\r\n\tdkim=none;\r\n\tdmarc=fail (p=quarantine dis=quarantine) header.from=example.net\r\nFrom: a@example.net"
+	if !strings.HasPrefix(r.data, expect) {
+		t.Errorf("unexpected message %q", r.data)
+	}
+}
+
+func TestSessionDmarcReports(t *testing.T) {
+	resolver := fakeResolver{"_dmarc.example.org": {"v=DMARC1; p=reject; rua=mailto:dmarc@example.org"}}
+	conf := &Config{
+		Hostname:     "mx.dtynn.me",
+		SConf:        &SessionConfig{CmdSizeLimit: 1024, DataSizeLimit: 1 << 20},
+		Dmarc:        dmarc.NewEvaluator(resolver),
+		DmarcReports: dmarc.NewAggregator("dtynn.me", "postmaster@dtynn.me", resolver),
+	}
+	for i := 0; i < 2; i++ {
+		transact(t, conf, &fakeReceiver{}, "From: a@example.org\r\nSubject: x\r\n\r\nbody\r\n")
+	}
+
+	reports := conf.DmarcReports.Flush(time.Now().Add(48 * time.Hour))
+	if len(reports) != 1 || reports[0].Domain != "example.org" || len(reports[0].Feedback.Records) != 1 {
+		t.Fatalf("expect one report of example.org, get %v", reports)
+	}
+	row := reports[0].Feedback.Records[0].Row
+	if row.Count != 2 || row.SourceIP != "127.0.0.1" || row.PolicyEvaluated.Disposition != dmarc.PolicyReject {
+		t.Errorf("unexpected row %+v", row)
+	}
+}
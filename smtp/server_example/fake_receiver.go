@@ -2,7 +2,6 @@ package main
 
 import (
 	"io/ioutil"
-	"os"
 
 	"github.com/dtynn/dmail/smtp/server"
 	"github.com/dtynn/dmail/utils"
@@ -53,7 +52,7 @@ func (this *faker) SetData(data string) error {
 	this.message.Data = data
 
 	filename := utils.RandString(10)
-	err := ioutil.WriteFile(filename, []byte(data), os.ModeAppend)
+	err := ioutil.WriteFile(filename, []byte(data), 0600)
 	l.Info("output to file", filename, err)
 	return nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"github.com/dtynn/dmail/dns"
 	"github.com/dtynn/dmail/smtp/server"
 
 	"github.com/qiniu/log"
@@ -20,6 +21,7 @@ func main() {
 	cfg.Hostname = "localtest"
 	cfg.Verbose = true
 	cfg.SConf = &scfg
+	cfg.Spf = dns.NewSpfChecker(nil, cfg.Hostname)
 
 	srv := server.NewServer(&cfg, log.Std)
 	srv.RegisterReceiver(&faker{})
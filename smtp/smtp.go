@@ -1,56 +1,131 @@
 package smtp
 
 import (
+	"bytes"
+	"context"
 	"crypto/tls"
-	"net/smtp"
+	"fmt"
+	"net"
+	"strings"
 )
 
 const DefaultPort = 25
 
+// RcptErrors maps the recipients rejected at RCPT TO to the replies.
+// SendEmail returns it when the message was sent to the other recipients,
+// or when every recipient was rejected and no message was sent.
+type RcptErrors map[string]error
+
+func (this RcptErrors) Error() string {
+	buf := bytes.NewBufferString("recipients rejected:")
+	for rcpt, err := range this {
+		buf.WriteString(fmt.Sprintf(" %s: %s;", rcpt, err))
+	}
+	return buf.String()
+}
+
 func SendEmail(addr, local, from string, to []string, msg []byte, tlsConfig *tls.Config) error {
-	c, err := smtp.Dial(addr)
+	_, err := SendMailContext(context.Background(), DefaultDialer, addr, local, from, to, msg, tlsConfig)
+	return err
+}
+
+// SendMailContext is SendEmail connecting with the dialer and aborted when ctx is done.
+// It returns the ip:port the message was delivered to or failed at, "" if none connected.
+// STARTTLS is used with tlsConfig if the server supports it.
+func SendMailContext(ctx context.Context, d *Dialer, addr, local, from string, to []string, msg []byte, tlsConfig *tls.Config) (string, error) {
+	session, err := SendEnvelopeContext(ctx, d, addr, local, &Envelope{From: from, To: to}, msg, opportunistic(tlsConfig))
+	return session.Remote, err
+}
+
+// SendEnvelopeContext is SendMailContext with the DSN parameters of env, connecting
+// as required by policy, plaintext if nil. The session is returned even on errors.
+func SendEnvelopeContext(ctx context.Context, d *Dialer, addr, local string, env *Envelope, msg []byte, policy *TlsPolicy) (*Session, error) {
+	c, session, err := dial(ctx, d, addr, local, policy)
 	if err != nil {
-		return err
+		return session, err
 	}
 
 	defer c.Close()
+	defer c.bind(ctx)()
+
+	err = c.Send(env, msg)
+	if sessionError(err) == nil {
+		c.Quit()
+	}
+	return session, err
+}
+
+func opportunistic(tlsConfig *tls.Config) *TlsPolicy {
+	if tlsConfig == nil {
+		return nil
+	}
+	return &TlsPolicy{Mode: TlsOpportunistic, Config: tlsConfig}
+}
+
+// dial connects, greets and starts tls as required by policy.
+func dial(ctx context.Context, d *Dialer, addr, local string, policy *TlsPolicy) (*Client, *Session, error) {
+	session := &Session{}
+	if d == nil {
+		d = DefaultDialer
+	}
+	conn, err := d.DialContext(ctx, addr)
+	if err != nil {
+		return nil, session, err
+	}
+	session.Remote = conn.RemoteAddr().String()
+
+	c := newClient(conn, d.Timeouts)
+	defer c.bind(ctx)()
+
+	if err := c.greet(); err != nil {
+		c.Close()
+		return nil, session, err
+	}
 
 	if err := c.Hello(local); err != nil {
-		return err
+		c.Close()
+		return nil, session, err
 	}
 
-	if tlsConfig != nil {
-		if ok, _ := c.Extension("STARTTLS"); ok {
-			if err := c.StartTLS(tlsConfig); err != nil {
-				return err
+	if policy != nil && policy.Mode != TlsNone {
+		if err := c.startTls(addr, policy); err != nil {
+			c.Close()
+			if _, ok := err.(*TlsError); ok && !policy.required() {
+				// opportunistic tls falls back to plaintext, RFC 7435
+				return dial(ctx, d, addr, local, nil)
 			}
+			return nil, session, err
 		}
 	}
-
-	if err := c.Mail(from); err != nil {
-		return err
+	if state, ok := c.TLSConnectionState(); ok {
+		session.TlsVersion, session.TlsCipherSuite = state.Version, state.CipherSuite
 	}
+	return c, session, nil
+}
 
-	for _, rcpt := range to {
-		if err := c.Rcpt(rcpt); err != nil {
-			return err
+// startTls upgrades the session if the server supports STARTTLS, or fails with a TlsError
+// if the server does not and tls is required. A failed handshake is a TlsError.
+func (this *Client) startTls(addr string, policy *TlsPolicy) error {
+	if !this.ext.Has("STARTTLS") {
+		if policy.required() {
+			this.Quit()
+			return &TlsError{errNoStartTls}
 		}
+		return nil
 	}
-
-	w, err := c.Data()
+	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
-		return err
+		host = addr
 	}
-
-	_, err = w.Write(msg)
-	if err != nil {
+	err = this.StartTLS(policy.config(strings.TrimSuffix(host, ".")))
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(*Reply); ok || err == context.Canceled || err == context.DeadlineExceeded {
 		return err
 	}
-
-	err = w.Close()
-	if err != nil {
+	if _, ok := err.(net.Error); ok {
 		return err
 	}
-
-	return c.Quit()
+	return &TlsError{err}
 }
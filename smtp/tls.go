@@ -0,0 +1,107 @@
+package smtp
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+type TlsMode int
+
+const (
+	// plaintext, STARTTLS is not used
+	TlsNone TlsMode = iota
+	// STARTTLS if the server advertises it, plaintext otherwise, RFC 7435
+	TlsOpportunistic
+	// STARTTLS or no delivery, the certificate is not verified
+	TlsRequire
+	// STARTTLS with a certificate valid for the verification name, or no delivery
+	TlsVerify
+)
+
+func (this TlsMode) String() string {
+	switch this {
+	case TlsNone:
+		return "none"
+	case TlsOpportunistic:
+		return "opportunistic"
+	case TlsRequire:
+		return "require"
+	case TlsVerify:
+		return "verify"
+	}
+	return fmt.Sprintf("TlsMode(%d)", int(this))
+}
+
+// TlsPolicy is how a destination is connected to.
+type TlsPolicy struct {
+	Mode TlsMode
+	// name the certificate is verified against with TlsVerify, the host connected to if ""
+	VerifyName string
+	// lowest version accepted, e.g. tls.VersionTLS12, the default of crypto/tls if 0
+	MinVersion uint16
+	// base config, e.g. with RootCAs. It is verified as is unless the mode is TlsVerify,
+	// which always verifies
+	Config *tls.Config
+}
+
+// TlsError is returned when the policy of a destination can not be met:
+// STARTTLS is required but not advertised, or the handshake failed.
+type TlsError struct {
+	Err error
+}
+
+func (this *TlsError) Error() string {
+	return "smtp: tls policy not met: " + this.Err.Error()
+}
+
+func (this *TlsPolicy) required() bool {
+	return this.Mode == TlsRequire || this.Mode == TlsVerify
+}
+
+// config returns the tls config of a session with host.
+func (this *TlsPolicy) config(host string) *tls.Config {
+	var config *tls.Config
+	if this.Config != nil {
+		config = this.Config.Clone()
+	} else {
+		config = &tls.Config{InsecureSkipVerify: this.Mode != TlsVerify}
+	}
+	if this.Mode == TlsVerify {
+		config.InsecureSkipVerify = false
+		if this.VerifyName != "" {
+			config.ServerName = this.VerifyName
+		}
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	if this.MinVersion > config.MinVersion {
+		config.MinVersion = this.MinVersion
+	}
+	return config
+}
+
+func (this *TlsPolicy) key() string {
+	if this == nil || this.Mode == TlsNone {
+		return "plain"
+	}
+	// sessions are shared by the policies with the same config, e.g. RootCAs
+	return fmt.Sprintf("%s:%s:%x:%p", this.Mode, this.VerifyName, this.MinVersion, this.Config)
+}
+
+// Session describes the connection a transaction was made on.
+type Session struct {
+	// the ip:port connected to, "" if none connected
+	Remote string
+	// the negotiated tls version and cipher suite, 0 without tls
+	TlsVersion     uint16
+	TlsCipherSuite uint16
+}
+
+// Tls returns the tls version and cipher suite as text, "none" without tls.
+func (this *Session) Tls() string {
+	if this.TlsVersion == 0 {
+		return "none"
+	}
+	return tls.VersionName(this.TlsVersion) + " " + tls.CipherSuiteName(this.TlsCipherSuite)
+}
@@ -0,0 +1,144 @@
+package smtp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveStartTls is a server advertising STARTTLS, with a self-signed certificate of mx.example.com.
+func serveStartTls(t *testing.T) (string, func()) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal("generate key: ", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "mx.example.com"},
+		DNSNames:     []string{"mx.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal("create certificate: ", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("listen: ", err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer func() { conn.Close() }()
+				c := textproto.NewConn(conn)
+				c.PrintfLine("220 test ESMTP")
+				for {
+					line, err := c.ReadLine()
+					if err != nil {
+						return
+					}
+					switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+					case "EHLO":
+						c.PrintfLine("250-test\r\n250 STARTTLS")
+					case "STARTTLS":
+						c.PrintfLine("220 ready")
+						conn = tls.Server(conn, config)
+						c = textproto.NewConn(conn)
+					case "DATA":
+						c.PrintfLine("354 go ahead")
+						if _, err := c.ReadDotBytes(); err != nil {
+							return
+						}
+						c.PrintfLine("250 queued")
+					case "QUIT":
+						c.PrintfLine("221 bye")
+						return
+					default:
+						c.PrintfLine("250 OK")
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String(), func() { l.Close() }
+}
+
+func TestTlsPolicy(t *testing.T) {
+	addr, stop := serveStartTls(t)
+	defer stop()
+	send := func(policy *TlsPolicy) (*Session, error) {
+		env := &Envelope{From: "a@dtynn.me", To: []string{"b@example.com"}}
+		return SendEnvelopeContext(context.Background(), nil, addr, "local", env, []byte("Subject: x\r\n\r\nbody\r\n"), policy)
+	}
+
+	session, err := send(&TlsPolicy{Mode: TlsRequire, MinVersion: tls.VersionTLS12})
+	if err != nil || session.TlsVersion < tls.VersionTLS12 || session.TlsCipherSuite == 0 {
+		t.Errorf("expect a tls delivery, get %s %v", session.Tls(), err)
+	}
+	if _, err = send(&TlsPolicy{Mode: TlsVerify, VerifyName: "mx.example.com"}); err == nil {
+		t.Errorf("expect the self-signed certificate rejected")
+	} else if _, ok := err.(*TlsError); !ok {
+		t.Errorf("expect a tls error, get %v", err)
+	}
+
+	roots := x509.NewCertPool()
+	if _, err = send(&TlsPolicy{Mode: TlsVerify, VerifyName: "mx.example.com", Config: &tls.Config{RootCAs: roots}}); err == nil {
+		t.Errorf("expect the unknown authority rejected")
+	}
+
+	if _, err = send(&TlsPolicy{Mode: TlsVerify, VerifyName: "mx.example.com", Config: &tls.Config{InsecureSkipVerify: true}}); err == nil {
+		t.Errorf("expect verification whatever the config")
+	}
+
+	// a failed handshake is not a reason to defer opportunistic tls
+	session, err = send(&TlsPolicy{Mode: TlsOpportunistic, Config: &tls.Config{RootCAs: roots}})
+	if err != nil || session.Tls() != "none" {
+		t.Errorf("expect a plaintext delivery after the failed handshake, get %s %v", session.Tls(), err)
+	}
+	if _, err = send(&TlsPolicy{Mode: TlsRequire, MinVersion: tls.VersionTLS13, Config: &tls.Config{MaxVersion: tls.VersionTLS12}}); err == nil {
+		t.Errorf("expect the version mismatch to fail required tls")
+	} else if _, ok := err.(*TlsError); !ok {
+		t.Errorf("expect a tls error, get %v", err)
+	}
+
+	plain, stopPlain := serveScript(t, "220 test ESMTP", okScript)
+	defer stopPlain()
+	addr = plain
+	if _, err = send(&TlsPolicy{Mode: TlsRequire}); err == nil {
+		t.Errorf("expect no plaintext delivery when tls is required")
+	} else if _, ok := err.(*TlsError); !ok {
+		t.Errorf("expect a tls error, get %v", err)
+	}
+	session, err = send(&TlsPolicy{Mode: TlsOpportunistic})
+	if err != nil || session.Tls() != "none" {
+		t.Errorf("expect a plaintext delivery, get %s %v", session.Tls(), err)
+	}
+}
+
+func TestTlsPolicyKey(t *testing.T) {
+	a := &TlsPolicy{Mode: TlsVerify, Config: &tls.Config{RootCAs: x509.NewCertPool()}}
+	b := &TlsPolicy{Mode: TlsVerify, Config: &tls.Config{RootCAs: x509.NewCertPool()}}
+	if a.key() == b.key() {
+		t.Errorf("expect policies with other configs not to share sessions, get %s", a.key())
+	}
+	if a.key() != (&TlsPolicy{Mode: TlsVerify, Config: a.Config}).key() {
+		t.Errorf("expect policies with the same config to share sessions")
+	}
+}
@@ -0,0 +1,239 @@
+// Package virtual resolves recipients of virtual domains through users, aliases and catch-alls.
+//
+// The table file has one entry per line, # starts a comment:
+//
+//	domain dtynn.me                          # a virtual domain
+//	domain spam.dtynn.me reject              # every recipient of the domain is rejected
+//	user bob@dtynn.me                        # a mailbox
+//	alias team@dtynn.me bob@dtynn.me, a@example.com
+//	alias @dtynn.me bob@dtynn.me             # catch-all of the domain
+//
+// user+tag@domain resolves like user@domain, the tag is kept when delivering to the user itself.
+package virtual
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	maxAliasDepth = 10
+	tagSeparator  = "+"
+)
+
+var (
+	ErrUnknownUser    error = permanentError("unknown user")
+	ErrDomainRejected error = permanentError("domain rejected")
+	// a broken table, the recipient may resolve once it is fixed
+	errAliasLoop = fmt.Errorf("alias loop")
+)
+
+// permanentError refuses a recipient for good, see server.RecipientResolver.
+type permanentError string
+
+func (this permanentError) Error() string {
+	return string(this)
+}
+
+func (this permanentError) Permanent() bool {
+	return true
+}
+
+type table struct {
+	domains map[string]bool // domain -> rejected
+	users   map[string]bool
+	aliases map[string][]string
+}
+
+func newTable() *table {
+	return &table{map[string]bool{}, map[string]bool{}, map[string][]string{}}
+}
+
+// Table is a hot reloadable recipient table.
+type Table struct {
+	mutex sync.RWMutex
+	t     *table
+}
+
+func NewTable() *Table {
+	return &Table{t: newTable()}
+}
+
+// LoadTable reads a table file.
+func LoadTable(path string) (*Table, error) {
+	this := NewTable()
+	if err := this.Reload(path); err != nil {
+		return nil, err
+	}
+	return this, nil
+}
+
+// Reload replaces the table with the content of the file,
+// the current table is kept on errors.
+func (this *Table) Reload(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return this.Load(f)
+}
+
+// Load replaces the table with the entries read from r.
+func (this *Table) Load(r io.Reader) error {
+	t, err := parseTable(r)
+	if err != nil {
+		return err
+	}
+	this.mutex.Lock()
+	this.t = t
+	this.mutex.Unlock()
+	return nil
+}
+
+// Watch reloads the file whenever its modification time changes, until stop is closed.
+// Reload errors are passed to onError if not nil.
+func (this *Table) Watch(path string, interval time.Duration, stop <-chan struct{}, onError func(error)) {
+	var modTime time.Time
+	if fi, err := os.Stat(path); err == nil {
+		modTime = fi.ModTime()
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		fi, err := os.Stat(path)
+		if err == nil && fi.ModTime().Equal(modTime) {
+			continue
+		}
+		if err == nil {
+			modTime = fi.ModTime()
+			err = this.Reload(path)
+		}
+		if err != nil && onError != nil {
+			onError(err)
+		}
+	}
+}
+
+func parseTable(r io.Reader) (*table, error) {
+	t := newTable()
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i != -1 {
+			line = line[:i]
+		}
+		fields := strings.Fields(strings.Replace(line, ",", " ", -1))
+		if len(fields) == 0 {
+			continue
+		}
+
+		kind := strings.ToLower(fields[0])
+		args := fields[1:]
+		for i := range args {
+			args[i] = strings.ToLower(args[i])
+		}
+		switch {
+		case kind == "domain" && len(args) == 1:
+			t.domains[args[0]] = false
+		case kind == "domain" && len(args) == 2 && args[1] == "reject":
+			t.domains[args[0]] = true
+		case kind == "user" && len(args) == 1 && strings.Contains(args[0], "@"):
+			t.users[args[0]] = true
+		case kind == "alias" && len(args) >= 2 && strings.Contains(args[0], "@"):
+			t.aliases[args[0]] = append(t.aliases[args[0]], args[1:]...)
+		default:
+			return nil, fmt.Errorf("line %d: invalid entry %q", n, scanner.Text())
+		}
+	}
+	return t, scanner.Err()
+}
+
+// Resolve returns the addresses a recipient is delivered to.
+// Recipients outside the virtual domains are returned unchanged.
+func (this *Table) Resolve(rcpt string) ([]string, error) {
+	this.mutex.RLock()
+	t := this.t
+	this.mutex.RUnlock()
+
+	resolved := []string{}
+	seen := map[string]bool{}
+	if err := t.resolve(rcpt, 0, &resolved, seen); err != nil {
+		return nil, err
+	}
+	return resolved, nil
+}
+
+func (this *table) resolve(rcpt string, depth int, resolved *[]string, seen map[string]bool) error {
+	if depth > maxAliasDepth {
+		return errAliasLoop
+	}
+	addr := strings.ToLower(rcpt)
+	at := strings.LastIndex(addr, "@")
+	if at == -1 {
+		return ErrUnknownUser
+	}
+	local, domain := addr[:at], addr[at+1:]
+
+	rejected, virtual := this.domains[domain]
+	if rejected {
+		return ErrDomainRejected
+	}
+	if !virtual {
+		if !seen[addr] {
+			seen[addr] = true
+			*resolved = append(*resolved, rcpt)
+		}
+		return nil
+	}
+
+	base := addr
+	if i := strings.Index(local, tagSeparator); i > 0 {
+		base = local[:i] + "@" + domain
+	}
+
+	targets, ok := this.aliases[addr]
+	if !ok {
+		targets, ok = this.aliases[base]
+	}
+	if !ok && this.users[base] {
+		if !seen[addr] {
+			seen[addr] = true
+			*resolved = append(*resolved, rcpt)
+		}
+		return nil
+	}
+	if !ok {
+		targets, ok = this.aliases["@"+domain]
+	}
+	if !ok {
+		return ErrUnknownUser
+	}
+
+	for _, target := range targets {
+		// an alias to itself is the mailbox
+		if target == addr || target == base {
+			if !seen[target] {
+				seen[target] = true
+				*resolved = append(*resolved, target)
+			}
+			continue
+		}
+		if err := this.resolve(target, depth+1, resolved, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
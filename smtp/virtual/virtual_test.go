@@ -0,0 +1,100 @@
+package virtual
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testTable = `
+# virtual domains
+domain dtynn.me
+domain example.com
+domain spam.dtynn.me reject
+
+user bob@dtynn.me
+user alice@dtynn.me
+user carol@example.com
+
+alias team@dtynn.me bob@dtynn.me, alice@dtynn.me, friend@other.org
+alias all@dtynn.me team@dtynn.me, carol@example.com
+alias bob+list@dtynn.me carol@example.com
+alias loop@dtynn.me loop2@dtynn.me
+alias loop2@dtynn.me loop@dtynn.me
+alias @example.com carol@example.com
+`
+
+func TestResolve(t *testing.T) {
+	table := NewTable()
+	if err := table.Load(strings.NewReader(testTable)); err != nil {
+		t.Fatal("load: ", err)
+	}
+
+	cases := []struct {
+		rcpt   string
+		expect string
+		err    error
+	}{
+		{"bob@dtynn.me", "[bob@dtynn.me]", nil},
+		{"Bob@DTYNN.me", "[Bob@DTYNN.me]", nil},
+		{"bob+golang@dtynn.me", "[bob+golang@dtynn.me]", nil},
+		{"bob+list@dtynn.me", "[carol@example.com]", nil},
+		{"team@dtynn.me", "[bob@dtynn.me alice@dtynn.me friend@other.org]", nil},
+		{"all@dtynn.me", "[bob@dtynn.me alice@dtynn.me friend@other.org carol@example.com]", nil},
+		{"nobody@dtynn.me", "", ErrUnknownUser},
+		{"anyone@example.com", "[carol@example.com]", nil},
+		{"x@spam.dtynn.me", "", ErrDomainRejected},
+		{"someone@other.org", "[someone@other.org]", nil},
+		{"loop@dtynn.me", "", errAliasLoop},
+	}
+	for _, c := range cases {
+		got, err := table.Resolve(c.rcpt)
+		if err != c.err {
+			t.Errorf("%s: expect error %v, get %v", c.rcpt, c.err, err)
+			continue
+		}
+		if err == nil && fmt.Sprint(got) != c.expect {
+			t.Errorf("%s: expect %s, get %v", c.rcpt, c.expect, got)
+		}
+	}
+
+	if err := table.Load(strings.NewReader("alias nobody")); err == nil {
+		t.Error("expect error for invalid entry")
+	}
+	if _, err := table.Resolve("bob@dtynn.me"); err != nil {
+		t.Error("expect failed load to keep the table: ", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "virtual")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "virtual")
+	ioutil.WriteFile(path, []byte("domain dtynn.me\nuser bob@dtynn.me\n"), 0600)
+
+	table, err := LoadTable(path)
+	if err != nil {
+		t.Fatal("load: ", err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go table.Watch(path, 10*time.Millisecond, stop, nil)
+	time.Sleep(50 * time.Millisecond)
+
+	ioutil.WriteFile(path, []byte("domain dtynn.me\nuser alice@dtynn.me\n"), 0600)
+	os.Chtimes(path, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	for i := 0; i < 100; i++ {
+		if _, err := table.Resolve("alice@dtynn.me"); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("table not reloaded")
+}
@@ -0,0 +1,270 @@
+// Package srs implements the Sender Rewriting Scheme, which keeps SPF passing
+// for forwarded mail by rewriting the envelope sender into the forwarder's domain:
+//
+//	SRS0=HHHH=TT=orig.domain=orig-local@forwarder.domain
+//	SRS1=HHHH=first.forwarder==HHHH=TT=orig.domain=orig-local@forwarder.domain
+//
+// HHHH is a truncated HMAC over the rest of the address and TT the day of the
+// rewrite, so bounces can be routed back without keeping any state.
+package srs
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	srs0Tag       = "SRS0"
+	srs1Tag       = "SRS1"
+	separator     = "="
+	hashLength    = 4
+	timeBase      = "ABCDEFGHIJKLMNOPQRSTUVWXYZ234567"
+	timePrecision = 24 * time.Hour
+	timeSlots     = 1024 // two base32 characters
+
+	DefaultMaxAge = 21 * 24 * time.Hour
+)
+
+var (
+	errNoSecret       = fmt.Errorf("srs: no secret configured")
+	errInvalidAddress = fmt.Errorf("srs: invalid address")
+	errNotSrs         = fmt.Errorf("srs: not a srs address")
+	errBadHash        = fmt.Errorf("srs: hash mismatch")
+	errBadTimestamp   = fmt.Errorf("srs: invalid timestamp")
+	errExpired        = fmt.Errorf("srs: address expired")
+)
+
+// Rewriter rewrites envelope senders into its domain and reverses them.
+// The first secret signs new addresses, all of them are accepted on reversal,
+// so a secret can be rotated by prepending the new one and dropping the old
+// one after MaxAge.
+type Rewriter struct {
+	domain string
+	maxAge time.Duration
+	now    func() time.Time
+
+	lock    sync.RWMutex
+	secrets [][]byte
+	local   map[string]bool
+}
+
+func NewRewriter(domain string, secrets ...string) *Rewriter {
+	r := &Rewriter{
+		domain: strings.ToLower(domain),
+		maxAge: DefaultMaxAge,
+		now:    time.Now,
+		local:  map[string]bool{},
+	}
+	r.SetSecrets(secrets...)
+	return r
+}
+
+func (this *Rewriter) Domain() string {
+	return this.domain
+}
+
+// SetSecrets replaces the secrets, the first one signs.
+func (this *Rewriter) SetSecrets(secrets ...string) {
+	keys := make([][]byte, 0, len(secrets))
+	for _, s := range secrets {
+		if s != "" {
+			keys = append(keys, []byte(s))
+		}
+	}
+	this.lock.Lock()
+	this.secrets = keys
+	this.lock.Unlock()
+}
+
+// SetLocalDomains sets the domains whose senders are not rewritten,
+// i.e. the ones whose SPF records already cover us.
+func (this *Rewriter) SetLocalDomains(domains ...string) {
+	local := map[string]bool{}
+	for _, d := range domains {
+		local[strings.ToLower(d)] = true
+	}
+	this.lock.Lock()
+	this.local = local
+	this.lock.Unlock()
+}
+
+func (this *Rewriter) SetMaxAge(d time.Duration) {
+	this.maxAge = d
+}
+
+// Forward rewrites the envelope sender of a forwarded message.
+// The null sender and senders of the rewriter or local domains are returned unchanged.
+func (this *Rewriter) Forward(addr string) (string, error) {
+	if addr == "" {
+		return "", nil
+	}
+	local, domain, ok := splitAddress(addr)
+	if !ok {
+		return "", errInvalidAddress
+	}
+	lower := strings.ToLower(domain)
+	this.lock.RLock()
+	skip := lower == this.domain || this.local[lower]
+	this.lock.RUnlock()
+	if skip {
+		return addr, nil
+	}
+
+	if tag, rest, ok := splitTag(local); ok {
+		var first, opaque string
+		if tag == srs0Tag {
+			// SRS0=... of the previous hop: SRS1=HHHH=prev.hop==...
+			first, opaque = domain, rest
+		} else {
+			// SRS1=HHHH=first==... of another forwarder: keep the first hop
+			parts := strings.SplitN(rest[1:], separator, 3)
+			if len(parts) != 3 {
+				return "", errInvalidAddress
+			}
+			first, opaque = parts[1], parts[2]
+		}
+		hash, err := this.hash(first, opaque)
+		if err != nil {
+			return "", err
+		}
+		return srs1Tag + separator + hash + separator + first + separator + opaque + "@" + this.domain, nil
+	}
+
+	ts := this.timestamp()
+	hash, err := this.hash(ts, domain, local)
+	if err != nil {
+		return "", err
+	}
+	return srs0Tag + separator + strings.Join([]string{hash, ts, domain, local}, separator) +
+		"@" + this.domain, nil
+}
+
+// IsSrs reports whether addr is a SRS address of the rewriter's domain.
+func (this *Rewriter) IsSrs(addr string) bool {
+	local, domain, ok := splitAddress(addr)
+	if !ok || !strings.EqualFold(domain, this.domain) {
+		return false
+	}
+	_, _, ok = splitTag(local)
+	return ok
+}
+
+// Reverse returns the address a SRS address was made of,
+// the original sender for SRS0 and the SRS0 address of the first hop for SRS1.
+func (this *Rewriter) Reverse(addr string) (string, error) {
+	if !this.IsSrs(addr) {
+		return "", errNotSrs
+	}
+	local, _, _ := splitAddress(addr)
+	tag, rest, _ := splitTag(local)
+
+	if tag == srs1Tag {
+		parts := strings.SplitN(rest[1:], separator, 3)
+		if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+			return "", errInvalidAddress
+		}
+		if err := this.checkHash(parts[0], parts[1], parts[2]); err != nil {
+			return "", err
+		}
+		return srs0Tag + parts[2] + "@" + parts[1], nil
+	}
+
+	parts := strings.SplitN(rest[1:], separator, 4)
+	if len(parts) != 4 || parts[2] == "" || parts[3] == "" {
+		return "", errInvalidAddress
+	}
+	if err := this.checkHash(parts[0], parts[1], parts[2], parts[3]); err != nil {
+		return "", err
+	}
+	if err := this.checkTimestamp(parts[1]); err != nil {
+		return "", err
+	}
+	return parts[3] + "@" + parts[2], nil
+}
+
+func (this *Rewriter) hash(data ...string) (string, error) {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if len(this.secrets) == 0 {
+		return "", errNoSecret
+	}
+	return makeHash(this.secrets[0], data), nil
+}
+
+func (this *Rewriter) checkHash(hash string, data ...string) error {
+	this.lock.RLock()
+	defer this.lock.RUnlock()
+	if len(this.secrets) == 0 {
+		return errNoSecret
+	}
+	for _, secret := range this.secrets {
+		// mail systems may change the case of local parts
+		if strings.EqualFold(hash, makeHash(secret, data)) {
+			return nil
+		}
+	}
+	return errBadHash
+}
+
+func (this *Rewriter) timestamp() string {
+	day := this.now().Unix() / int64(timePrecision/time.Second) % timeSlots
+	return string([]byte{timeBase[day>>5], timeBase[day&31]})
+}
+
+func (this *Rewriter) checkTimestamp(ts string) error {
+	if len(ts) != 2 {
+		return errBadTimestamp
+	}
+	var then int64
+	for _, c := range strings.ToUpper(ts) {
+		i := strings.IndexRune(timeBase, c)
+		if i == -1 {
+			return errBadTimestamp
+		}
+		then = then<<5 | int64(i)
+	}
+	today := this.now().Unix() / int64(timePrecision/time.Second) % timeSlots
+	age := (today - then + timeSlots) % timeSlots
+	if time.Duration(age)*timePrecision > this.maxAge {
+		return errExpired
+	}
+	return nil
+}
+
+func makeHash(secret []byte, data []string) string {
+	mac := hmac.New(sha1.New, secret)
+	for _, d := range data {
+		mac.Write([]byte(strings.ToLower(d)))
+	}
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))[:hashLength]
+}
+
+// splitTag splits SRS0=rest or SRS1=rest, rest starting with the separator.
+// Other forwarders may use + or - after the tag.
+func splitTag(local string) (string, string, bool) {
+	if len(local) < len(srs0Tag)+2 {
+		return "", "", false
+	}
+	tag := strings.ToUpper(local[:len(srs0Tag)])
+	if tag != srs0Tag && tag != srs1Tag {
+		return "", "", false
+	}
+	rest := local[len(srs0Tag):]
+	if !strings.ContainsAny(rest[:1], "=+-") {
+		return "", "", false
+	}
+	return tag, rest, true
+}
+
+func splitAddress(addr string) (string, string, bool) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", false
+	}
+	return addr[:i], addr[i+1:], true
+}
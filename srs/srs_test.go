@@ -0,0 +1,106 @@
+package srs
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestRewriter(domain string, secrets ...string) *Rewriter {
+	r := NewRewriter(domain, secrets...)
+	r.now = func() time.Time { return time.Date(2014, 11, 25, 10, 0, 0, 0, time.UTC) }
+	return r
+}
+
+func TestForwardReverse(t *testing.T) {
+	r := newTestRewriter("fwd.dtynn.me", "secret")
+	r.SetLocalDomains("dtynn.me")
+
+	for _, addr := range []string{"", "bob@dtynn.me", "x@FWD.dtynn.me"} {
+		if got, err := r.Forward(addr); err != nil || got != addr {
+			t.Errorf("expect %q unchanged, get %q %v", addr, got, err)
+		}
+	}
+
+	srs0, err := r.Forward("alice=x@example.com")
+	if err != nil {
+		t.Fatal("forward: ", err)
+	}
+	if !strings.HasPrefix(srs0, "SRS0=") || !strings.HasSuffix(srs0, "=AP=example.com=alice=x@fwd.dtynn.me") {
+		t.Errorf("unexpected srs0 %s", srs0)
+	}
+	if orig, err := r.Reverse(srs0); err != nil || orig != "alice=x@example.com" {
+		t.Errorf("expect original sender, get %q %v", orig, err)
+	}
+	if orig, err := r.Reverse(strings.ToLower(srs0)); err != nil || orig != "alice=x@example.com" {
+		t.Errorf("expect case insensitive hash, get %q %v", orig, err)
+	}
+
+	// second hop
+	next := newTestRewriter("other.example.org", "another")
+	srs1, err := next.Forward(srs0)
+	if err != nil {
+		t.Fatal("forward srs0: ", err)
+	}
+	if !strings.HasPrefix(srs1, "SRS1=") || !strings.Contains(srs1, "=fwd.dtynn.me==") {
+		t.Errorf("unexpected srs1 %s", srs1)
+	}
+	if prev, err := next.Reverse(srs1); err != nil || prev != srs0 {
+		t.Errorf("expect %s, get %q %v", srs0, prev, err)
+	}
+
+	// third hop keeps the first forwarder
+	third := newTestRewriter("third.example.net", "third")
+	srs1b, err := third.Forward(srs1)
+	if err != nil {
+		t.Fatal("forward srs1: ", err)
+	}
+	if prev, err := third.Reverse(srs1b); err != nil || prev != srs0 {
+		t.Errorf("expect %s, get %q %v", srs0, prev, err)
+	}
+}
+
+func TestReverseErrors(t *testing.T) {
+	r := newTestRewriter("fwd.dtynn.me", "secret")
+	srs0, _ := r.Forward("alice@example.com")
+
+	tampered := strings.Replace(srs0, "alice", "mallory", 1)
+	if _, err := r.Reverse(tampered); err != errBadHash {
+		t.Errorf("expect hash error, get %v", err)
+	}
+	if _, err := r.Reverse("bob@fwd.dtynn.me"); err != errNotSrs {
+		t.Errorf("expect not srs, get %v", err)
+	}
+	if _, err := r.Reverse(strings.Replace(srs0, "@fwd.dtynn.me", "@other.org", 1)); err != errNotSrs {
+		t.Errorf("expect not srs for other domain, get %v", err)
+	}
+
+	r.now = func() time.Time { return time.Date(2014, 12, 25, 10, 0, 0, 0, time.UTC) }
+	if _, err := r.Reverse(srs0); err != errExpired {
+		t.Errorf("expect expired, get %v", err)
+	}
+}
+
+func TestSecretRotation(t *testing.T) {
+	r := newTestRewriter("fwd.dtynn.me", "old")
+	srs0, _ := r.Forward("alice@example.com")
+
+	r.SetSecrets("new", "old")
+	if _, err := r.Reverse(srs0); err != nil {
+		t.Errorf("expect old secret accepted, get %v", err)
+	}
+	rotated, _ := r.Forward("alice@example.com")
+	if rotated == srs0 {
+		t.Error("expect new secret to sign")
+	}
+
+	r.SetSecrets("new")
+	if _, err := r.Reverse(srs0); err != errBadHash {
+		t.Errorf("expect dropped secret rejected, get %v", err)
+	}
+
+	r.SetSecrets()
+	if _, err := r.Forward("alice@example.com"); err != errNoSecret {
+		t.Errorf("expect no secret error, get %v", err)
+	}
+}